@@ -0,0 +1,135 @@
+package btreeplus
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// key size distributions the benchmarks run with
+var benchKeySizes = []struct {
+	name string
+	size func(r *rand.Rand) int
+}{
+	{"small", func(r *rand.Rand) int { return 8 }},
+	{"medium", func(r *rand.Rand) int { return 64 }},
+	{"large", func(r *rand.Rand) int { return 512 }},
+	{"mixed", func(r *rand.Rand) int { return 4 + r.Intn(200) }},
+}
+
+// n distinct random keys, their sizes drawn from size
+func benchKeys(n int, size func(r *rand.Rand) int) []ByteArr {
+	r := rand.New(rand.NewSource(1))
+	seen := make(map[string]bool, n)
+	keys := make([]ByteArr, 0, n)
+	for len(keys) < n {
+		key := make(ByteArr, size(r))
+		r.Read(key)
+		key[0] |= 1 // never empty, never the sentinel
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func benchTree(keys []ByteArr) *BtreeContainer {
+	treeContainer := NewBTS()
+	for _, key := range keys {
+		treeContainer.tree.Insert(key, ByteArr("value"))
+	}
+	return treeContainer
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, dist := range benchKeySizes {
+		b.Run(dist.name, func(b *testing.B) {
+			keys := benchKeys(10000, dist.size)
+			treeContainer := benchTree(keys)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				treeContainer.tree.Get(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	for _, dist := range benchKeySizes {
+		b.Run(dist.name, func(b *testing.B) {
+			keys := benchKeys(10000, dist.size)
+			treeContainer := benchTree(keys)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// overwrites keep the tree at a steady size
+				treeContainer.tree.Insert(keys[i%len(keys)], ByteArr("other"))
+			}
+		})
+	}
+}
+
+func BenchmarkDelete(b *testing.B) {
+	for _, dist := range benchKeySizes {
+		b.Run(dist.name, func(b *testing.B) {
+			keys := benchKeys(10000, dist.size)
+			treeContainer := benchTree(keys)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// delete and put back, so there is always something to delete
+				key := keys[i%len(keys)]
+				treeContainer.tree.Delete(key)
+				b.StopTimer()
+				treeContainer.tree.Insert(key, ByteArr("value"))
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// the lookup alone, against the linear scan it replaced
+func BenchmarkNodeLookup(b *testing.B) {
+	for _, n := range []int{16, 64, 200} {
+		node := lookupTestNode(n)
+		keys := make([]ByteArr, 2*n)
+		for i := range keys {
+			keys[i] = ByteArr(fmt.Sprintf("k%04d", i))
+		}
+
+		b.Run(fmt.Sprintf("binary/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				nodeLookupLE(node, keys[i%len(keys)])
+			}
+		})
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				nodeLookupLELinear(node, keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+// a tree of 10000 keys, inserted one by one or bulk loaded
+func BenchmarkBuild(b *testing.B) {
+	keys := benchKeys(10000, benchKeySizes[1].size)
+	slices.SortFunc(keys, func(a, b ByteArr) int { return bytes.Compare(a, b) })
+
+	b.Run("insert", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			benchTree(keys)
+		}
+	})
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			NewBTS().tree.BulkLoad(func(yield func(k, v ByteArr) bool) {
+				for _, key := range keys {
+					if !yield(key, ByteArr("value")) {
+						return
+					}
+				}
+			}, 0)
+		}
+	})
+}
@@ -2,10 +2,42 @@ package btreeplus
 
 import (
 	"beaver/helpers"
-	"bytes"
+	"errors"
 	"fmt"
 )
 
+var (
+	ErrEmptyKey    = errors.New("empty key")
+	ErrKeyTooLarge = errors.New("key too large")
+	ErrValTooLarge = errors.New("value too large")
+	ErrNotFound    = errors.New("key not found")
+	ErrUnsorted    = errors.New("keys out of order")
+	ErrNotEmpty    = errors.New("tree not empty")
+	ErrPageSize    = errors.New("unsupported page size")
+	// ErrCorrupt is wrapped by the errors about damaged pages
+	ErrCorrupt = errors.New("corrupt page")
+)
+
+// corruptf reports a damaged page. Pages come from callbacks that can't
+// fail, so the error is panicked and turned back into one by catchCorrupt
+// at the exported methods; the get callback may do the same with its own
+// errors, as long as they wrap ErrCorrupt.
+func corruptf(format string, args ...any) {
+	panic(fmt.Errorf("%w: "+format, append([]any{ErrCorrupt}, args...)...))
+}
+
+// catchCorrupt stores the error of a panic raised by corruptf in err. Any
+// other panic is a bug, and goes on.
+func catchCorrupt(err *error) {
+	if r := recover(); r != nil {
+		if e, ok := r.(error); ok && errors.Is(e, ErrCorrupt) {
+			*err = e
+			return
+		}
+		panic(r)
+	}
+}
+
 type BTree struct {
 	// root pointer (a nonzero page number)
 	root uint64
@@ -13,25 +45,108 @@ type BTree struct {
 	get func(uint64) BNode // read data from a page number
 	new func(BNode) uint64 // allocate a new page number with data
 	del func(uint64)       // deallocate a page number
+	raw func(uint64) BNode // get before any decoding, as the page is stored
+	// expanded nodes of prefix compressed pages
+	cache *NodeCache
+	// size of the pages, 0 means BTREE_PAGE_SIZE
+	pageSize int
+	prefix   bool       // pages are prefix compressed
+	cmp      Comparator // key order, zero means BytesComparator
+}
+
+// Option configures a BTree at construction.
+type Option func(*BTree)
+
+// WithPageSize sets the size of the pages the tree is laid out in. It must
+// be one of PAGE_SIZES, NewBTree fails with ErrPageSize otherwise.
+func WithPageSize(size int) Option {
+	return func(tree *BTree) {
+		tree.pageSize = size
+	}
 }
 
 func NewBTree(get func(uint64) BNode,
 	new func(BNode) uint64,
-	del func(uint64)) BTree {
-	return BTree{
+	del func(uint64), opts ...Option) (BTree, error) {
+	tree := BTree{
 		get: get,
 		new: new,
 		del: del,
+		raw: get,
+	}
+	for _, opt := range opts {
+		opt(&tree)
 	}
+	if !ValidPageSize(tree.PageSize()) {
+		return BTree{}, fmt.Errorf("%w: %d", ErrPageSize, tree.pageSize)
+	}
+	if tree.prefix {
+		if tree.PageSize() > PREFIX_MAX_PAGE_SIZE {
+			return BTree{}, fmt.Errorf("%w: %d with prefix compression", ErrPageSize, tree.pageSize)
+		}
+		if tree.cache == nil {
+			tree.cache = NewNodeCache(PREFIX_CACHE_NODES)
+		}
+		usePrefixCompression(&tree)
+	}
+	return tree, nil
 }
 
-func checkLimit(key, val ByteArr) error {
+// readNode reads a node of the tree, refusing a page that can't be one:
+// reading it as a node would go astray. The bounds are those Check goes by.
+func (tree *BTree) readNode(ptr uint64) BNode {
+	node := tree.get(ptr)
+	if len(node) < HEADER_SIZE {
+		corruptf("page %d: page of %d bytes", ptr, len(node))
+	}
+	if t := NodeType(node.btype()); t != InternalNode && t != LeafNode {
+		corruptf("page %d: bad node type %d", ptr, node.btype())
+	}
+	if err := checkPlain(node, len(node)); err != nil {
+		corruptf("page %d: %v", ptr, err)
+	}
+	return node
+}
+
+func (tree *BTree) PageSize() int {
+	if tree.pageSize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return tree.pageSize
+}
+
+func (tree *BTree) layout() layout {
+	return layout{pageSize: tree.PageSize(), prefix: tree.prefix}
+}
+
+func (tree *BTree) newNode() BNode {
+	return BNode(make([]byte, tree.layout().nodeCap()))
+}
+
+// a node with room to hold a full node plus one more KV
+func (tree *BTree) newOverfullNode() BNode {
+	return BNode(make([]byte, tree.layout().nodeCap()+tree.PageSize()))
+}
+
+// checkKey rejects the keys the tree can't hold: the empty key is the
+// sentinel.
+func checkKey(key ByteArr) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
 	if len(key) > BTREE_MAX_KEY_SIZE {
-		return fmt.Errorf("key limit exceeded")
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrKeyTooLarge, len(key), BTREE_MAX_KEY_SIZE)
+	}
+	return nil
+}
+
+func checkLimit(key, val ByteArr) error {
+	if err := checkKey(key); err != nil {
+		return err
 	}
 
-	if len(val) > BTREE_MAX_VAL_SIZE {
-		return fmt.Errorf("val limit exceeded")
+	if len(val) > BTREE_MAX_OVERFLOW_VAL_SIZE {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrValTooLarge, len(val), BTREE_MAX_OVERFLOW_VAL_SIZE)
 	}
 
 	return nil
@@ -49,25 +164,28 @@ func nodeReplaceKidN(tree *BTree, new, old BNode, idx uint16, kids ...BNode) {
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
 
-func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
+// ptr is the overflow chain of val, 0 if stored inline
+func treeInsert(tree *BTree, node BNode, key []byte, ptr uint64, val []byte) BNode {
 	// The extra size allows it to exceed 1 page temporarily.
-	new := BNode(make([]byte, 2*BTREE_PAGE_SIZE))
+	new := tree.newOverfullNode()
 
-	idx := nodeLookupLE(node, key)
+	idx := tree.lookupLE(node, key)
 	switch NodeType(node.btype()) {
 	case LeafNode: // leaf node
 		k, _ := node.getKeyAndVal(idx)
 
-		if bytes.Equal(key, k) {
-			leafUpsert(new, node, idx, key, val, 0x01)
+		if tree.Compare(key, k) == 0 {
+			// the overwritten value goes along with its chain
+			overflowFree(tree, node.getPtr(idx))
+			leafUpsert(new, node, idx, ptr, key, val, 0x01)
 		} else {
-			leafUpsert(new, node, idx+1, key, val, 0x00)
+			leafUpsert(new, node, idx+1, ptr, key, val, 0x00)
 		}
 	case InternalNode: // internal node, walk into the child node
 		kptr := node.getPtr(idx)
-		knode := treeInsert(tree, tree.get(kptr), key, val)
+		knode := treeInsert(tree, tree.readNode(kptr), key, ptr, val)
 
-		nsplit, split := nodeSplit3(knode)
+		nsplit, split := nodeSplit3(knode, tree.layout())
 
 		// remove old page since cow
 		defer tree.del(kptr)
@@ -78,29 +196,43 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 	return new
 }
 
-func (tree *BTree) Insert(key, val ByteArr) error {
+// Insert sets the value of key. A damaged page met on the way fails it
+// with an error wrapping ErrCorrupt, after which the pages allocated and
+// freed so far must be rolled back by the caller.
+func (tree *BTree) Insert(key, val ByteArr) (err error) {
 
 	if err := checkLimit(key, val); err != nil {
 		return err
 	}
+	defer catchCorrupt(&err)
+
+	ptr := uint64(0)
+	if len(val) > maxInlineVal(tree.PageSize()) {
+		ptr, val = overflowWrite(tree, val)
+	}
 
 	// sentinel value
 	if tree.root == 0 {
-		root := NewBnode()
+		root := tree.newNode()
 		root.setHeader(uint16(LeafNode), 2)
 		nodeAppendKV(root, 0, 0, nil, nil)
-		nodeAppendKV(root, 1, 0, key, val)
+		nodeAppendKV(root, 1, ptr, key, val)
 		tree.root = tree.new(root)
 		return nil
 	}
 
-	node := treeInsert(tree, tree.get(tree.root), key, val)
-
-	nsplit, split := nodeSplit3(node)
+	node := treeInsert(tree, tree.readNode(tree.root), key, ptr, val)
 	defer tree.del(tree.root)
+	replaceRoot(tree, node)
+	return nil
+}
 
+// replaceRoot makes node the root, splitting it under a new root if it
+// doesn't fit in a page.
+func replaceRoot(tree *BTree, node BNode) {
+	nsplit, split := nodeSplit3(node, tree.layout())
 	if nsplit > 1 {
-		newRoot := NewBnode()
+		newRoot := tree.newNode()
 		newRoot.setHeader(uint16(InternalNode), nsplit)
 
 		for i, knode := range split[:nsplit] {
@@ -112,26 +244,24 @@ func (tree *BTree) Insert(key, val ByteArr) error {
 	} else {
 		tree.root = tree.new(split[0])
 	}
-	return nil
 }
 
 func shouldMerge(tree *BTree, node BNode, idx uint16, updatedKid BNode) (int, BNode) {
-	if updatedKid.nbytes() > BTREE_PAGE_SIZE/4 {
+	l := tree.layout()
+	if _, written := l.size(updatedKid, 0, updatedKid.nkeys()); written > l.pageSize/4 {
 		return 0, BNode{}
 	}
 
 	if idx > 0 {
-		sibling := tree.get(node.getPtr(idx - 1))
-		merged := sibling.nbytes() + updatedKid.nbytes() - HEADER_SIZE
-		if merged <= BTREE_PAGE_SIZE {
+		sibling := tree.readNode(node.getPtr(idx - 1))
+		if l.mergedFits(sibling, updatedKid) {
 			return -1, sibling // left
 		}
 	}
 
 	if idx+1 < node.nkeys() {
-		sibling := tree.get(node.getPtr(idx + 1))
-		merged := sibling.nbytes() + updatedKid.nbytes() - HEADER_SIZE
-		if merged <= BTREE_PAGE_SIZE {
+		sibling := tree.readNode(node.getPtr(idx + 1))
+		if l.mergedFits(updatedKid, sibling) {
 			return +1, sibling // right
 		}
 	}
@@ -140,36 +270,39 @@ func shouldMerge(tree *BTree, node BNode, idx uint16, updatedKid BNode) (int, BN
 
 // delete a key from the tree
 func treeDelete(tree *BTree, node BNode, key ByteArr) BNode {
-	idx := nodeLookupLE(node, key)
+	idx := tree.lookupLE(node, key)
 
 	switch NodeType(node.btype()) {
 	case LeafNode:
 		k, _ := node.getKeyAndVal(idx)
-		if !bytes.Equal(key, k) {
+		if tree.Compare(key, k) != 0 {
 			return nil
 		}
-		new := NewBnode()
+		overflowFree(tree, node.getPtr(idx))
+		new := tree.newNode()
 		leafDelete(new, node, idx)
 		return new
 	case InternalNode:
 		return nodeDelete(tree, node, idx, key)
 	}
 
-	// this won't occur
+	// this won't occur, readNode checked the type
 	return nil
 }
 
 // nodeDelete takes care of recursing the internal nodes + merging
 func nodeDelete(tree *BTree, node BNode, idx uint16, key ByteArr) BNode {
 	childptr := node.getPtr(idx)
-	updatedChildPage := treeDelete(tree, tree.get(childptr), key)
+	updatedChildPage := treeDelete(tree, tree.readNode(childptr), key)
 
 	if len(updatedChildPage) == 0 {
 		return BNode{}
 	}
 
 	defer tree.del(childptr)
-	new := NewBnode()
+	// a separator key may change, and get longer (or share less of the
+	// prefix): the node could outgrow its page, the parent splits it
+	new := tree.newOverfullNode()
 
 	mergeDir, sibling := shouldMerge(tree, node, idx, updatedChildPage)
 
@@ -178,15 +311,16 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key ByteArr) BNode {
 		helpers.Assert(node.nkeys() == 1 && idx == 0)
 		new.setHeader(uint16(InternalNode), 0)
 	case mergeDir == 0 && updatedChildPage.nkeys() > 0:
-		nodeReplaceKidN(tree, new, node, idx, updatedChildPage)
+		nsplit, split := nodeSplit3(updatedChildPage, tree.layout())
+		nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
 	case mergeDir == -1: // left dir
-		merged := NewBnode()
+		merged := tree.newNode()
 		nodeMerge(merged, sibling, updatedChildPage)
 		defer tree.del(node.getPtr(idx - 1))
 		newKey, _ := merged.getKeyAndVal(0)
 		nodeReplace2Kid(new, node, idx-1, tree.new(merged), newKey)
 	case mergeDir == 1: // right dir
-		merged := NewBnode()
+		merged := tree.newNode()
 		nodeMerge(merged, updatedChildPage, sibling)
 		tree.del(node.getPtr(idx + 1))
 		newKey, _ := merged.getKeyAndVal(0)
@@ -195,14 +329,22 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key ByteArr) BNode {
 	return new
 }
 
-func (tree *BTree) Delete(key ByteArr) (bool, error) {
+// Delete removes key, failing with ErrNotFound if it isn't there. Damaged
+// pages are reported as by Insert.
+func (tree *BTree) Delete(key ByteArr) (deleted bool, err error) {
+
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	defer catchCorrupt(&err)
 
-	helpers.Assert(len(key) != 0)
-	helpers.Assert(len(key) < BTREE_MAX_KEY_SIZE)
+	if tree.root == 0 {
+		return false, ErrNotFound
+	}
 
-	updated := treeDelete(tree, tree.get(tree.root), key)
+	updated := treeDelete(tree, tree.readNode(tree.root), key)
 	if len(updated) == 0 {
-		return false, fmt.Errorf("key not found")
+		return false, ErrNotFound
 	}
 
 	defer tree.del(tree.root)
@@ -210,37 +352,42 @@ func (tree *BTree) Delete(key ByteArr) (bool, error) {
 	if NodeType(updated.btype()) == InternalNode && updated.nkeys() == 1 {
 		tree.root = updated.getPtr(0)
 	} else {
-		tree.root = tree.new(updated)
+		replaceRoot(tree, updated)
 	}
 
 	return true, nil
 }
 
-func (tree *BTree) Get(key ByteArr) (retKey, retVal ByteArr) {
-	retKey = key
-	helpers.Assert(len(key) != 0 && len(key) < BTREE_MAX_KEY_SIZE)
+// Get returns the key as stored, which another comparator than Bytes may
+// consider equal to key without being the same, and its value. It fails
+// with ErrNotFound if there is no such key.
+func (tree *BTree) Get(key ByteArr) (retKey, retVal ByteArr, err error) {
+	if err := checkKey(key); err != nil {
+		return nil, nil, err
+	}
+	defer catchCorrupt(&err)
 	if tree.root == 0 {
-		return nil, nil
+		return nil, nil, ErrNotFound
 	}
 
 	var node BNode
-	for node = tree.get(tree.root); NodeType(node.btype()) != LeafNode; {
-		idx := nodeLookupLE(node, key)
+	for node = tree.readNode(tree.root); NodeType(node.btype()) != LeafNode; {
+		idx := tree.lookupLE(node, key)
 		kaddr := node.getPtr(idx)
 		if kaddr == 0 {
-			return nil, nil
+			return nil, nil, ErrNotFound
 		}
-		node = tree.get(kaddr)
+		node = tree.readNode(kaddr)
 	}
 
-	idx := nodeLookupLE(node, key)
+	idx := tree.lookupLE(node, key)
 
-	_k, _v := node.getKeyAndVal(idx)
-	if bytes.Equal(_k, key) {
-		return _k, _v
+	_k, _ := node.getKeyAndVal(idx)
+	if tree.Compare(_k, key) == 0 {
+		return _k, leafVal(tree, node, idx), nil
 	}
 
-	return nil, nil
+	return nil, nil, ErrNotFound
 }
 
 func (tree *BTree) GetRoot() uint64 {
@@ -1,37 +1,35 @@
 package btreeplus
 
-import (
-	"beaver/helpers"
-	"bytes"
-)
-
-func (tree *BTree) _internalsFetchNodeChain(key ByteArr) ([]BNode, bool) {
-	helpers.Assert(len(key) != 0 && len(key) < BTREE_MAX_KEY_SIZE)
+func (tree *BTree) _internalsFetchNodeChain(key ByteArr) (_ []BNode, _ bool, err error) {
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
+	defer catchCorrupt(&err)
 	var bnodeChain []BNode = make([]BNode, 0)
 
 	if tree.root == 0 {
-		return bnodeChain, false
+		return bnodeChain, false, nil
 	}
 
 	var node BNode
-	for node = tree.get(tree.root); NodeType(node.btype()) != LeafNode; {
+	for node = tree.readNode(tree.root); NodeType(node.btype()) != LeafNode; {
 		bnodeChain = append(bnodeChain, node)
-		idx := nodeLookupLE(node, key)
+		idx := tree.lookupLE(node, key)
 		kaddr := node.getPtr(idx)
 		if kaddr == 0 {
-			return bnodeChain, false
+			return bnodeChain, false, nil
 		}
-		node = tree.get(kaddr)
+		node = tree.readNode(kaddr)
 	}
 
 	bnodeChain = append(bnodeChain, node)
-	idx := nodeLookupLE(node, key)
+	idx := tree.lookupLE(node, key)
 
 	_k, _ := node.getKeyAndVal(idx)
-	if bytes.Equal(_k, key) {
-		return bnodeChain, true
+	if tree.Compare(_k, key) == 0 {
+		return bnodeChain, true, nil
 	}
 
-	return bnodeChain, false
+	return bnodeChain, false, nil
 
 }
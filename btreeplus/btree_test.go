@@ -2,7 +2,9 @@ package btreeplus
 
 import (
 	"beaver/helpers"
+	"encoding/binary"
 	"fmt"
+	"strings"
 	"testing"
 	"unsafe"
 
@@ -51,8 +53,10 @@ func (c *BtreeContainer) Del(key string) (bool, error) {
 	return c.tree.Delete(ByteArr(key))
 }
 
+// Get returns nils for a missing key
 func (c *BtreeContainer) Get(key string) (ByteArr, ByteArr) {
-	return c.tree.Get(ByteArr(key))
+	k, v, _ := c.tree.Get(ByteArr(key))
+	return k, v
 }
 
 func (c *BtreeContainer) PrintTree() {
@@ -109,7 +113,7 @@ func TestKeyDeletion(t *testing.T) {
 	// same deletion should be a no-op
 
 	res, err = treeContainer.Del("k9")
-	assert.NotNil(t, err)
+	assert.ErrorIs(t, err, ErrNotFound)
 	assert.False(t, res)
 }
 
@@ -120,8 +124,9 @@ func TestPageChain(t *testing.T) {
 		treeContainer.Add(fmt.Sprintf("k%d", i), fmt.Sprintf("mickey%d", i))
 	}
 
-	chain, res := treeContainer.tree._internalsFetchNodeChain(ByteArr("k5"))
+	chain, res, err := treeContainer.tree._internalsFetchNodeChain(ByteArr("k5"))
 
+	assert.Nil(t, err)
 	assert.True(t, res, "Page should exist")
 	assert.NotEmpty(t, chain, "chain should be there")
 	assert.Len(t, chain, 1, "only one page should be there")
@@ -130,6 +135,84 @@ func TestPageChain(t *testing.T) {
 	assert.Equal(t, uint16(10), page0.nkeys()) // num of keys = n + 1 (because of sentinal value)
 }
 
+func TestKeyErrors(t *testing.T) {
+	treeContainer := NewBTS()
+	tree := &treeContainer.tree
+	long := ByteArr(strings.Repeat("k", BTREE_MAX_KEY_SIZE+1))
+
+	assert.ErrorIs(t, tree.Insert(nil, ByteArr("v")), ErrEmptyKey)
+	assert.ErrorIs(t, tree.Insert(long, ByteArr("v")), ErrKeyTooLarge)
+	assert.Nil(t, tree.Insert(long[1:], ByteArr("v")))
+
+	_, _, err := tree.Get(nil)
+	assert.ErrorIs(t, err, ErrEmptyKey)
+	_, _, err = tree.Get(long)
+	assert.ErrorIs(t, err, ErrKeyTooLarge)
+	_, _, err = tree._internalsFetchNodeChain(long)
+	assert.ErrorIs(t, err, ErrKeyTooLarge)
+	_, found, err := tree._internalsFetchNodeChain(long[1:])
+	assert.Nil(t, err)
+	assert.True(t, found)
+	_, _, err = tree.Get(ByteArr("missing"))
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = tree.Delete(ByteArr{})
+	assert.ErrorIs(t, err, ErrEmptyKey)
+	_, err = tree.Delete(long)
+	assert.ErrorIs(t, err, ErrKeyTooLarge)
+	_, err = tree.Delete(ByteArr("missing"))
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestCorruptPage(t *testing.T) {
+	treeContainer := NewBTS()
+	for i := 0; i < 500; i++ {
+		treeContainer.Add(fmt.Sprintf("k%03d", i), "v")
+	}
+	treeContainer.Add("k250", bigVal(2*OVERFLOW_DATA_SIZE, 1))
+	tree := &treeContainer.tree
+
+	// the overflow chain of k250 loses its last page
+	chain, _, _ := tree._internalsFetchNodeChain(ByteArr("k250"))
+	node := chain[len(chain)-1]
+	first := node.getPtr(tree.lookupLE(node, ByteArr("k250")))
+	binary.LittleEndian.PutUint64(treeContainer.pages[first][HEADER_SIZE:], 0)
+	_, _, err := tree.Get(ByteArr("k250"))
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.ErrorContains(t, err, "overflow chain of")
+
+	iter := tree.Seek(ByteArr("k249"))
+	assert.True(t, iter.Valid())
+	iter.Next()
+	assert.Nil(t, iter.Val())
+	assert.False(t, iter.Valid())
+	assert.ErrorIs(t, iter.Err(), ErrCorrupt)
+
+	// a leaf with a bad node type
+	node.setHeader(7, node.nkeys())
+	_, _, err = tree.Get(ByteArr("k250"))
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.ErrorContains(t, err, "bad node type 7")
+	_, err = tree.Delete(ByteArr("k250"))
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.ErrorIs(t, tree.Insert(ByteArr("k250"), ByteArr("v")), ErrCorrupt)
+	assert.Nil(t, tree.Seek(nil).Err(), "the first leaf is fine")
+	iter = tree.Seek(ByteArr("k250"))
+	assert.False(t, iter.Valid())
+	assert.ErrorIs(t, iter.Err(), ErrCorrupt)
+
+	// a leaf whose last offset points past its pairs
+	node.setHeader(uint16(LeafNode), node.nkeys())
+	node.setOffset(node.nkeys(), BTREE_PAGE_SIZE)
+	_, _, err = tree.Get(ByteArr("k250"))
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.ErrorContains(t, err, "offset")
+
+	// other panics aren't errors
+	tree.get = func(uint64) BNode { panic("bug") }
+	assert.PanicsWithValue(t, "bug", func() { tree.Get(ByteArr("k000")) })
+}
+
 /*
 
 Things to test ->
@@ -138,3 +221,14 @@ The structure is valid.
 	Node sizes are within limits.
 The data matches a reference. We used a map to capture each update.
 */
+
+func TestPageSizeOption(t *testing.T) {
+	get := func(uint64) BNode { return nil }
+	_, err := NewBTree(get, nil, nil, WithPageSize(5000))
+	assert.ErrorIs(t, err, ErrPageSize)
+	_, err = NewBTree(get, nil, nil, WithPageSize(32768), WithPrefixCompression())
+	assert.ErrorIs(t, err, ErrPageSize)
+	tree, err := NewBTree(get, nil, nil, WithPageSize(8192))
+	assert.Nil(t, err)
+	assert.Equal(t, 8192, tree.PageSize())
+}
@@ -0,0 +1,155 @@
+package btreeplus
+
+import (
+	"fmt"
+	"iter"
+)
+
+/*
+BulkLoad builds a tree from sorted pairs without going through Insert:
+the leaves are filled one after the other, left to right, and every leaf
+written adds its first key to the level above, which is filled the same
+way. Each level only keeps the node it is filling in memory. Nodes are
+closed once they reach the fill factor, a percentage of the page: leaving
+room makes the first updates after the load cheaper, since they don't all
+split a page.
+*/
+const DEFAULT_BULK_FILL = 90
+
+// the node a level of the tree is filling
+type bulkNode struct {
+	keys, vals []ByteArr
+	ptrs       []uint64
+	plain      int // bytes in the plain layout
+	prefix     int // length of the prefix shared by keys
+	written    int // nodes of the level written so far
+}
+
+type bulkLoader struct {
+	tree   *BTree
+	limit  int // bytes a node may take once written
+	levels []*bulkNode
+}
+
+// BulkLoad fills an empty tree with pairs, which must come in ascending
+// key order without duplicates. Nodes are filled up to fill percent of a
+// page, 0 meaning DEFAULT_BULK_FILL. The tree is only changed once every
+// pair is in; on error the pages allocated so far must be rolled back by
+// the caller, like after a failed Insert.
+func (tree *BTree) BulkLoad(pairs iter.Seq2[ByteArr, ByteArr], fill int) (err error) {
+	if fill == 0 {
+		fill = DEFAULT_BULK_FILL
+	}
+	if fill < 0 || fill > 100 {
+		return fmt.Errorf("BulkLoad: fill factor of %d%%", fill)
+	}
+	defer catchCorrupt(&err)
+
+	// the root left by deleting every key counts as empty
+	sentinel := uint64(0)
+	if tree.root != 0 {
+		root := tree.readNode(tree.root)
+		if NodeType(root.btype()) != LeafNode || root.nkeys() > 1 {
+			return ErrNotEmpty
+		}
+		sentinel = tree.root
+	}
+
+	b := &bulkLoader{tree: tree, limit: max(tree.PageSize()*fill/100, HEADER_SIZE)}
+	b.add(0, ByteArr{}, 0, ByteArr{})
+	var prev ByteArr
+	for key, val := range pairs {
+		if err := checkLimit(key, val); err != nil {
+			return err
+		}
+		if prev != nil && tree.Compare(prev, key) >= 0 {
+			return fmt.Errorf("%w: %q after %q", ErrUnsorted, key, prev)
+		}
+		// the pairs are kept until their node is written
+		key, val = append(ByteArr{}, key...), append(ByteArr{}, val...)
+		ptr := uint64(0)
+		if len(val) > maxInlineVal(tree.PageSize()) {
+			ptr, val = overflowWrite(tree, val)
+		}
+		b.add(0, key, ptr, val)
+		prev = key
+	}
+
+	root := b.finish()
+	if sentinel != 0 {
+		tree.del(sentinel)
+	}
+	tree.root = root
+	return nil
+}
+
+// add appends a pair to the node of level, writing the node out first if
+// the pair would take it past the limit. An internal node takes a second
+// entry past the limit, as long as it fits the page: each written node
+// must leave fewer entries on the level above, or it would never end.
+// Two entries with the largest keys fit any page.
+func (b *bulkLoader) add(level int, key ByteArr, ptr uint64, val ByteArr) {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, &bulkNode{})
+	}
+	node := b.levels[level]
+
+	l := b.tree.layout()
+	n := len(node.keys) + 1
+	plain := node.plain + POINTER_SIZE + OFFSET_SIZE + KV_HEADER_SIZE + len(key) + len(val)
+	prefix := len(key)
+	if n > 1 {
+		prefix = min(node.prefix, commonPrefixLen(node.keys[0], key))
+	}
+	written := HEADER_SIZE + plain
+	if l.prefix {
+		written += PREFIX_LEN_SIZE + prefix - n*prefix
+	}
+	full := written > b.limit && (level == 0 || n > 2)
+	if n > 1 && (full || written > l.pageSize || HEADER_SIZE+plain > l.nodeCap()) {
+		b.flush(level)
+		b.add(level, key, ptr, val)
+		return
+	}
+
+	node.keys = append(node.keys, key)
+	node.vals = append(node.vals, val)
+	node.ptrs = append(node.ptrs, ptr)
+	node.plain, node.prefix = plain, prefix
+}
+
+// flush writes the node of level and links it from the level above.
+func (b *bulkLoader) flush(level int) {
+	ptr, first := b.write(level)
+	b.add(level+1, first, ptr, nil)
+}
+
+// write writes the node of level out, and returns its page and first key.
+func (b *bulkLoader) write(level int) (uint64, ByteArr) {
+	node := b.levels[level]
+	btype := LeafNode
+	if level > 0 {
+		btype = InternalNode
+	}
+
+	new := b.tree.newNode()
+	new.setHeader(uint16(btype), uint16(len(node.keys)))
+	for i := range node.keys {
+		nodeAppendKV(new, uint16(i), node.ptrs[i], node.keys[i], node.vals[i])
+	}
+	first := node.keys[0]
+	*node = bulkNode{written: node.written + 1}
+	return b.tree.new(new), first
+}
+
+// finish writes the nodes left, from the leaves up, and returns the root:
+// the first node alone on its level.
+func (b *bulkLoader) finish() uint64 {
+	for level := 0; ; level++ {
+		if b.levels[level].written == 0 {
+			root, _ := b.write(level)
+			return root
+		}
+		b.flush(level)
+	}
+}
@@ -0,0 +1,118 @@
+package btreeplus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sortedPairs yields the keys [0, n) with their value in c.ref.
+func sortedPairs(c *BtreeContainer, n int) func(yield func(k, v ByteArr) bool) {
+	return func(yield func(k, v ByteArr) bool) {
+		for i := 0; i < n; i++ {
+			key := prefixedKey(i)
+			if !yield(ByteArr(key), ByteArr(c.ref[key])) {
+				return
+			}
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	plain := NewBTS()
+	plain.tree, _ = NewBTree(plain.tree.get, plain.tree.new, plain.tree.del)
+	for _, c := range []*BtreeContainer{plain, newPrefixBTS()} {
+		for i := 0; i < 20000; i++ {
+			c.ref[prefixedKey(i)] = fmt.Sprintf("v%d", i)
+			if i%1000 == 0 {
+				c.ref[prefixedKey(i)] = bigVal(2*OVERFLOW_DATA_SIZE, byte(i))
+			}
+		}
+		assert.Nil(t, c.tree.BulkLoad(sortedPairs(c, 20000), 0))
+
+		errs, keys := checkBTS(t, c)
+		assert.Empty(t, errs)
+		assert.Equal(t, uint64(20000), keys)
+		for k, v := range c.ref {
+			_, val := c.Get(k)
+			assert.Equal(t, ByteArr(v), val)
+		}
+
+		// filled to DEFAULT_BULK_FILL, but the last node of each level
+		l, leaves, full := c.tree.layout(), 0, 0
+		for ptr, page := range c.pages {
+			if NodeType(page.btype()&^PREFIX_FLAG) != LeafNode {
+				continue
+			}
+			node := c.tree.get(ptr)
+			_, written := l.size(node, 0, node.nkeys())
+			assert.LessOrEqual(t, written, BTREE_PAGE_SIZE*DEFAULT_BULK_FILL/100)
+			if written > BTREE_PAGE_SIZE*DEFAULT_BULK_FILL/100-100 {
+				full++
+			}
+			leaves++
+		}
+		assert.Greater(t, full, leaves*9/10)
+
+		// the tree takes updates as usual
+		c.Add(prefixedKey(20000), "new")
+		c.Del(prefixedKey(5))
+		errs, _ = checkBTS(t, c)
+		assert.Empty(t, errs)
+
+		assert.ErrorIs(t, c.tree.BulkLoad(sortedPairs(c, 10), 0), ErrNotEmpty)
+	}
+}
+
+func TestBulkLoadErrors(t *testing.T) {
+	c := NewBTS()
+	pairs := func(keys ...string) func(yield func(k, v ByteArr) bool) {
+		return func(yield func(k, v ByteArr) bool) {
+			for _, k := range keys {
+				if !yield(ByteArr(k), ByteArr("v")) {
+					return
+				}
+			}
+		}
+	}
+	assert.ErrorIs(t, c.tree.BulkLoad(pairs("a", "c", "b"), 0), ErrUnsorted)
+	assert.ErrorIs(t, c.tree.BulkLoad(pairs("a", "a"), 0), ErrUnsorted)
+	assert.ErrorIs(t, c.tree.BulkLoad(pairs("a", ""), 0), ErrEmptyKey)
+	assert.NotNil(t, c.tree.BulkLoad(pairs("a"), 101))
+	assert.Zero(t, c.tree.root, "left untouched")
+
+	// a tree emptied by deletes counts as empty
+	c.Add("x", "v")
+	c.Del("x")
+	assert.Nil(t, c.tree.BulkLoad(pairs("a", "b"), 100))
+	_, val := c.Get("b")
+	assert.Equal(t, ByteArr("v"), val)
+	_, val = c.Get("x")
+	assert.Nil(t, val)
+}
+
+func TestBulkLoadLowFill(t *testing.T) {
+	// a node at 20% of a page holds a single one of these keys
+	plain := NewBTS()
+	plain.tree, _ = NewBTree(plain.tree.get, plain.tree.new, plain.tree.del)
+	for _, c := range []*BtreeContainer{plain, newPrefixBTS()} {
+		for i := 0; i < 50; i++ {
+			c.ref[fmt.Sprintf("%0900d", i)] = "v"
+		}
+		pairs := func(yield func(k, v ByteArr) bool) {
+			for i := 0; i < 50; i++ {
+				if !yield(ByteArr(fmt.Sprintf("%0900d", i)), ByteArr("v")) {
+					return
+				}
+			}
+		}
+		assert.Nil(t, c.tree.BulkLoad(pairs, 20))
+
+		errs, keys := checkBTS(t, c)
+		assert.Empty(t, errs)
+		assert.Equal(t, uint64(50), keys)
+		_, val := c.Get(fmt.Sprintf("%0900d", 49))
+		assert.Equal(t, ByteArr("v"), val)
+	}
+}
@@ -0,0 +1,218 @@
+package btreeplus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// PageError is a problem Check found in the page at Ptr.
+type PageError struct {
+	Ptr uint64
+	Msg string
+}
+
+func (e *PageError) Error() string {
+	return fmt.Sprintf("page %d: %s", e.Ptr, e.Msg)
+}
+
+type checker struct {
+	tree      *BTree
+	visit     func(ptr uint64) bool
+	errs      []error
+	leafDepth int
+	keys      uint64
+}
+
+func (c *checker) errorf(ptr uint64, format string, args ...any) {
+	c.errs = append(c.errs, &PageError{Ptr: ptr, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Check walks the whole tree from the root and validates every page on
+// the way: its type, that its offsets follow each other and stay within
+// the page, that its keys are sorted, that the separator keys of internal
+// nodes are the first keys of their children, that the leaves are all at
+// the same depth and that overflow chains hold the length they should.
+//
+// Pages are read without trusting them, a corrupt page is reported and not
+// descended into. visit is called with every page number reached, before
+// the page is read; it returns false for a page that mustn't be read, like
+// one past the end of the file or seen before, which the caller reports.
+// Check returns the problems found and the number of keys, the sentinel
+// excluded.
+func (tree *BTree) Check(visit func(ptr uint64) bool) ([]error, uint64) {
+	if tree.root == 0 {
+		return nil, 0
+	}
+	c := &checker{tree: tree, visit: visit, leafDepth: -1}
+	c.walk(tree.root, 0, 0, ByteArr{}, nil)
+	if c.keys > 0 {
+		c.keys--
+	}
+	return c.errs, c.keys
+}
+
+// walk checks the subtree at ptr, whose first key must be first (its
+// separator in parent) and whose keys must be below end, if not nil.
+func (c *checker) walk(ptr uint64, parent uint64, depth int, first, end ByteArr) {
+	if !c.visit(ptr) {
+		return
+	}
+	node, err := c.tree.decodePage(c.tree.raw(ptr))
+	if err != nil {
+		c.errorf(ptr, "%v", err)
+		return
+	}
+	nkeys := node.nkeys()
+	if nkeys == 0 {
+		c.errorf(ptr, "empty %v", NodeType(node.btype()))
+		return
+	}
+
+	if key := node.getKey(0); !bytes.Equal(key, first) {
+		if parent == 0 {
+			c.errorf(ptr, "first key %q of the root isn't the empty sentinel", key)
+		} else {
+			c.errorf(parent, "separator %q doesn't match the first key %q of child %d", first, key, ptr)
+		}
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		key := node.getKey(i)
+		if len(key) > BTREE_MAX_KEY_SIZE {
+			c.errorf(ptr, "key %d is %d bytes long", i, len(key))
+		}
+		if i > 0 && c.tree.Compare(node.getKey(i-1), key) >= 0 {
+			c.errorf(ptr, "key %d %q isn't above key %d %q", i, key, i-1, node.getKey(i-1))
+		}
+	}
+	if last := node.getKey(nkeys - 1); end != nil && c.tree.Compare(last, end) >= 0 {
+		c.errorf(ptr, "last key %q isn't below the next separator %q", last, end)
+	}
+
+	if NodeType(node.btype()) == LeafNode {
+		if c.leafDepth == -1 {
+			c.leafDepth = depth
+		} else if depth != c.leafDepth {
+			c.errorf(ptr, "leaf at depth %d, others are at %d", depth, c.leafDepth)
+		}
+		c.keys += uint64(nkeys)
+		for i := uint16(0); i < nkeys; i++ {
+			_, val := node.getKeyAndVal(i)
+			if chain := node.getPtr(i); chain != 0 {
+				c.checkOverflow(ptr, chain, val)
+			} else if len(val) > maxInlineVal(c.tree.PageSize()) {
+				c.errorf(ptr, "inline value %d is %d bytes long", i, len(val))
+			}
+		}
+		return
+	}
+
+	for i := uint16(0); i < nkeys; i++ {
+		childEnd := end
+		if i+1 < nkeys {
+			childEnd = node.getKey(i + 1)
+		}
+		child := node.getPtr(i)
+		if child == 0 {
+			c.errorf(ptr, "null pointer to child %d", i)
+			continue
+		}
+		c.walk(child, ptr, depth+1, node.getKey(i), childEnd)
+	}
+}
+
+func (c *checker) checkOverflow(leaf, ptr uint64, ref ByteArr) {
+	if len(ref) != OVERFLOW_REF_SIZE {
+		c.errorf(leaf, "overflow reference of %d bytes", len(ref))
+		return
+	}
+	want := binary.LittleEndian.Uint64(ref)
+	got := uint64(0)
+	for ; ptr != 0; ptr = c.tree.raw(ptr).overflowNext() {
+		if !c.visit(ptr) {
+			return
+		}
+		page := c.tree.raw(ptr)
+		if NodeType(page.btype()) != OverflowNode {
+			c.errorf(ptr, "%v in an overflow chain", NodeType(page.btype()))
+			return
+		}
+		if n := int(page.nkeys()); n == 0 || n > c.tree.PageSize()-OVERFLOW_HEADER_SIZE {
+			c.errorf(ptr, "overflow page holding %d bytes", n)
+			return
+		}
+		got += uint64(page.nkeys())
+	}
+	if got != want {
+		c.errorf(leaf, "overflow chain holds %d bytes, not %d", got, want)
+	}
+}
+
+// decodePage validates a page as stored and returns it as a plain node.
+func (tree *BTree) decodePage(page BNode) (BNode, error) {
+	pageSize := tree.PageSize()
+	if len(page) < HEADER_SIZE {
+		return nil, fmt.Errorf("page of %d bytes", len(page))
+	}
+	btype := NodeType(page.btype() &^ PREFIX_FLAG)
+	if btype != InternalNode && btype != LeafNode {
+		return nil, fmt.Errorf("bad node type %d", page.btype())
+	}
+	if page.btype()&PREFIX_FLAG == 0 {
+		return page, checkPlain(page, pageSize)
+	}
+	if !tree.prefix {
+		return nil, fmt.Errorf("prefix compressed %v in a plain tree", btype)
+	}
+	if err := checkCompressed(page, pageSize); err != nil {
+		return nil, err
+	}
+	return expandNode(page), nil
+}
+
+// checkCompressed checks that a compressed page expands into a node
+// checkPlain accepts, within PREFIX_NODE_CAP.
+func checkCompressed(page BNode, pageSize int) error {
+	p := int(binary.LittleEndian.Uint16(page[HEADER_SIZE:]))
+	bodyPos := HEADER_SIZE + PREFIX_LEN_SIZE + p
+	if bodyPos > pageSize {
+		return fmt.Errorf("prefix of %d bytes", p)
+	}
+	stripped := BNode(make([]byte, HEADER_SIZE+pageSize-bodyPos))
+	stripped.setHeader(page.btype()&^PREFIX_FLAG, page.nkeys())
+	copy(stripped[HEADER_SIZE:], page[bodyPos:pageSize])
+	if err := checkPlain(stripped, len(stripped)); err != nil {
+		return err
+	}
+	if size := int(stripped.nbytes()) + p*int(page.nkeys()); size > PREFIX_NODE_CAP {
+		return fmt.Errorf("expands to %d bytes", size)
+	}
+	return nil
+}
+
+// checkPlain checks that the pairs of node follow each other within limit
+// bytes, so that reading them can't go astray.
+func checkPlain(node BNode, limit int) error {
+	nkeys := int(node.nkeys())
+	kvStart := HEADER_SIZE + (POINTER_SIZE+OFFSET_SIZE)*nkeys
+	if kvStart > limit {
+		return fmt.Errorf("%d keys don't fit in the page", nkeys)
+	}
+	pos := kvStart
+	for i := 0; i < nkeys; i++ {
+		if pos+KV_HEADER_SIZE > limit {
+			return fmt.Errorf("pair %d starts past the end of the page", i)
+		}
+		klen := int(binary.LittleEndian.Uint16(node[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node[pos+KEY_SIZE:]))
+		next := pos + KV_HEADER_SIZE + klen + vlen
+		if next > limit {
+			return fmt.Errorf("pair %d ends past the end of the page", i)
+		}
+		if off := int(node.getOffset(uint16(i + 1))); off != next-kvStart {
+			return fmt.Errorf("offset %d is %d, pair %d ends at %d", i+1, off, i, next-kvStart)
+		}
+		pos = next
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package btreeplus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// checkBTS checks the tree of c, which must reach each of its pages once.
+func checkBTS(t *testing.T, c *BtreeContainer) ([]error, uint64) {
+	seen := map[uint64]bool{}
+	errs, keys := c.tree.Check(func(ptr uint64) bool {
+		assert.False(t, seen[ptr], "page %d reached twice", ptr)
+		seen[ptr] = true
+		return c.pages[ptr] != nil
+	})
+	assert.Equal(t, len(c.pages), len(seen))
+	return errs, keys
+}
+
+func TestCheckTree(t *testing.T) {
+	plain := NewBTS()
+	plain.tree, _ = NewBTree(plain.tree.get, plain.tree.new, plain.tree.del)
+	for _, c := range []*BtreeContainer{plain, newPrefixBTS()} {
+		errs, keys := c.tree.Check(func(uint64) bool { return true })
+		assert.Empty(t, errs)
+		assert.Zero(t, keys)
+
+		for i := 0; i < 3000; i++ {
+			val := "v"
+			if i%300 == 0 {
+				val = bigVal(3*OVERFLOW_DATA_SIZE, byte(i))
+			}
+			c.Add(prefixedKey(i), val)
+		}
+		for i := 0; i < 3000; i += 7 {
+			c.Del(prefixedKey(i))
+		}
+		errs, keys = checkBTS(t, c)
+		assert.Empty(t, errs)
+		assert.Equal(t, uint64(len(c.ref)), keys)
+
+		for _, page := range c.pages {
+			if NodeType(page.btype()) == OverflowNode {
+				assert.Len(t, page, BTREE_PAGE_SIZE, "overflow pages are stored as they are")
+			}
+		}
+	}
+}
+
+func TestCheckTreeCorruption(t *testing.T) {
+	c := newPrefixBTS()
+	for i := 0; i < 2000; i++ {
+		c.Add(prefixedKey(i), "v")
+	}
+	root := c.pages[c.tree.root]
+	assert.NotZero(t, root.btype()&PREFIX_FLAG)
+	leaf := expandNode(root).getPtr(1)
+
+	// swap the first two keys of a leaf
+	node := expandNode(c.pages[leaf])
+	swapped := BNode(make([]byte, PREFIX_NODE_CAP))
+	swapped.setHeader(uint16(LeafNode), node.nkeys())
+	for i := uint16(0); i < node.nkeys(); i++ {
+		j := i
+		if i < 2 {
+			j = 1 - i
+		}
+		k, v := node.getKeyAndVal(j)
+		nodeAppendKV(swapped, i, 0, k, v)
+	}
+	c.pages[leaf] = compressNode(swapped, BTREE_PAGE_SIZE)
+
+	errs, _ := checkBTS(t, c)
+	assert.Len(t, errs, 2)
+	assert.Contains(t, fmt.Sprint(errs), fmt.Sprintf("page %d: separator", c.tree.root))
+	assert.Contains(t, fmt.Sprint(errs), fmt.Sprintf("page %d: key 1", leaf))
+
+	// a prefix longer than the page
+	c.pages[leaf][HEADER_SIZE] = 0xff
+	c.pages[leaf][HEADER_SIZE+1] = 0xff
+	errs, _ = checkBTS(t, c)
+	assert.Equal(t, []error{&PageError{Ptr: leaf, Msg: "prefix of 65535 bytes"}}, errs)
+}
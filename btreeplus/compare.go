@@ -0,0 +1,108 @@
+package btreeplus
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Comparator orders the keys of a tree. Compare returns -1, 0 or 1 like
+// bytes.Compare; keys comparing equal are the same key. Name identifies the
+// ordering, a tree must always be opened with the comparator it was built
+// with.
+type Comparator struct {
+	Name    string
+	Compare func(a, b []byte) int
+}
+
+// BytesComparator is the default, lexicographic byte order.
+var BytesComparator = Comparator{Name: "bytes", Compare: bytes.Compare}
+
+// ReverseBytesComparator is the byte order, descending.
+var ReverseBytesComparator = Comparator{
+	Name:    "bytes-reverse",
+	Compare: func(a, b []byte) int { return bytes.Compare(b, a) },
+}
+
+// CaseInsensitiveComparator orders keys by their ASCII lowercase form, so
+// keys differing only by case are the same key.
+var CaseInsensitiveComparator = Comparator{
+	Name: "ascii-case-insensitive",
+	Compare: func(a, b []byte) int {
+		for i := 0; i < len(a) && i < len(b); i++ {
+			ca, cb := asciiLower(a[i]), asciiLower(b[i])
+			if ca != cb {
+				if ca < cb {
+					return -1
+				}
+				return 1
+			}
+		}
+		return cmpInt(len(a), len(b))
+	},
+}
+
+// Int64BEComparator orders 8 byte keys as big-endian two's complement
+// integers, negative ones first. Keys of another length sort after them,
+// in byte order.
+var Int64BEComparator = Comparator{
+	Name: "int64-be",
+	Compare: func(a, b []byte) int {
+		switch {
+		case len(a) == 8 && len(b) == 8:
+			return cmpInt(int64(binary.BigEndian.Uint64(a)), int64(binary.BigEndian.Uint64(b)))
+		case len(a) == 8:
+			return -1
+		case len(b) == 8:
+			return 1
+		}
+		return bytes.Compare(a, b)
+	},
+}
+
+func asciiLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func cmpInt[T int | int64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// WithComparator orders the keys of the tree with cmp instead of
+// BytesComparator.
+func WithComparator(cmp Comparator) Option {
+	return func(tree *BTree) {
+		tree.cmp = cmp
+	}
+}
+
+func (tree *BTree) Comparator() Comparator {
+	if tree.cmp.Compare == nil {
+		return BytesComparator
+	}
+	return tree.cmp
+}
+
+// Compare orders two keys of the tree. The empty key, which is the
+// sentinel of the leftmost leaf, comes before every other key in any order.
+func (tree *BTree) Compare(a, b ByteArr) int {
+	switch {
+	case len(a) == 0 || len(b) == 0:
+		return cmpInt(len(a), len(b))
+	case tree.cmp.Compare == nil:
+		return bytes.Compare(a, b)
+	}
+	return tree.cmp.Compare(a, b)
+}
+
+func (tree *BTree) lookupLE(node BNode, key ByteArr) uint16 {
+	return nodeLookupLEFunc(node, key, tree.Compare)
+}
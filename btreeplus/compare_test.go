@@ -0,0 +1,93 @@
+package btreeplus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCmpBTS(cmp Comparator) *BtreeContainer {
+	treeContainer := NewBTS()
+	tree := &treeContainer.tree
+	treeContainer.tree, _ = NewBTree(tree.get, tree.new, tree.del, WithComparator(cmp))
+	return treeContainer
+}
+
+func int64Key(i int64) string {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], uint64(i))
+	return string(key[:])
+}
+
+func TestComparators(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, cmp := range []Comparator{BytesComparator, ReverseBytesComparator, CaseInsensitiveComparator, Int64BEComparator} {
+		treeContainer := newCmpBTS(cmp)
+		keys := []string{}
+		for i := 0; i < 2000; i++ {
+			var key string
+			if cmp.Name == Int64BEComparator.Name {
+				key = int64Key(r.Int63n(1<<40) - 1<<39)
+			} else {
+				key = fmt.Sprintf("key-%c-%05d", 'a'+r.Intn(26), r.Intn(100000))
+			}
+			if _, ok := treeContainer.ref[key]; !ok {
+				keys = append(keys, key)
+			}
+			treeContainer.Add(key, strings200(key))
+		}
+		sort.Slice(keys, func(i, j int) bool { return cmp.Compare([]byte(keys[i]), []byte(keys[j])) < 0 })
+
+		// delete some, the rest must come out in comparator order
+		remaining := []string{}
+		for i, k := range keys {
+			if i%4 == 0 {
+				_, err := treeContainer.Del(k)
+				assert.Nil(t, err)
+				continue
+			}
+			remaining = append(remaining, k)
+		}
+
+		got := []string{}
+		for iter := treeContainer.tree.Seek(nil); iter.Valid(); iter.Next() {
+			got = append(got, string(iter.Key()))
+		}
+		assert.Equal(t, remaining, got, cmp.Name)
+
+		iter := treeContainer.tree.Seek([]byte(remaining[100]))
+		assert.Equal(t, remaining[100], string(iter.Key()), cmp.Name)
+	}
+}
+
+func strings200(s string) string {
+	return fmt.Sprintf("%0200s", s)
+}
+
+func TestCaseInsensitiveSameKey(t *testing.T) {
+	treeContainer := newCmpBTS(CaseInsensitiveComparator)
+	treeContainer.tree.Insert([]byte("Hello"), []byte("v1"))
+	treeContainer.tree.Insert([]byte("HELLO"), []byte("v2"))
+
+	k, v, err := treeContainer.tree.Get([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, "HELLO", string(k))
+	assert.Equal(t, "v2", string(v))
+
+	deleted, err := treeContainer.tree.Delete([]byte("hELLo"))
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	assert.False(t, treeContainer.tree.Seek(nil).Valid())
+}
+
+func TestInt64Comparator(t *testing.T) {
+	cmp := Int64BEComparator.Compare
+	assert.Equal(t, -1, cmp([]byte(int64Key(-5)), []byte(int64Key(3))))
+	assert.Equal(t, 1, cmp([]byte(int64Key(1<<40)), []byte(int64Key(-1<<40))))
+	assert.Equal(t, 0, cmp([]byte(int64Key(7)), []byte(int64Key(7))))
+	assert.Equal(t, -1, cmp([]byte(int64Key(7)), []byte("short")))
+}
@@ -0,0 +1,181 @@
+package btreeplus
+
+// BIter walks the tree in key order. Like _internalsFetchNodeChain it keeps
+// the chain of nodes from the root down to a leaf, along with the position
+// taken inside each of them, so moving to a sibling leaf only needs to walk
+// back up as far as the first ancestor that still has room to move.
+//
+// A damaged page stops the iterator: it isn't Valid anymore, and Err says
+// why.
+type BIter struct {
+	tree *BTree
+	path []BNode  // root -> leaf
+	pos  []uint16 // index into each node of path
+	err  error
+}
+
+// SeekLE positions the iterator at the largest key <= key. If every key is
+// greater, the iterator rests before the first key and is not Valid.
+func (tree *BTree) SeekLE(key ByteArr) (iter *BIter) {
+	iter = &BIter{tree: tree}
+	if tree.root == 0 {
+		return iter
+	}
+	defer catchCorrupt(&iter.err)
+
+	for node := tree.readNode(tree.root); ; {
+		idx := tree.lookupLE(node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if NodeType(node.btype()) == LeafNode {
+			break
+		}
+		node = tree.readNode(node.getPtr(idx))
+	}
+	return iter
+}
+
+// Seek positions the iterator at the smallest key >= key. A nil key seeks to
+// the first key of the tree.
+func (tree *BTree) Seek(key ByteArr) *BIter {
+	iter := tree.SeekLE(key)
+	if len(iter.path) == 0 {
+		return iter
+	}
+
+	if iter.err == nil && (!iter.Valid() || tree.Compare(iter.Key(), key) < 0) {
+		iter.Next()
+	}
+	return iter
+}
+
+// SeekLast positions the iterator at the largest key of the tree.
+func (tree *BTree) SeekLast() (iter *BIter) {
+	iter = &BIter{tree: tree}
+	if tree.root == 0 {
+		return iter
+	}
+	defer catchCorrupt(&iter.err)
+
+	for node := tree.readNode(tree.root); ; {
+		idx := node.nkeys() - 1
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if NodeType(node.btype()) == LeafNode {
+			break
+		}
+		node = tree.readNode(node.getPtr(idx))
+	}
+	return iter
+}
+
+// Valid reports whether the iterator currently points at a key. It is false
+// once the iterator moved past either end of the tree.
+func (iter *BIter) Valid() bool {
+	if len(iter.path) == 0 || iter.err != nil {
+		return false
+	}
+
+	leaf, idx := iter.leaf()
+	if idx >= leaf.nkeys() {
+		return false
+	}
+
+	// the sentinel (empty key) marks the position before the first key
+	k, _ := leaf.getKeyAndVal(idx)
+	return len(k) != 0
+}
+
+func (iter *BIter) Key() ByteArr {
+	leaf, idx := iter.leaf()
+	k, _ := leaf.getKeyAndVal(idx)
+	return k
+}
+
+// Val returns the value at the current position. Values stored in
+// overflow pages are put back together in a new slice.
+func (iter *BIter) Val() (val ByteArr) {
+	defer catchCorrupt(&iter.err)
+	leaf, idx := iter.leaf()
+	return leafVal(iter.tree, leaf, idx)
+}
+
+// Err is the error that stopped the iterator, nil if it ran out of keys
+// or is still going.
+func (iter *BIter) Err() error {
+	return iter.err
+}
+
+// Next moves to the following key. Moving past the last key leaves the
+// iterator invalid; further calls are no-ops.
+func (iter *BIter) Next() {
+	if len(iter.path) == 0 || iter.err != nil {
+		return
+	}
+	defer catchCorrupt(&iter.err)
+
+	leaf, idx := iter.leaf()
+	if idx >= leaf.nkeys() {
+		return
+	}
+
+	if !iterNext(iter, len(iter.path)-1) {
+		iter.pos[len(iter.pos)-1] = leaf.nkeys()
+	}
+}
+
+// Prev moves to the preceding key. Moving before the first key leaves the
+// iterator invalid; further calls are no-ops.
+func (iter *BIter) Prev() {
+	if len(iter.path) == 0 || iter.err != nil {
+		return
+	}
+	defer catchCorrupt(&iter.err)
+
+	leaf, idx := iter.leaf()
+	if idx >= leaf.nkeys() {
+		iter.pos[len(iter.pos)-1] = leaf.nkeys() - 1
+		return
+	}
+
+	iterPrev(iter, len(iter.path)-1)
+}
+
+func (iter *BIter) leaf() (BNode, uint16) {
+	last := len(iter.path) - 1
+	return iter.path[last], iter.pos[last]
+}
+
+// move one step forward at level, walking up when the node is exhausted.
+// returns false (leaving the iterator untouched) at the end of the tree.
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++
+	} else if level == 0 || !iterNext(iter, level-1) {
+		return false
+	}
+
+	// the entry at this level changed, so the child below must be reloaded
+	if level+1 < len(iter.path) {
+		kid := iter.tree.readNode(iter.path[level].getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
+	return true
+}
+
+// mirror of iterNext
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] > 0 {
+		iter.pos[level]--
+	} else if level == 0 || !iterPrev(iter, level-1) {
+		return false
+	}
+
+	if level+1 < len(iter.path) {
+		kid := iter.tree.readNode(iter.path[level].getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nkeys() - 1
+	}
+	return true
+}
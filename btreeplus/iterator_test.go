@@ -0,0 +1,127 @@
+package btreeplus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func populatedBTS(n int) (*BtreeContainer, []string) {
+	treeContainer := NewBTS()
+	keys := make([]string, 0, n)
+
+	// large values force the tree to grow a few levels
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("k%05d", (i*7919)%n)
+		treeContainer.Add(k, strings.Repeat("v", 200)+k)
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return treeContainer, keys
+}
+
+func TestIterForward(t *testing.T) {
+	treeContainer, keys := populatedBTS(1000)
+
+	got := []string{}
+	for iter := treeContainer.tree.Seek(nil); iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key()))
+		assert.Equal(t, treeContainer.ref[string(iter.Key())], string(iter.Val()))
+	}
+	assert.Equal(t, keys, got)
+}
+
+func TestIterBackward(t *testing.T) {
+	treeContainer, keys := populatedBTS(1000)
+
+	got := []string{}
+	for iter := treeContainer.tree.SeekLast(); iter.Valid(); iter.Prev() {
+		got = append([]string{string(iter.Key())}, got...)
+	}
+	assert.Equal(t, keys, got)
+}
+
+func TestIterSeek(t *testing.T) {
+	treeContainer, _ := populatedBTS(1000)
+
+	// exact match
+	iter := treeContainer.tree.Seek(ByteArr("k00500"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "k00500", string(iter.Key()))
+
+	// between two keys
+	iter = treeContainer.tree.Seek(ByteArr("k00500a"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "k00501", string(iter.Key()))
+
+	iter = treeContainer.tree.SeekLE(ByteArr("k00500a"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, "k00500", string(iter.Key()))
+
+	// before every key
+	iter = treeContainer.tree.SeekLE(ByteArr("a"))
+	assert.False(t, iter.Valid())
+	iter.Next()
+	assert.Equal(t, "k00000", string(iter.Key()))
+
+	// after every key
+	iter = treeContainer.tree.Seek(ByteArr("z"))
+	assert.False(t, iter.Valid())
+	iter.Prev()
+	assert.Equal(t, "k00999", string(iter.Key()))
+}
+
+func TestIterEnds(t *testing.T) {
+	treeContainer, _ := populatedBTS(100)
+
+	iter := treeContainer.tree.Seek(nil)
+	iter.Prev()
+	assert.False(t, iter.Valid())
+	iter.Prev()
+	assert.False(t, iter.Valid())
+	iter.Next()
+	assert.Equal(t, "k00000", string(iter.Key()))
+
+	iter = treeContainer.tree.SeekLast()
+	iter.Next()
+	assert.False(t, iter.Valid())
+	iter.Next()
+	assert.False(t, iter.Valid())
+	iter.Prev()
+	assert.Equal(t, "k00099", string(iter.Key()))
+}
+
+func TestIterEmptyTree(t *testing.T) {
+	treeContainer := NewBTS()
+
+	iter := treeContainer.tree.Seek(nil)
+	assert.False(t, iter.Valid())
+	iter.Next()
+	iter.Prev()
+	assert.False(t, iter.Valid())
+	assert.False(t, treeContainer.tree.SeekLast().Valid())
+}
+
+func TestIterAfterDeletes(t *testing.T) {
+	treeContainer, keys := populatedBTS(1000)
+
+	remaining := []string{}
+	for i, k := range keys {
+		if i%3 == 0 {
+			remaining = append(remaining, k)
+			continue
+		}
+		res, err := treeContainer.Del(k)
+		assert.Nil(t, err)
+		assert.True(t, res)
+	}
+
+	got := []string{}
+	for iter := treeContainer.tree.Seek(nil); iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key()))
+	}
+	assert.Equal(t, remaining, got)
+}
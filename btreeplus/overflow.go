@@ -0,0 +1,101 @@
+package btreeplus
+
+import (
+	"encoding/binary"
+)
+
+/*
+Values longer than maxInlineVal don't fit in a leaf. They are written
+to a chain of overflow pages instead, and the leaf keeps a reference: the
+(otherwise unused) leaf pointer of the pair holds the first page of the
+chain, and the value stored inline is the total length of the real value.
+
+Overflow page
+| type | len | checksum | next | data | unused |
+|  2B  | 2B  |    4B    |  8B  | len  |        |
+
+next is 0 on the last page of a chain. The chain is copied on write like
+every other page: overwriting or deleting the value frees it all.
+*/
+const (
+	OVERFLOW_HEADER_SIZE        = HEADER_SIZE + POINTER_SIZE
+	OVERFLOW_DATA_SIZE          = BTREE_PAGE_SIZE - OVERFLOW_HEADER_SIZE // with default pages
+	OVERFLOW_REF_SIZE           = 8
+	BTREE_MAX_OVERFLOW_VAL_SIZE = 1 << 30
+)
+
+func (node BNode) overflowNext() uint64 {
+	return binary.LittleEndian.Uint64(node[HEADER_SIZE:])
+}
+
+// the data of an overflow page, its length is kept in place of nkeys
+func (node BNode) overflowData() []byte {
+	return node[OVERFLOW_HEADER_SIZE:][:node.nkeys()]
+}
+
+// overflowWrite stores val in a new chain. It returns the first page, and
+// the reference to keep inline.
+func overflowWrite(tree *BTree, val ByteArr) (uint64, ByteArr) {
+	// written back to front, so each page knows the next one
+	dataSize := tree.PageSize() - OVERFLOW_HEADER_SIZE
+	next := uint64(0)
+	for end := len(val); end > 0; {
+		start := (end - 1) / dataSize * dataSize
+		// exactly a page: overflow pages are stored as they are, even
+		// when tree.newNode makes room for expanded nodes
+		page := BNode(make([]byte, tree.PageSize()))
+		page.setHeader(uint16(OverflowNode), uint16(end-start))
+		binary.LittleEndian.PutUint64(page[HEADER_SIZE:], next)
+		copy(page[OVERFLOW_HEADER_SIZE:], val[start:end])
+		next = tree.new(page)
+		end = start
+	}
+
+	ref := make(ByteArr, OVERFLOW_REF_SIZE)
+	binary.LittleEndian.PutUint64(ref, uint64(len(val)))
+	return next, ref
+}
+
+// overflowRead puts the value referenced by ref back together.
+func overflowRead(tree *BTree, ptr uint64, ref ByteArr) ByteArr {
+	size := binary.LittleEndian.Uint64(ref)
+	if size > BTREE_MAX_OVERFLOW_VAL_SIZE {
+		corruptf("overflow value of %d bytes", size)
+	}
+	val := make(ByteArr, 0, size)
+	for ; ptr != 0; ptr = tree.get(ptr).overflowNext() {
+		page := tree.get(ptr)
+		if NodeType(page.btype()) != OverflowNode {
+			corruptf("%v in the overflow chain of a %d byte value", NodeType(page.btype()), cap(val))
+		}
+		if n := int(page.nkeys()); n > len(page)-OVERFLOW_HEADER_SIZE || len(val)+n > cap(val) {
+			corruptf("overflow chain longer than the %d bytes of its value", cap(val))
+		}
+		val = append(val, page.overflowData()...)
+	}
+	if len(val) != cap(val) {
+		corruptf("overflow chain of %d bytes, not %d", len(val), cap(val))
+	}
+	return val
+}
+
+func overflowFree(tree *BTree, ptr uint64) {
+	for ptr != 0 {
+		next := tree.get(ptr).overflowNext()
+		tree.del(ptr)
+		ptr = next
+	}
+}
+
+// leafVal is the value of a leaf pair, read from its overflow chain if it
+// has one.
+func leafVal(tree *BTree, leaf BNode, idx uint16) ByteArr {
+	_, val := leaf.getKeyAndVal(idx)
+	if ptr := leaf.getPtr(idx); ptr != 0 {
+		if len(val) != OVERFLOW_REF_SIZE {
+			corruptf("overflow reference of %d bytes", len(val))
+		}
+		return overflowRead(tree, ptr, val)
+	}
+	return val
+}
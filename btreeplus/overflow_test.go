@@ -0,0 +1,77 @@
+package btreeplus
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func bigVal(n int, seed byte) string {
+	val := make([]byte, n)
+	for i := range val {
+		val[i] = seed + byte(i%251)
+	}
+	return string(val)
+}
+
+func TestOverflowRoundTrip(t *testing.T) {
+	treeContainer := NewBTS()
+	sizes := []int{BTREE_MAX_VAL_SIZE, BTREE_MAX_VAL_SIZE + 1, OVERFLOW_DATA_SIZE,
+		2 * OVERFLOW_DATA_SIZE, 2*OVERFLOW_DATA_SIZE + 1, 100_000}
+	for i, n := range sizes {
+		treeContainer.Add(fmt.Sprintf("k%d", i), bigVal(n, byte(i)))
+	}
+	treeContainer.Add("small", "v")
+
+	for k, v := range treeContainer.ref {
+		_, val := treeContainer.Get(k)
+		assert.True(t, bytes.Equal([]byte(v), val), "key %s", k)
+	}
+
+	got := 0
+	for iter := treeContainer.tree.Seek(nil); iter.Valid(); iter.Next() {
+		assert.Equal(t, treeContainer.ref[string(iter.Key())], string(iter.Val()))
+		got++
+	}
+	assert.Equal(t, len(sizes)+1, got)
+}
+
+func TestOverflowFreedOnOverwriteAndDelete(t *testing.T) {
+	treeContainer := NewBTS()
+	treeContainer.Add("a", "small")
+	treeContainer.Add("b", "small")
+	base := len(treeContainer.pages)
+
+	treeContainer.Add("a", bigVal(50_000, 1))
+	assert.Equal(t, base+(50_000+OVERFLOW_DATA_SIZE-1)/OVERFLOW_DATA_SIZE, len(treeContainer.pages))
+
+	// big -> big swaps the chain, big -> small drops it
+	treeContainer.Add("a", bigVal(10_000, 2))
+	_, val := treeContainer.Get("a")
+	assert.Equal(t, bigVal(10_000, 2), string(val))
+	treeContainer.Add("a", "small")
+	assert.Equal(t, base, len(treeContainer.pages))
+
+	treeContainer.Add("b", bigVal(20_000, 3))
+	res, err := treeContainer.Del("b")
+	assert.Nil(t, err)
+	assert.True(t, res)
+	assert.Equal(t, 1, len(treeContainer.pages), "only the root leaf is left")
+}
+
+func TestOverflowManyKeys(t *testing.T) {
+	treeContainer := NewBTS()
+	for i := 0; i < 300; i++ {
+		treeContainer.Add(fmt.Sprintf("k%03d", i), bigVal(3000+i*37, byte(i)))
+	}
+	for i := 0; i < 300; i += 2 {
+		_, err := treeContainer.Del(fmt.Sprintf("k%03d", i))
+		assert.Nil(t, err)
+	}
+	for k, v := range treeContainer.ref {
+		_, val := treeContainer.Get(k)
+		assert.Equal(t, v, string(val))
+	}
+}
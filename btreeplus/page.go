@@ -12,6 +12,7 @@ type NodeType uint16
 const (
 	InternalNode NodeType = iota
 	LeafNode
+	OverflowNode
 )
 
 func (n NodeType) String() string {
@@ -20,6 +21,8 @@ func (n NodeType) String() string {
 		return "InternalNode"
 	case LeafNode:
 		return "LeafNode"
+	case OverflowNode:
+		return "OverflowNode"
 	default:
 		return "NA"
 	}
@@ -33,8 +36,11 @@ type BNode []byte
 
 /*
 Internal Node
-| type | nkeys |  pointers  |  offsets   | key-values | unused |
-|  2B  |   2B  | nkeys × 8B | nkeys × 4B |     ...    |        |
+| type | nkeys | checksum |  pointers  |  offsets   | key-values | unused |
+|  2B  |   2B  |    4B    | nkeys × 8B | nkeys × 4B |     ...    |        |
+
+the checksum belongs to the storage: the tree leaves it alone, the store
+fills it in when writing the page and checks it when reading it back.
 
 Leaf Node
 | key_size | val_size | key | val |
@@ -45,7 +51,9 @@ const (
 	BASE               = 0
 	NODE_TYPE_SIZE     = 2
 	NKEYS_SIZE         = 2
-	HEADER_SIZE        = NODE_TYPE_SIZE + NKEYS_SIZE
+	CHECKSUM_POS       = NODE_TYPE_SIZE + NKEYS_SIZE
+	CHECKSUM_SIZE      = 4
+	HEADER_SIZE        = CHECKSUM_POS + CHECKSUM_SIZE
 	POINTER_SIZE       = 8
 	OFFSET_SIZE        = 2
 	KEY_SIZE           = 2
@@ -56,9 +64,35 @@ const (
 	BTREE_MAX_VAL_SIZE = 3000
 )
 
+// PAGE_SIZES are the supported page sizes, BTREE_PAGE_SIZE being the
+// default. Offsets inside a node are 16 bits, and a node may temporarily
+// grow to twice the page size, which rules out 64K pages.
+var PAGE_SIZES = []int{4096, 8192, 16384, 32768}
+
+func ValidPageSize(size int) bool {
+	for _, s := range PAGE_SIZES {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// maxInlineVal is the largest value a leaf holds itself with pages of
+// pageSize, longer ones go to overflow pages. It is BTREE_MAX_VAL_SIZE for
+// the default page size.
+func maxInlineVal(pageSize int) int {
+	return pageSize - (BTREE_PAGE_SIZE - BTREE_MAX_VAL_SIZE)
+}
+
 func init() {
 	node1max := HEADER_SIZE + 1*POINTER_SIZE + 1*OFFSET_SIZE + KEY_SIZE + VAL_SIZE + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
 	helpers.Assert(node1max <= BTREE_PAGE_SIZE) // maximum KV
+	// an overfull node, a full page plus the largest KV, must stay
+	// addressable with uint16 offsets
+	largest := PAGE_SIZES[len(PAGE_SIZES)-1]
+	maxKV := node1max - BTREE_PAGE_SIZE + largest
+	helpers.Assert(largest+maxKV < 1<<16)
 }
 
 func NewBnode() BNode {
@@ -71,7 +105,7 @@ func (node BNode) btype() uint16 {
 }
 
 func (node BNode) nkeys() uint16 {
-	return binary.LittleEndian.Uint16(node[BASE+NODE_TYPE_SIZE : 4])
+	return binary.LittleEndian.Uint16(node[BASE+NODE_TYPE_SIZE : BASE+NODE_TYPE_SIZE+NKEYS_SIZE])
 }
 
 func (node BNode) setHeader(btype uint16, nkeys uint16) {
@@ -131,6 +165,12 @@ func (node BNode) getKeyAndVal(idx uint16) (ByteArr, ByteArr) {
 }
 
 func (node BNode) nbytes() uint16 {
+	if node.btype()&PREFIX_FLAG != 0 {
+		return node.compressedBytes()
+	}
+	if NodeType(node.btype()) == OverflowNode {
+		return OVERFLOW_HEADER_SIZE + node.nkeys()
+	}
 	return node.kvPos(node.nkeys())
 }
 
@@ -160,47 +200,52 @@ func nodeAppendRange(new, old BNode, dstNew, srcOld, n uint16) {
 	}
 }
 
-func leafUpsert(new, old BNode, idx uint16, key, val ByteArr, isUpdate uint16) {
+// ptr is the overflow chain of val, 0 if stored inline
+func leafUpsert(new, old BNode, idx uint16, ptr uint64, key, val ByteArr, isUpdate uint16) {
 	new.setHeader(uint16(LeafNode), old.nkeys()+1-(isUpdate&0x01))
 	nodeAppendRange(new, old, 0, 0, idx)
-	nodeAppendKV(new, idx, 0, key, val)
+	nodeAppendKV(new, idx, ptr, key, val)
 	nodeAppendRange(new, old, idx+1, idx+(isUpdate&0x01), old.nkeys()-(idx+(isUpdate&0x01)))
 }
 
+func (node BNode) getKey(idx uint16) ByteArr {
+	helpers.Assert(idx < node.nkeys())
+	pos := node.kvPos(idx)
+	klen := binary.LittleEndian.Uint16(node[pos:])
+	return ByteArr(node[pos+KV_HEADER_SIZE:][:klen])
+}
+
 // fetch the key who's value is -le param key
 func nodeLookupLE(node BNode, key ByteArr) uint16 {
-	for i := uint16(0); i < node.nkeys(); i++ {
-		nodeKey, _ := node.getKeyAndVal(i)
-		switch bytes.Compare(nodeKey, key) {
-		case 0:
-			return i
-		case 1:
-			return i - 1
+	return nodeLookupLEFunc(node, key, func(a, b ByteArr) int { return bytes.Compare(a, b) })
+}
+
+// nodeLookupLE in the order of cmp
+func nodeLookupLEFunc(node BNode, key ByteArr, cmp func(a, b ByteArr) int) uint16 {
+	// binary search for the first key > key, the answer is right before it
+	lo, hi := uint16(0), node.nkeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if cmp(node.getKey(mid), key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
-
-	return node.nkeys() - 1
+	return lo - 1
 }
 
-func nodeSplit2(left, right, old BNode) {
+func nodeSplit2(left, right, old BNode, l layout) {
 	helpers.Assert(old.nkeys() >= 2)
 	nleft := old.nkeys() / 2
-	left_bytes := func() uint16 {
-		return HEADER_SIZE + POINTER_SIZE*nleft + OFFSET_SIZE*nleft +
-			old.getOffset(nleft)
-	}
 
-	for left_bytes() > BTREE_PAGE_SIZE {
+	for !l.fits(old, 0, nleft) {
 		nleft--
 	}
 
 	helpers.Assert(nleft >= 1)
 
-	right_bytes := func() uint16 {
-		return old.nbytes() - left_bytes() + HEADER_SIZE
-	}
-
-	for right_bytes() > BTREE_PAGE_SIZE {
+	for !l.fits(old, nleft, old.nkeys()) {
 		nleft++
 	}
 
@@ -212,29 +257,30 @@ func nodeSplit2(left, right, old BNode) {
 	nodeAppendRange(left, old, 0, 0, nleft)
 	nodeAppendRange(right, old, 0, nleft, nright)
 	// NOTE: the left half may be still too big
-	helpers.Assert(right.nbytes() <= BTREE_PAGE_SIZE)
+	helpers.Assert(l.fits(right, 0, right.nkeys()))
 
 }
 
 // split a node if it's too big. the results are 1~3 nodes.
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old = old[:BTREE_PAGE_SIZE]
+func nodeSplit3(old BNode, l layout) (uint16, [3]BNode) {
+	nodeCap := l.nodeCap()
+	if l.fits(old, 0, old.nkeys()) {
+		old = old[:nodeCap]
 		return 1, [3]BNode{old} // not split
 	}
 
-	left := BNode(make([]byte, 2*BTREE_PAGE_SIZE)) // might be split later
-	right := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left = left[:BTREE_PAGE_SIZE]
+	left := BNode(make([]byte, len(old))) // might be split later
+	right := BNode(make([]byte, nodeCap))
+	nodeSplit2(left, right, old, l)
+	if l.fits(left, 0, left.nkeys()) {
+		left = left[:nodeCap]
 		return 2, [3]BNode{left, right} // 2 nodes
 	}
 
-	leftleft := BNode(make([]byte, BTREE_PAGE_SIZE))
-	leftright := BNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(leftleft, leftright, left)
-	helpers.Assert(leftleft.nbytes() <= BTREE_PAGE_SIZE)
+	leftleft := BNode(make([]byte, nodeCap))
+	leftright := BNode(make([]byte, nodeCap))
+	nodeSplit2(leftleft, leftright, left, l)
+	helpers.Assert(l.fits(leftleft, 0, leftleft.nkeys()))
 	return 3, [3]BNode{leftleft, leftright, right} // 3 nodes
 }
 
@@ -245,40 +291,12 @@ func leafDelete(new, old BNode, idx uint16) {
 	nodeAppendRange(new, old, idx, idx+1, old.nkeys()-(idx+1))
 }
 
-// merge two pages into new one
+// merge two sibling pages into new one. every key of left comes before
+// the keys of right, so they are simply laid one after the other.
 func nodeMerge(new, left, right BNode) {
 	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
-
-	idx, lptr, rptr := uint16(0), uint16(0), uint16(0)
-
-	for lptr < left.nkeys() && rptr < right.nkeys() {
-		kleft, vleft := left.getKeyAndVal(lptr)
-		kright, vright := right.getKeyAndVal(rptr)
-
-		if bytes.Compare(kleft, kright) <= 0 {
-			nodeAppendKV(new, idx, left.getPtr(lptr), kleft, vleft)
-			lptr++
-		} else {
-			nodeAppendKV(new, idx, right.getPtr(lptr), kright, vright)
-			rptr++
-		}
-
-		idx++
-	}
-
-	for lptr < left.nkeys() {
-		kleft, vleft := left.getKeyAndVal(lptr)
-		nodeAppendKV(new, idx, left.getPtr(lptr), kleft, vleft)
-		lptr++
-		idx++
-	}
-
-	for rptr < right.nkeys() {
-		kright, vright := right.getKeyAndVal(rptr)
-		nodeAppendKV(new, idx, right.getPtr(lptr), kright, vright)
-		rptr++
-		idx++
-	}
+	nodeAppendRange(new, left, 0, 0, left.nkeys())
+	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
 }
 
 // update new node as the old node with the idx and idx+1 nodes squashed as one and ptr pointing to this squashed node
@@ -286,7 +304,7 @@ func nodeReplace2Kid(new, old BNode, idx uint16, ptr uint64, key ByteArr) {
 	new.setHeader(old.btype(), old.nkeys()-1)
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, ptr, key, nil)
-	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+1))
+	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 }
 
 func Run() {
@@ -1,6 +1,7 @@
 package btreeplus
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 
@@ -115,8 +116,46 @@ func TestNodeSplit2(t *testing.T) {
 	}
 
 	lnode, rnode := NewBnode(), NewBnode()
-	nodeSplit2(lnode, rnode, node)
+	nodeSplit2(lnode, rnode, node, layout{pageSize: BTREE_PAGE_SIZE})
 
 	assert.Equal(t, uint16(1), lnode.nkeys())
 	assert.Equal(t, uint16(1), rnode.nkeys())
 }
+
+// the linear scan nodeLookupLE used to be, kept as a reference
+func nodeLookupLELinear(node BNode, key ByteArr) uint16 {
+	for i := uint16(0); i < node.nkeys(); i++ {
+		nodeKey, _ := node.getKeyAndVal(i)
+		switch bytes.Compare(nodeKey, key) {
+		case 0:
+			return i
+		case 1:
+			return i - 1
+		}
+	}
+
+	return node.nkeys() - 1
+}
+
+// a leaf holding the sentinel and then n sorted keys
+func lookupTestNode(n int) BNode {
+	node := NewBnode()
+	node.setHeader(uint16(LeafNode), uint16(n+1))
+	nodeAppendKV(node, 0, 0, nil, nil)
+	for i := 0; i < n; i++ {
+		nodeAppendKV(node, uint16(i+1), 0, ByteArr(fmt.Sprintf("k%04d", i*2)), nil)
+	}
+	return node
+}
+
+func TestNodeLookupMatchesLinear(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 7, 100, 200} {
+		node := lookupTestNode(n)
+		for i := -1; i <= 2*n+1; i++ {
+			key := ByteArr(fmt.Sprintf("k%04d", i))
+			assert.Equal(t, nodeLookupLELinear(node, key), nodeLookupLE(node, key), "n %d, key %s", n, key)
+		}
+		assert.Equal(t, uint16(0), nodeLookupLE(node, ByteArr("a")))
+		assert.Equal(t, uint16(n), nodeLookupLE(node, ByteArr("z")))
+	}
+}
@@ -0,0 +1,251 @@
+package btreeplus
+
+import (
+	"beaver/helpers"
+	"bytes"
+	"encoding/binary"
+	"sync"
+)
+
+/*
+With prefix compression (WithPrefixCompression) the longest prefix shared
+by every key of a node is stored once in the page, and the keys without it:
+
+| type | nkeys | checksum | plen | prefix | pointers | offsets | key-values | unused |
+|  2B  |   2B  |    4B    |  2B  |  plen  |    (as in an uncompressed node)  |        |
+
+PREFIX_FLAG is set in the type. The tree never works on compressed pages:
+they are expanded when read (get) and compressed when written (new), so the
+rest of the code keeps using the plain layout. An expanded node is allowed
+to grow past the page size, up to PREFIX_NODE_CAP, as long as it compresses
+into a page.
+
+Expanding rebuilds every key of the page, so the expanded nodes are kept in
+a NodeCache, by page number. Page numbers are reused once freed: an entry
+only serves a page that still holds the very bytes it was expanded from.
+*/
+const (
+	PREFIX_FLAG          = 0x8000
+	PREFIX_LEN_SIZE      = 2
+	PREFIX_NODE_CAP      = 32768
+	PREFIX_MAX_PAGE_SIZE = 16384 // leaves room for PREFIX_NODE_CAP to matter
+	PREFIX_CACHE_NODES   = 1024  // expanded nodes cached by default
+)
+
+// WithPrefixCompression stores the pages of the tree prefix compressed. It
+// needs pages of PREFIX_MAX_PAGE_SIZE at most.
+func WithPrefixCompression() Option {
+	return func(tree *BTree) {
+		tree.prefix = true
+	}
+}
+
+// WithNodeCache has a prefix compressed tree keep its expanded nodes in
+// cache, which may be shared with the other trees reading the same pages.
+// Without it, the tree gets a cache of PREFIX_CACHE_NODES of its own.
+func WithNodeCache(cache *NodeCache) Option {
+	return func(tree *BTree) {
+		tree.cache = cache
+	}
+}
+
+// NodeCache holds the nodes expanded from compressed pages. It is safe for
+// concurrent use; the nodes it hands out are shared, and must not be
+// modified.
+type NodeCache struct {
+	mu    sync.Mutex
+	max   int
+	nodes map[uint64]cachedNode
+}
+
+type cachedNode struct {
+	page BNode // the bytes the node was expanded from
+	node BNode
+}
+
+// NewNodeCache returns a cache of up to max nodes.
+func NewNodeCache(max int) *NodeCache {
+	return &NodeCache{max: max, nodes: make(map[uint64]cachedNode)}
+}
+
+// lookup returns the node expanded from page at ptr, if it is in cache.
+func (c *NodeCache) lookup(ptr uint64, page BNode) BNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.nodes[ptr]
+	if !ok || len(e.page) > len(page) || !bytes.Equal(e.page, page[:len(e.page)]) {
+		return nil
+	}
+	return e.node
+}
+
+func (c *NodeCache) store(ptr uint64, page, node BNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.nodes[ptr]; !ok && len(c.nodes) >= c.max {
+		// any entry will do, the map order is random enough
+		for old := range c.nodes {
+			delete(c.nodes, old)
+			break
+		}
+	}
+	c.nodes[ptr] = cachedNode{page: append(BNode{}, page[:page.compressedBytes()]...), node: node}
+}
+
+// layout is what decides whether a node fits in a page.
+type layout struct {
+	pageSize int
+	prefix   bool
+}
+
+// nodeCap is the largest (expanded) node a page can hold.
+func (l layout) nodeCap() int {
+	if l.prefix {
+		return PREFIX_NODE_CAP
+	}
+	return l.pageSize
+}
+
+// size is the number of bytes the keys [from, to) of node take in a page,
+// in the plain layout and once written.
+func (l layout) size(node BNode, from, to uint16) (plain, written int) {
+	n := int(to - from)
+	plain = HEADER_SIZE + n*(POINTER_SIZE+OFFSET_SIZE) + int(node.getOffset(to)-node.getOffset(from))
+	if !l.prefix {
+		return plain, plain
+	}
+	p := rangePrefixLen(node, from, to)
+	return plain, plain - n*p + PREFIX_LEN_SIZE + p
+}
+
+func (l layout) fits(node BNode, from, to uint16) bool {
+	plain, written := l.size(node, from, to)
+	return plain <= l.nodeCap() && written <= l.pageSize
+}
+
+// mergedFits reports whether left and right fit in a single page.
+func (l layout) mergedFits(left, right BNode) bool {
+	plain := int(left.nbytes()) + int(right.nbytes()) - HEADER_SIZE
+	if !l.prefix || plain > l.nodeCap() {
+		return plain <= l.nodeCap()
+	}
+	p := 0
+	if left.nkeys() > 0 && right.nkeys() > 0 {
+		p = min(rangePrefixLen(left, 0, left.nkeys()), rangePrefixLen(right, 0, right.nkeys()),
+			commonPrefixLen(left.getKey(0), right.getKey(0)))
+	}
+	n := int(left.nkeys() + right.nkeys())
+	return plain-n*p+PREFIX_LEN_SIZE+p <= l.pageSize
+}
+
+func commonPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// length of the prefix shared by the keys [from, to) of node
+func rangePrefixLen(node BNode, from, to uint16) int {
+	if from >= to {
+		return 0
+	}
+	first := node.getKey(from)
+	p := len(first)
+	for i := from + 1; i < to && p > 0; i++ {
+		p = min(p, commonPrefixLen(first, node.getKey(i)))
+	}
+	return p
+}
+
+// nbytes of a compressed page
+func (page BNode) compressedBytes() uint16 {
+	p := binary.LittleEndian.Uint16(page[HEADER_SIZE:])
+	nkeys := page.nkeys()
+	start := HEADER_SIZE + PREFIX_LEN_SIZE + p + (POINTER_SIZE+OFFSET_SIZE)*nkeys
+	if nkeys == 0 {
+		return start
+	}
+	last := HEADER_SIZE + PREFIX_LEN_SIZE + p + POINTER_SIZE*nkeys + OFFSET_SIZE*(nkeys-1)
+	return start + binary.LittleEndian.Uint16(page[last:])
+}
+
+// compressNode turns a plain node into a compressed page.
+func compressNode(node BNode, pageSize int) BNode {
+	nkeys := node.nkeys()
+	p := rangePrefixLen(node, 0, nkeys)
+	var prefix []byte
+	if p > 0 {
+		prefix = node.getKey(0)[:p]
+	}
+
+	// the keys without the prefix, in a plain node
+	stripped := BNode(make([]byte, len(node)))
+	stripped.setHeader(node.btype(), nkeys)
+	for i := uint16(0); i < nkeys; i++ {
+		k, v := node.getKeyAndVal(i)
+		nodeAppendKV(stripped, i, node.getPtr(i), k[p:], v)
+	}
+
+	page := BNode(make([]byte, pageSize))
+	page.setHeader(node.btype()|PREFIX_FLAG, nkeys)
+	binary.LittleEndian.PutUint16(page[HEADER_SIZE:], uint16(p))
+	copy(page[HEADER_SIZE+PREFIX_LEN_SIZE:], prefix)
+	body := stripped[HEADER_SIZE:stripped.nbytes()]
+	helpers.Assert(HEADER_SIZE+PREFIX_LEN_SIZE+p+len(body) <= pageSize)
+	copy(page[HEADER_SIZE+PREFIX_LEN_SIZE+p:], body)
+	return page
+}
+
+// expandNode turns a compressed page back into a plain node, just as big
+// as its keys need.
+func expandNode(page BNode) BNode {
+	p := int(binary.LittleEndian.Uint16(page[HEADER_SIZE:]))
+	prefix := page[HEADER_SIZE+PREFIX_LEN_SIZE:][:p]
+	btype, nkeys := page.btype()&^PREFIX_FLAG, page.nkeys()
+
+	// put the header back in front of the body to read it as a plain node
+	body := page[HEADER_SIZE+PREFIX_LEN_SIZE+p : page.compressedBytes()]
+	stripped := BNode(make([]byte, HEADER_SIZE+len(body)))
+	stripped.setHeader(btype, nkeys)
+	copy(stripped[HEADER_SIZE:], body)
+
+	node := BNode(make([]byte, int(stripped.nbytes())+p*int(nkeys)))
+	node.setHeader(btype, nkeys)
+	key := append([]byte{}, prefix...)
+	for i := uint16(0); i < nkeys; i++ {
+		k, v := stripped.getKeyAndVal(i)
+		nodeAppendKV(node, i, stripped.getPtr(i), append(key[:p], k...), v)
+	}
+	return node
+}
+
+// wrap the page callbacks of tree so that it only sees plain nodes.
+// overflow pages go through untouched.
+func usePrefixCompression(tree *BTree) {
+	get, new, pageSize, cache := tree.get, tree.new, tree.PageSize(), tree.cache
+
+	tree.get = func(ptr uint64) BNode {
+		page := get(ptr)
+		if page.btype()&PREFIX_FLAG == 0 {
+			return page
+		}
+		if node := cache.lookup(ptr, page); node != nil {
+			return node
+		}
+		// expanding a damaged page would read past it
+		if err := checkCompressed(page, pageSize); err != nil {
+			corruptf("page %d: %v", ptr, err)
+		}
+		node := expandNode(page)
+		cache.store(ptr, page, node)
+		return node
+	}
+	tree.new = func(node BNode) uint64 {
+		if NodeType(node.btype()) == OverflowNode {
+			return new(node)
+		}
+		return new(compressNode(node, pageSize))
+	}
+}
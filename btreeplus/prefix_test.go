@@ -0,0 +1,114 @@
+package btreeplus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPrefixBTS() *BtreeContainer {
+	treeContainer := NewBTS()
+	tree := &treeContainer.tree
+	treeContainer.tree, _ = NewBTree(tree.get, tree.new, tree.del, WithPrefixCompression())
+	return treeContainer
+}
+
+func prefixedKey(i int) string {
+	return fmt.Sprintf("tenant-0042/projects/beaver/objects/%06d", i)
+}
+
+func TestPrefixCompressRoundTrip(t *testing.T) {
+	node := BNode(make([]byte, PREFIX_NODE_CAP))
+	node.setHeader(uint16(LeafNode), 200)
+	for i := 0; i < 200; i++ {
+		nodeAppendKV(node, uint16(i), uint64(i), ByteArr(prefixedKey(i)), ByteArr("v"))
+	}
+	assert.Greater(t, int(node.nbytes()), BTREE_PAGE_SIZE)
+
+	page := compressNode(node, BTREE_PAGE_SIZE)
+	assert.LessOrEqual(t, int(page.nbytes()), BTREE_PAGE_SIZE)
+	assert.Equal(t, node[:node.nbytes()], BNode(expandNode(page)))
+}
+
+func TestNodeCache(t *testing.T) {
+	node := BNode(make([]byte, PREFIX_NODE_CAP))
+	node.setHeader(uint16(LeafNode), 100)
+	for i := 0; i < 100; i++ {
+		nodeAppendKV(node, uint16(i), 0, ByteArr(prefixedKey(i)), ByteArr("v"))
+	}
+	page := compressNode(node, BTREE_PAGE_SIZE)
+
+	cache := NewNodeCache(2)
+	assert.Nil(t, cache.lookup(1, page))
+	cache.store(1, page, expandNode(page))
+	assert.Equal(t, node[:node.nbytes()], cache.lookup(1, page))
+
+	// the page number reused for another node
+	nodeAppendKV(node, 99, 0, ByteArr(prefixedKey(1000)), ByteArr("v"))
+	assert.Nil(t, cache.lookup(1, compressNode(node, BTREE_PAGE_SIZE)))
+
+	cache.store(2, page, expandNode(page))
+	cache.store(3, page, expandNode(page))
+	assert.Len(t, cache.nodes, 2)
+}
+
+func TestPrefixCompressedTree(t *testing.T) {
+	plain, compressed := NewBTS(), newPrefixBTS()
+	for i := 0; i < 5000; i++ {
+		plain.Add(prefixedKey(i), "v")
+		compressed.Add(prefixedKey(i), "v")
+	}
+	assert.Less(t, 2*len(compressed.pages), len(plain.pages), "pages hold more keys")
+
+	for i := 0; i < 5000; i++ {
+		_, val := compressed.Get(prefixedKey(i))
+		assert.Equal(t, "v", string(val))
+	}
+
+	for i := 0; i < 5000; i++ {
+		if i%3 != 0 {
+			res, err := compressed.Del(prefixedKey(i))
+			assert.Nil(t, err)
+			assert.True(t, res)
+		}
+	}
+	got := []string{}
+	for iter := compressed.tree.Seek(nil); iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key()))
+	}
+	want := []string{}
+	for i := 0; i < 5000; i += 3 {
+		want = append(want, prefixedKey(i))
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestPrefixCompressedMixedKeys(t *testing.T) {
+	// keys sharing nothing, and big values, alongside prefixed ones
+	treeContainer := newPrefixBTS()
+	for i := 0; i < 2000; i++ {
+		treeContainer.Add(prefixedKey(i), "v")
+		treeContainer.Add(fmt.Sprintf("%03d-other", i%1000), bigVal(i%5*1000, byte(i)))
+	}
+	for i := 0; i < 2000; i += 2 {
+		treeContainer.Del(prefixedKey(i))
+	}
+	for k, v := range treeContainer.ref {
+		_, val := treeContainer.Get(k)
+		assert.Equal(t, v, string(val), "key %s", k)
+	}
+}
+
+func TestPrefixCompressedCorruptPage(t *testing.T) {
+	c := newPrefixBTS()
+	for i := 0; i < 500; i++ {
+		c.Add(prefixedKey(i), "v")
+	}
+	// the prefix of the root runs past the page
+	binary.LittleEndian.PutUint16(c.pages[c.tree.root][HEADER_SIZE:], BTREE_PAGE_SIZE)
+	_, _, err := c.tree.Get(ByteArr(prefixedKey(1)))
+	assert.ErrorIs(t, err, ErrCorrupt)
+	assert.ErrorContains(t, err, "prefix of")
+}
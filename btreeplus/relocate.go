@@ -0,0 +1,118 @@
+package btreeplus
+
+import (
+	"encoding/binary"
+)
+
+/*
+Relocate moves pages of the tree to other page numbers, the way a
+compaction needs it to empty the end of the file. A page can't be moved
+alone: its parent points at it, so the parent is copied too, with the
+new pointer, and so on up to the root. Overflow chains are linked the same
+way, from the first page to the last. Everything is copied on write like
+any other update: the new pages come from tree.new, the old ones go to
+tree.del.
+*/
+type relocator struct {
+	tree  *BTree
+	move  func(ptr uint64) bool
+	dry   bool // only count the pages
+	pages uint64
+}
+
+// Relocate copies every page for which move returns true, and the pages
+// pointing at them, to new pages. It returns the number of pages copied.
+func (tree *BTree) Relocate(move func(ptr uint64) bool) (pages uint64, err error) {
+	defer catchCorrupt(&err)
+	if tree.root == 0 {
+		return 0, nil
+	}
+	r := &relocator{tree: tree, move: move}
+	tree.root, _ = r.node(tree.root)
+	return r.pages, nil
+}
+
+// Relocations is the number of pages Relocate would copy, without copying
+// any.
+func (tree *BTree) Relocations(move func(ptr uint64) bool) (pages uint64, err error) {
+	defer catchCorrupt(&err)
+	if tree.root == 0 {
+		return 0, nil
+	}
+	r := &relocator{tree: tree, move: move, dry: true}
+	r.node(tree.root)
+	return r.pages, nil
+}
+
+// node relocates the subtree at ptr, and returns its new page number and
+// whether it was copied.
+func (r *relocator) node(ptr uint64) (uint64, bool) {
+	node := r.tree.readNode(ptr)
+	leaf := NodeType(node.btype()) == LeafNode
+	nkeys := node.nkeys()
+
+	ptrs := make([]uint64, nkeys)
+	copied := r.move(ptr)
+	for i := uint16(0); i < nkeys; i++ {
+		kid, moved := node.getPtr(i), false
+		switch {
+		case !leaf:
+			kid, moved = r.node(kid)
+		case kid != 0:
+			kid, moved = r.chain(kid)
+		}
+		ptrs[i] = kid
+		copied = copied || moved
+	}
+	if !copied {
+		return ptr, false
+	}
+
+	r.pages++
+	if r.dry {
+		return ptr, true
+	}
+	new := r.tree.newNode()
+	copy(new, node[:node.nbytes()])
+	for i, kid := range ptrs {
+		new.setPtr(uint16(i), kid)
+	}
+	r.tree.del(ptr)
+	return r.tree.new(new), true
+}
+
+// chain relocates the overflow chain starting at ptr. The pages before
+// the last one to move are copied too.
+func (r *relocator) chain(ptr uint64) (uint64, bool) {
+	var pages []uint64
+	last := -1
+	for p := ptr; p != 0; {
+		page := r.tree.get(p)
+		if t := NodeType(page.btype()); t != OverflowNode {
+			corruptf("page %d: %v in an overflow chain", p, t)
+		}
+		if r.move(p) {
+			last = len(pages)
+		}
+		pages = append(pages, p)
+		p = page.overflowNext()
+	}
+	if last == -1 {
+		return ptr, false
+	}
+
+	r.pages += uint64(last + 1)
+	if r.dry {
+		return ptr, true
+	}
+	// back to front, like overflowWrite
+	next := r.tree.get(pages[last]).overflowNext()
+	for i := last; i >= 0; i-- {
+		page := BNode(make([]byte, r.tree.PageSize()))
+		copy(page, r.tree.get(pages[i]))
+		binary.LittleEndian.PutUint64(page[HEADER_SIZE:], next)
+		r.tree.del(pages[i])
+		next = r.tree.new(page)
+	}
+	return next, true
+}
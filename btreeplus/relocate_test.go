@@ -0,0 +1,66 @@
+package btreeplus
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelocate(t *testing.T) {
+	plain := NewBTS()
+	plain.tree, _ = NewBTree(plain.tree.get, plain.tree.new, plain.tree.del)
+	for _, c := range []*BtreeContainer{plain, newPrefixBTS()} {
+		n, err := c.tree.Relocate(func(uint64) bool { return true })
+		assert.Nil(t, err)
+		assert.Zero(t, n, "empty tree")
+
+		for i := 0; i < 2000; i++ {
+			val := "v"
+			if i%200 == 0 {
+				val = bigVal(3*OVERFLOW_DATA_SIZE, byte(i))
+			}
+			c.Add(prefixedKey(i), val)
+		}
+
+		// the leaves and the last page of every chain
+		move := map[uint64]bool{}
+		for ptr, page := range c.pages {
+			switch NodeType(page.btype() &^ PREFIX_FLAG) {
+			case LeafNode:
+				move[ptr] = true
+			case OverflowNode:
+				move[ptr] = page.overflowNext() == 0
+			}
+		}
+		before := len(c.pages)
+		// the old pages stay allocated, new ones can't take their address
+		old := maps.Clone(c.pages)
+		want, err := c.tree.Relocations(func(ptr uint64) bool { return move[ptr] })
+		assert.Nil(t, err)
+		assert.Equal(t, before, len(c.pages), "counting doesn't copy")
+
+		n, err = c.tree.Relocate(func(ptr uint64) bool { return move[ptr] })
+		assert.Nil(t, err)
+		assert.Equal(t, want, n)
+		// every node has a moved leaf below it, every chain its last page
+		assert.Equal(t, uint64(before), n)
+		assert.Equal(t, before, len(c.pages))
+		for ptr := range c.pages {
+			assert.False(t, move[ptr], "page %d still in use", ptr)
+		}
+
+		errs, keys := checkBTS(t, c)
+		assert.Empty(t, errs)
+		assert.Equal(t, uint64(len(c.ref)), keys)
+		for k, v := range c.ref {
+			_, val := c.Get(k)
+			assert.Equal(t, ByteArr(v), val)
+		}
+
+		n, err = c.tree.Relocate(func(ptr uint64) bool { return move[ptr] })
+		assert.Nil(t, err)
+		assert.Zero(t, n, "nothing left to move")
+		assert.NotEmpty(t, old)
+	}
+}
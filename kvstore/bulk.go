@@ -0,0 +1,82 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"fmt"
+	"iter"
+)
+
+/*
+BulkLoad fills an empty KV in a single commit, building the tree bottom-up
+(see btreeplus.BulkLoad). Its pages are appended like those of any update,
+but rather than piling up in memory until the commit they are written out
+every BULK_SPILL_PAGES: the meta page on disk doesn't reach past the used
+mark, so they stay invisible until the commit, and are overwritten later
+if it fails.
+*/
+const BULK_SPILL_PAGES = 4096
+
+// BulkLoad fills the empty KV with pairs, which must come in ascending key
+// order without duplicates. Nodes are filled up to fill percent of a page,
+// 0 meaning btreeplus.DEFAULT_BULK_FILL. Everything is committed at once,
+// outside of the log in WAL mode; on error nothing is.
+func (db *KV) BulkLoad(pairs iter.Seq2[btreeplus.ByteArr, btreeplus.ByteArr], fill int) error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.filePtr == nil {
+		return ErrClosed
+	}
+	// the tree in the file is the one to build on
+	if db.wal != nil {
+		if err := checkpoint(db); err != nil {
+			return fmt.Errorf("BulkLoad: %w", err)
+		}
+	}
+	db.mu.Lock()
+	db.freelist.maxVer = oldestReader(db)
+	db.mu.Unlock()
+
+	meta := saveMeta(db)
+	var spillErr error
+	spilled := func(yield func(k, v btreeplus.ByteArr) bool) {
+		for key, val := range pairs {
+			if len(db.page.temp) >= BULK_SPILL_PAGES {
+				if spillErr = spillPages(db); spillErr != nil {
+					return
+				}
+			}
+			if !yield(key, val) {
+				return
+			}
+		}
+	}
+	err := db.tree.BulkLoad(spilled, fill)
+	if err == nil {
+		err = spillErr
+	}
+	if err != nil {
+		rollback(db, meta, pageMarks{})
+		return fmt.Errorf("BulkLoad: %w", err)
+	}
+
+	if err := updateOrRevert(db, meta); err != nil {
+		return fmt.Errorf("BulkLoad: %w", err)
+	}
+	if db.wal != nil {
+		// the log goes on from a durable meta page, as after a checkpoint
+		return syncNow(db)
+	}
+	return nil
+}
+
+// spillPages writes the pages appended so far ahead of the commit.
+func spillPages(db *KV) error {
+	if err := writeAppended(db); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.page.flushedCount += uint64(len(db.page.temp))
+	db.page.temp = db.page.temp[:0]
+	return nil
+}
@@ -0,0 +1,92 @@
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"beaver/btreeplus"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bulkPairs yields n sorted keys; every other value spans overflow pages,
+// enough for the load to be spilled.
+func bulkPairs(n int, want map[string][]byte) func(yield func(k, v btreeplus.ByteArr) bool) {
+	return func(yield func(k, v btreeplus.ByteArr) bool) {
+		for i := 0; i < n; i++ {
+			key, val := fmt.Sprintf("key-%06d", i), []byte(fmt.Sprintf("v%d", i))
+			if i%2 == 0 {
+				val = bytes.Repeat([]byte{byte(i)}, 20000)
+			}
+			if want != nil {
+				want[key] = val
+			}
+			if !yield([]byte(key), val) {
+				return
+			}
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	for _, opts := range []Options{{}, {PrefixCompression: true}, {WAL: true},
+		{Durability: SyncPeriodic, SyncInterval: time.Hour}} {
+		path := filepath.Join(t.TempDir(), "kvstore.data")
+		db := ProvisionKV(path, opts)
+		assert.Nil(t, db.Open())
+
+		want := map[string][]byte{}
+		txid := db.Stat().Txid
+		assert.Nil(t, db.BulkLoad(bulkPairs(3000, want), 0))
+		assert.Equal(t, txid+1, db.Stat().Txid, "a single commit")
+		assert.Greater(t, db.Stat().Pages, uint64(BULK_SPILL_PAGES))
+		report := db.Verify()
+		assert.True(t, report.OK(), "%+v: %v", opts, report.Problems)
+		assert.Zero(t, report.FreePages)
+		assertKeys(t, db, want)
+
+		assert.ErrorIs(t, db.BulkLoad(bulkPairs(10, nil), 0), ErrNotEmpty)
+		assert.Nil(t, db.Set([]byte("key-000001"), []byte("updated")))
+		want["key-000001"] = []byte("updated")
+		assert.Nil(t, db.Close())
+
+		report, err := Check(path, opts)
+		assert.Nil(t, err)
+		assert.True(t, report.OK(), "%+v: %v", opts, report.Problems)
+		db = ProvisionKV(path, opts)
+		assert.Nil(t, db.Open())
+		assertKeys(t, db, want)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestBulkLoadFailure(t *testing.T) {
+	db := ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+
+	// out of order after enough pages to be spilled
+	pairs := func(yield func(k, v btreeplus.ByteArr) bool) {
+		for k, v := range bulkPairs(3000, nil) {
+			if !yield(k, v) {
+				return
+			}
+		}
+		yield([]byte("a"), []byte("v"))
+	}
+	assert.ErrorIs(t, db.BulkLoad(pairs, 0), ErrUnsorted)
+	assert.Equal(t, uint64(1), db.Stat().Pages, "only the meta page")
+	assert.True(t, db.Verify().OK())
+	_, err := db.Get([]byte("key-000001"))
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// the pages written ahead are overwritten by the next load
+	assert.Nil(t, db.BulkLoad(bulkPairs(100, nil), 100))
+	assert.True(t, db.Verify().OK())
+	val, err := db.Get([]byte("key-000001"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(val))
+}
@@ -0,0 +1,202 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CheckReport is the outcome of Check or Verify. Problems lists everything
+// found wrong, the counts describe what could be read.
+type CheckReport struct {
+	Txid          uint64
+	Pages         uint64 // pages in the file, page 0 included
+	TreePages     uint64 // nodes of the tree and overflow pages
+	FreelistPages uint64 // nodes of the freelist
+	FreePages     uint64 // pages listed in the freelist
+	Keys          uint64
+	Problems      []error
+}
+
+func (r *CheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// who refers to a page
+type pageOwner uint8
+
+const (
+	OWNER_NONE pageOwner = iota
+	OWNER_TREE
+	OWNER_FREELIST
+	OWNER_FREE
+)
+
+var ownerNames = []string{"unused", "part of the tree", "a freelist node", "free"}
+
+// Check verifies the database file at path without opening it for
+// writing. Every page below the used mark must be reachable exactly once:
+// from the root of the tree, as a node of the freelist, or as an item of
+// it. The meta page is read as Open would, so opts must name the
+// comparator of the file; a write-ahead log is not replayed, commits only
+// found in it are not checked.
+//
+// The error is about the file not being checkable at all, the problems
+// found in it are in the report.
+func Check(path string, opts ...Options) (*CheckReport, error) {
+	db := ProvisionKV(path, opts...)
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Check: %w", err)
+	}
+	defer fp.Close()
+	info, err := fp.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Check: %w", err)
+	}
+	if info.Size() == 0 {
+		return &CheckReport{}, nil
+	}
+
+	data, err := unix.Mmap(int(fp.Fd()), 0, int(info.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("Check: mmap: %w", err)
+	}
+	defer unix.Munmap(data)
+	db.mmap.chunks = [][]byte{data}
+	db.mmap.totalFileSizeBytes = uint64(len(data))
+
+	if err := readRoot(db, uint64(len(data))); err != nil {
+		return nil, fmt.Errorf("Check: %w", err)
+	}
+	return verify(db, db.page.flushedCount, nil), nil
+}
+
+// Verify is Check on an open KV, as of the last commit. It holds back the
+// writer while it runs.
+func (db *KV) Verify() *CheckReport {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	// in WAL mode, pages committed since the last checkpoint are only in
+	// memory, and the pages they replaced only join the freelist at the
+	// checkpoint
+	return verify(db, db.page.flushedCount+uint64(len(db.page.temp)), db.page.toDelete)
+}
+
+// verify checks the first pages of db, the pending ones count as free.
+func verify(db *KV, pages uint64, pending []uint64) *CheckReport {
+	report, _ := survey(db, pages, pending)
+	return report
+}
+
+// survey is verify, also returning who owns each page.
+func survey(db *KV, pages uint64, pending []uint64) (*CheckReport, []pageOwner) {
+	report := &CheckReport{Txid: db.txid, Pages: pages}
+	owners := make([]pageOwner, pages)
+	visitAs := func(owner pageOwner) func(ptr uint64) bool {
+		return func(ptr uint64) bool {
+			if ptr == 0 || ptr >= pages {
+				report.Problems = append(report.Problems,
+					fmt.Errorf("page %d, %s, is outside of the %d used pages", ptr, ownerNames[owner], pages))
+				return false
+			}
+			if prev := owners[ptr]; prev != OWNER_NONE {
+				report.Problems = append(report.Problems,
+					fmt.Errorf("page %d is referenced twice: %s and %s", ptr, ownerNames[prev], ownerNames[owner]))
+				return false
+			}
+			owners[ptr] = owner
+			// free pages hold nothing, the others are read next
+			if _, pending := db.page.updates[ptr]; owner != OWNER_FREE && !pending && ptr < db.page.flushedCount {
+				if err := verifyPage(ptr, db.pageMapped(ptr)); err != nil {
+					report.Problems = append(report.Problems, err)
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	errs, keys := db.tree.Check(visitAs(OWNER_TREE))
+	report.Problems = append(report.Problems, errs...)
+	report.Keys = keys
+	verifyFreelist(db, report, visitAs(OWNER_FREELIST), visitAs(OWNER_FREE))
+	for _, ptr := range pending {
+		visitAs(OWNER_FREE)(ptr)
+	}
+
+	leaked := []string{}
+	for ptr := uint64(1); ptr < pages; ptr++ {
+		switch owners[ptr] {
+		case OWNER_NONE:
+			leaked = append(leaked, fmt.Sprint(ptr))
+		case OWNER_TREE:
+			report.TreePages++
+		case OWNER_FREELIST:
+			report.FreelistPages++
+		case OWNER_FREE:
+			report.FreePages++
+		}
+	}
+	if n := len(leaked); n > 0 {
+		if n > 20 {
+			leaked = append(leaked[:20], "...")
+		}
+		report.Problems = append(report.Problems,
+			fmt.Errorf("%d pages leaked, neither reachable nor free: %s", n, strings.Join(leaked, ", ")))
+	}
+	return report, owners
+}
+
+// verifyFreelist follows the freelist from its head node to its tail node,
+// visiting the nodes and the items between headSeq and tailSeq.
+func verifyFreelist(db *KV, report *CheckReport, visitNode, visitItem func(uint64) bool) {
+	fl := &db.freelist
+	if fl.tailPage == 0 {
+		return
+	}
+	problem := func(format string, args ...any) {
+		report.Problems = append(report.Problems, fmt.Errorf("freelist: "+format, args...))
+	}
+	if fl.headSeq > fl.tailSeq {
+		problem("head sequence %d is past the tail %d", fl.headSeq, fl.tailSeq)
+		return
+	}
+
+	seq := fl.headSeq
+	for node := fl.headPage; ; {
+		if !visitNode(node) {
+			return
+		}
+		lnode := LNode(db.pageRead(node))
+		if string(lnode[:len(FL_SIG)]) != FL_SIG {
+			problem("page %d isn't a freelist node", node)
+			return
+		}
+		for first := true; seq < fl.tailSeq && (first || fl.seq2idx(seq) != 0); seq++ {
+			// 0 is a slot left empty
+			if ptr, _ := lnode.getItem(fl.seq2idx(seq)); ptr != 0 {
+				visitItem(ptr)
+			}
+			first = false
+		}
+		if node == fl.tailPage {
+			if seq != fl.tailSeq {
+				problem("tail node %d reached with %d items left", node, fl.tailSeq-seq)
+			}
+			// the successor it reserved is only owned, not written yet
+			if next := lnode.getNext(); next == 0 {
+				problem("tail node %d reserves no successor", node)
+			} else {
+				visitNode(next)
+			}
+			return
+		}
+		if node = lnode.getNext(); node == 0 {
+			problem("list ends before its tail node %d", fl.tailPage)
+			return
+		}
+	}
+}
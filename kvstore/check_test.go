@@ -0,0 +1,169 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"beaver/btreeplus"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fillCheckKV makes a file with a few levels of tree, overflow values and
+// a populated freelist.
+func fillCheckKV(t *testing.T, path string, opts Options) {
+	db := ProvisionKV(path, opts)
+	assert.Nil(t, db.Open())
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 3000; i++ {
+		val := []byte(fmt.Sprintf("v%d", i))
+		if i%500 == 0 {
+			val = bytes.Repeat([]byte("x"), 10000)
+		}
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("key-%05d", r.Intn(5000))), val))
+		if i%3 == 0 {
+			// ErrNotFound half of the time
+			db.Del([]byte(fmt.Sprintf("key-%05d", r.Intn(5000))))
+		}
+	}
+	report := db.Verify()
+	assert.True(t, report.OK(), "%+v: %v", opts, report.Problems)
+	assert.Nil(t, db.Close())
+}
+
+func TestCheck(t *testing.T) {
+	for _, opts := range []Options{{}, {PrefixCompression: true}, {PageSize: 16384}, {WAL: true}} {
+		path := filepath.Join(t.TempDir(), "kvstore.data")
+		fillCheckKV(t, path, opts)
+
+		report, err := Check(path, opts)
+		assert.Nil(t, err)
+		assert.True(t, report.OK(), "%+v: %v", opts, report.Problems)
+		assert.Greater(t, report.Keys, uint64(1000))
+		assert.Greater(t, report.FreePages, uint64(0))
+		assert.Equal(t, report.Pages-1, report.TreePages+report.FreelistPages+report.FreePages)
+
+		db := ProvisionKV(path, opts)
+		assert.Nil(t, db.Open())
+		online := db.Verify()
+		assert.Nil(t, db.Close())
+		assert.Equal(t, report, online)
+	}
+
+	report, err := Check(filepath.Join(t.TempDir(), "empty"), Options{})
+	assert.NotNil(t, err)
+	assert.Nil(t, report)
+}
+
+// corrupt opens the file of a fresh database, lets edit change it, and
+// returns what Check says about it. The checksums are redone after edit, so
+// that the damage is found by looking at the pages.
+func corrupt(t *testing.T, edit func(db *KV)) *CheckReport {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	fillCheckKV(t, path, Options{})
+	db := ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	edit(db)
+	for ptr := uint64(1); ptr < db.page.flushedCount; ptr++ {
+		page := db.pageMapped(ptr)
+		copy(page, sealPage(nil, page))
+	}
+	assert.Nil(t, db.Close())
+
+	report, err := Check(path)
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	return report
+}
+
+// the root and its first leaf, found by following the first pointers
+func rootAndLeaf(db *KV) (btreeplus.BNode, uint64) {
+	root := db.pageReadFile(db.tree.GetRoot())
+	ptr := db.tree.GetRoot()
+	for node := root; binary.LittleEndian.Uint16(node) != uint16(btreeplus.LeafNode); node = db.pageReadFile(ptr) {
+		ptr = binary.LittleEndian.Uint64(node[btreeplus.HEADER_SIZE:])
+	}
+	return root, ptr
+}
+
+func problemsContain(report *CheckReport, s string) bool {
+	for _, err := range report.Problems {
+		if bytes.Contains([]byte(err.Error()), []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCheckCorruption(t *testing.T) {
+	// a page both in the tree and on the freelist
+	report := corrupt(t, func(db *KV) {
+		_, leaf := rootAndLeaf(db)
+		node := LNode(db.pageReadFile(db.freelist.headPage))
+		// the first item, past any slot left empty
+		idx := db.freelist.seq2idx(db.freelist.headSeq)
+		for ptr, _ := node.getItem(idx); ptr == 0; ptr, _ = node.getItem(idx) {
+			node = LNode(db.pageReadFile(node.getNext()))
+			idx = 0
+		}
+		node.setItem(idx, leaf, 0)
+	})
+	assert.True(t, problemsContain(report, "referenced twice: part of the tree and free"), report.Problems)
+	assert.True(t, problemsContain(report, "1 pages leaked"), report.Problems)
+
+	// a bad node type
+	report = corrupt(t, func(db *KV) {
+		_, leaf := rootAndLeaf(db)
+		binary.LittleEndian.PutUint16(db.pageReadFile(leaf), 7)
+	})
+	assert.True(t, problemsContain(report, "bad node type 7"), report.Problems)
+
+	// offsets going backwards
+	report = corrupt(t, func(db *KV) {
+		_, leaf := rootAndLeaf(db)
+		node := btreeplus.BNode(db.pageReadFile(leaf))
+		nkeys := binary.LittleEndian.Uint16(node[2:])
+		pos := btreeplus.HEADER_SIZE + btreeplus.POINTER_SIZE*int(nkeys)
+		binary.LittleEndian.PutUint16(node[pos+2:], 1)
+	})
+	assert.True(t, problemsContain(report, "offset 2 is 1"), report.Problems)
+
+	// keys out of order, and no longer matching their separator
+	report = corrupt(t, func(db *KV) {
+		_, leaf := rootAndLeaf(db)
+		node := db.pageReadFile(leaf)
+		nkeys := binary.LittleEndian.Uint16(node[2:])
+		kv := btreeplus.HEADER_SIZE + (btreeplus.POINTER_SIZE+btreeplus.OFFSET_SIZE)*int(nkeys)
+		off := int(binary.LittleEndian.Uint16(node[btreeplus.HEADER_SIZE+btreeplus.POINTER_SIZE*int(nkeys):]))
+		// the second key is "key-....."; make it sort last
+		node[kv+off+btreeplus.KV_HEADER_SIZE] = 'z'
+	})
+	assert.True(t, problemsContain(report, "isn't above key 1"), report.Problems)
+
+	// the root pointing twice at the same child
+	report = corrupt(t, func(db *KV) {
+		root, _ := rootAndLeaf(db)
+		first := binary.LittleEndian.Uint64(root[btreeplus.HEADER_SIZE:])
+		binary.LittleEndian.PutUint64(root[btreeplus.HEADER_SIZE+btreeplus.POINTER_SIZE:], first)
+	})
+	assert.True(t, problemsContain(report, "referenced twice: part of the tree and part of the tree"), report.Problems)
+	assert.True(t, problemsContain(report, "pages leaked"), report.Problems)
+}
+
+func TestCheckShortFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "short.txt")
+	assert.Nil(t, os.WriteFile(path, []byte("hello\n"), 0644))
+
+	_, err := Check(path)
+	var metaErr *MetaError
+	assert.True(t, errors.As(err, &metaErr))
+	assert.ErrorIs(t, err, ErrNotBeaverFile)
+	err = ProvisionKV(path).Open()
+	assert.ErrorIs(t, err, ErrNotBeaverFile)
+}
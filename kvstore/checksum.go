@@ -0,0 +1,81 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"beaver/helpers"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+Every page but the meta page carries a CRC-32C of its content, the
+checksum bytes excluded, at PAGE_CHECKSUM_POS: in the header of the tree
+pages (btreeplus.CHECKSUM_POS), after the magic of the freelist nodes. It
+is filled in when the page is written to the file and checked when a page is
+read from it, which catches bit rot and torn writes before the tree follows
+a damaged offset or pointer.
+*/
+const (
+	PAGE_CHECKSUM_POS  = btreeplus.CHECKSUM_POS
+	PAGE_CHECKSUM_SIZE = btreeplus.CHECKSUM_SIZE
+)
+
+func init() {
+	helpers.Assert(len(FL_SIG) == PAGE_CHECKSUM_POS)
+}
+
+var (
+	ErrPageChecksum = errors.New("page checksum mismatch")
+	ErrPageRange    = errors.New("page number out of range")
+	ErrFreelistEnd  = errors.New("freelist ends before its tail")
+)
+
+// PageError is a page of the file that can't be trusted. Err is one of
+// the ErrPage* values or ErrFreelistEnd; all are ErrCorrupt as well.
+type PageError struct {
+	Ptr uint64
+	Err error
+}
+
+func (e *PageError) Error() string {
+	return fmt.Sprintf("page %d: %v", e.Ptr, e.Err)
+}
+
+func (e *PageError) Unwrap() []error {
+	return []error{e.Err, ErrCorrupt}
+}
+
+// catchCorrupt is the kvstore side of the panics the tree turns into
+// errors: pages are read by callbacks that can't return one, and also
+// outside of the tree, by the freelist.
+func catchCorrupt(err *error) {
+	if r := recover(); r != nil {
+		if e, ok := r.(error); ok && errors.Is(e, ErrCorrupt) {
+			*err = e
+			return
+		}
+		panic(r)
+	}
+}
+
+func pageChecksum(page []byte) uint32 {
+	crc := crc32.Update(0, crcTable, page[:PAGE_CHECKSUM_POS])
+	return crc32.Update(crc, crcTable, page[PAGE_CHECKSUM_POS+PAGE_CHECKSUM_SIZE:])
+}
+
+// sealPage copies page into buf with its checksum stored, right before it is
+// written. The page itself is left alone: readers may be looking at it.
+func sealPage(buf, page []byte) []byte {
+	buf = append(buf[:0], page...)
+	binary.LittleEndian.PutUint32(buf[PAGE_CHECKSUM_POS:], pageChecksum(buf))
+	return buf
+}
+
+func verifyPage(ptr uint64, page []byte) error {
+	if binary.LittleEndian.Uint32(page[PAGE_CHECKSUM_POS:]) != pageChecksum(page) {
+		return &PageError{Ptr: ptr, Err: ErrPageChecksum}
+	}
+	return nil
+}
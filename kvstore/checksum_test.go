@@ -0,0 +1,86 @@
+package kvstore
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	fillCheckKV(t, path, Options{})
+
+	// flip a bit of a leaf, as bit rot would
+	db := ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	_, leaf := rootAndLeaf(db)
+	page := db.pageMapped(leaf)
+	page[len(page)/2] ^= 0x10
+	assert.Nil(t, db.Close())
+
+	report, err := Check(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []error{&PageError{Ptr: leaf, Err: ErrPageChecksum}}, report.Problems)
+
+	db = ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	assert.NotPanics(t, func() { db.pageReadFile(db.tree.GetRoot()) })
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			assert.True(t, errors.Is(err, ErrPageChecksum), err)
+			assert.EqualError(t, err, (&PageError{Ptr: leaf, Err: ErrPageChecksum}).Error())
+		}()
+		db.pageReadFile(leaf)
+	}()
+
+	// flipped back, the page is whole again
+	page[len(page)/2] ^= 0x10
+	assert.Nil(t, verifyPage(leaf, page))
+}
+
+func TestCorruptPageErrors(t *testing.T) {
+	for _, opts := range []Options{{}, {WAL: true}} {
+		path := filepath.Join(t.TempDir(), "kvstore.data")
+		fillCheckKV(t, path, opts)
+
+		db := ProvisionKV(path, opts)
+		assert.Nil(t, db.Open())
+		first, err := db.Scan(nil, nil, ScanOptions{Limit: 1})
+		assert.Nil(t, err)
+		key := first[0].Key
+		_, leaf := rootAndLeaf(db)
+		db.pageMapped(leaf)[db.pageSize/2] ^= 0x10
+
+		_, err = db.Get(key)
+		assert.ErrorIs(t, err, ErrCorrupt)
+		assert.ErrorIs(t, err, ErrPageChecksum)
+		var pageErr *PageError
+		assert.True(t, errors.As(err, &pageErr))
+		assert.Equal(t, leaf, pageErr.Ptr)
+
+		_, err = db.Scan(nil, nil, ScanOptions{})
+		assert.ErrorIs(t, err, ErrCorrupt)
+		_, err = db.Scan(key, nil, ScanOptions{Reverse: true})
+		assert.ErrorIs(t, err, ErrCorrupt)
+
+		// a failed update leaves nothing behind, the others go on
+		txid := db.txid
+		assert.ErrorIs(t, db.Set(key, []byte("v")), ErrCorrupt)
+		_, err = db.Del(key)
+		assert.ErrorIs(t, err, ErrCorrupt)
+		assert.Equal(t, txid, db.txid)
+		assert.Nil(t, db.Set([]byte("zzz"), []byte("v")))
+		val, err := db.Get([]byte("zzz"))
+		assert.Nil(t, err)
+		assert.Equal(t, "v", string(val))
+		assert.Nil(t, db.Close())
+
+		report, err := Check(path, opts)
+		assert.Nil(t, err)
+		assert.Equal(t, []error{&PageError{Ptr: leaf, Err: ErrPageChecksum}}, report.Problems, "%+v", opts)
+	}
+}
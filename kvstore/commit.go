@@ -0,0 +1,89 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"sync"
+)
+
+/*
+Single Set/Del calls go through a commit queue. The first caller to find
+no commit in progress becomes the leader: it takes the writer lock, applies
+every queued update in one Tx, commits it (one pair of fsyncs, or a single
+log record in WAL mode) and hands each caller its own result. Callers
+arriving in the meantime wait in the queue and make up the next group, so
+under load the cost of a commit is shared by many updates.
+*/
+type commitReq struct {
+	key, val  btreeplus.ByteArr
+	del       bool
+	isDeleted bool
+	err       error
+	done      chan struct{}
+}
+
+type commitQueue struct {
+	mu      sync.Mutex
+	pending []*commitReq
+	leading bool // a leader is draining the queue
+}
+
+// submit queues req and waits until it has been committed or has failed.
+func submit(db *KV, req *commitReq) {
+	req.done = make(chan struct{})
+
+	q := &db.queue
+	q.mu.Lock()
+	q.pending = append(q.pending, req)
+	if q.leading {
+		q.mu.Unlock()
+		<-req.done
+		return
+	}
+	q.leading = true
+	q.mu.Unlock()
+
+	for {
+		tx := db.Begin()
+		q.mu.Lock()
+		group := q.pending
+		q.pending = nil
+		q.mu.Unlock()
+
+		commitGroup(tx, group)
+
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.leading = false
+			q.mu.Unlock()
+			break
+		}
+		q.mu.Unlock()
+	}
+	<-req.done
+}
+
+// commitGroup applies the updates of group in order and commits them
+// together. An update that fails on its own leaves the others unaffected;
+// a failed commit fails all of them.
+func commitGroup(tx *Tx, group []*commitReq) {
+	applied := group[:0:0]
+	for _, req := range group {
+		if req.del {
+			req.isDeleted, req.err = tx.Del(req.key)
+		} else {
+			req.err = tx.Set(req.key, req.val)
+		}
+		if req.err == nil {
+			applied = append(applied, req)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		for _, req := range applied {
+			req.isDeleted, req.err = false, err
+		}
+	}
+	for _, req := range group {
+		close(req.done)
+	}
+}
@@ -0,0 +1,82 @@
+package kvstore
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func queued(db *KV) int {
+	db.queue.mu.Lock()
+	defer db.queue.mu.Unlock()
+	return len(db.queue.pending)
+}
+
+func TestGroupCommit(t *testing.T) {
+	db := openTestKV(t)
+	assert.Nil(t, db.Set([]byte("k00"), []byte("old")))
+	txid := db.txid
+
+	// hold the writer so the calls below pile up in the queue
+	tx := db.Begin()
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 5 {
+				errs[i] = db.Set([]byte(strings.Repeat("x", 4096)), []byte("v"))
+				return
+			}
+			errs[i] = db.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v"))
+		}(i)
+	}
+	for queued(db) < 10 {
+		runtime.Gosched()
+	}
+	tx.Abort()
+	wg.Wait()
+
+	assert.Equal(t, txid+1, db.txid, "a single commit for the whole group")
+	for i, err := range errs {
+		if i == 5 {
+			assert.NotNil(t, err, "a failed update gets its own error")
+			continue
+		}
+		assert.Nil(t, err)
+		val, err := db.Get([]byte(fmt.Sprintf("k%02d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "v", string(val))
+	}
+}
+
+func TestGroupCommitConcurrentWriters(t *testing.T) {
+	db := openTestKV(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				assert.Nil(t, db.Set([]byte(fmt.Sprintf("w%02d-%02d", w, i)), []byte("v")))
+				if i%2 == 1 {
+					deleted, err := db.Del([]byte(fmt.Sprintf("w%02d-%02d", w, i-1)))
+					assert.Nil(t, err)
+					assert.True(t, deleted)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	res, err := db.Scan(nil, nil, ScanOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, res, 16*25)
+	assert.LessOrEqual(t, db.txid, uint64(16*75))
+}
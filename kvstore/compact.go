@@ -0,0 +1,308 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+The file never shrinks by itself: pages freed by updates go to the
+freelist and are reused, but the end of the file stays allocated. Compact
+gives it back. It picks a cutoff page, below which the live pages and the
+freelist can all fit, and copies the tree pages at or above the cutoff,
+with their parents up to the root, to free pages below it (see
+btreeplus.Relocate). The freelist is then rebuilt from scratch, sorted, out
+of the pages below the cutoff that nothing uses anymore, and the commit
+moves the used mark down to the cutoff. The file is truncated once that
+meta page is durable.
+
+Like any update, the relocation only writes pages that the last durable
+meta page doesn't reach: free pages, never the old freelist nodes. A crash
+before the meta page is written leaves the old tree intact.
+*/
+
+// Compact moves the pages at the end of the file into free pages and
+// truncates the file after them. It waits for the open read transactions
+// to end and holds new ones back until it is done, so it must not be
+// called with a ReadTx open; the writer is held back too.
+func (db *KV) Compact() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.filePtr == nil {
+		return ErrClosed
+	}
+
+	// start from a file holding every commit, durably
+	if err := settle(db); err != nil {
+		return fmt.Errorf("Compact: %w", err)
+	}
+
+	db.mu.Lock()
+	db.compacting = true
+	for len(db.readers) > 0 {
+		db.idle.Wait()
+	}
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		db.compacting = false
+		db.idle.Broadcast()
+		db.mu.Unlock()
+	}()
+
+	report, owners := survey(db, db.page.flushedCount, nil)
+	if !report.OK() {
+		return fmt.Errorf("Compact: %w: %v", ErrCorrupt, report.Problems[0])
+	}
+	cutoff, err := compactCutoff(db, report, owners)
+	if err != nil {
+		return fmt.Errorf("Compact: %w", err)
+	}
+	if cutoff >= db.page.flushedCount {
+		return nil
+	}
+
+	meta := saveMeta(db)
+	db.txid++
+	if err := relocate(db, owners, cutoff); err != nil {
+		rollback(db, meta, pageMarks{})
+		return fmt.Errorf("Compact: %w", err)
+	}
+	// written out like a checkpoint, then made durable whatever the mode:
+	// the truncation must not happen before
+	err = writePages(db)
+	if err == nil {
+		err = flushMeta(db, saveMeta(db))
+	}
+	if err == nil {
+		err = unix.Fsync(db.fd)
+	}
+	if err != nil {
+		db.lastUpdateFailed = true
+		rollback(db, meta, pageMarks{})
+		return fmt.Errorf("Compact: %w", err)
+	}
+	publish(db)
+
+	// the pages from the cutoff on are unused, and unreachable by readers
+	// since there are none
+	size := db.page.flushedCount * db.pageSize
+	if err := db.filePtr.Truncate(int64(size)); err != nil {
+		return fmt.Errorf("Compact: truncate: %w", err)
+	}
+	db.mmap.totalFileSizeBytes = size
+	return nil
+}
+
+// settle writes out and syncs whatever was committed but isn't durable in
+// the file yet. Caller holds db.writer.
+func settle(db *KV) error {
+	if db.wal != nil {
+		return checkpoint(db)
+	}
+	if db.lastUpdateFailed {
+		if err := commitPages(db); err != nil {
+			return err
+		}
+	}
+	return syncNow(db)
+}
+
+// compactCutoff finds the lowest cutoff whose free pages can take the
+// tree pages to copy plus the nodes of the new freelist.
+func compactCutoff(db *KV, report *CheckReport, owners []pageOwner) (uint64, error) {
+	pages := db.page.flushedCount
+	// free[c] is the number of free pages below c
+	free := make([]uint64, pages+1)
+	for ptr := uint64(1); ptr < pages; ptr++ {
+		free[ptr+1] = free[ptr]
+		if owners[ptr] == OWNER_FREE {
+			free[ptr+1]++
+		}
+	}
+
+	var err error
+	fits := func(cutoff uint64) bool {
+		moves, e := db.tree.Relocations(func(ptr uint64) bool { return ptr >= cutoff })
+		if e != nil {
+			err = e
+			return true
+		}
+		nodes, _ := freelistLayout(cutoff-1-report.TreePages, db.freelist.cap)
+		return moves+nodes <= free[cutoff]
+	}
+	// more room below a higher cutoff, and less to move; but for the one
+	// leaving a single page to the freelist, which never fits
+	lo, hi := report.TreePages+1, pages
+	if lo < hi {
+		if fits(lo) {
+			hi = lo
+		} else {
+			lo = min(lo+2, hi)
+		}
+	}
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if fits(mid) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return lo, nil
+}
+
+// freelistLayout shares out the free pages below a cutoff between the
+// nodes of a freelist and its items. The last node is the successor the
+// tail node reserves, and the tail node must have room for the next push:
+// the items start at the offset headSeq in the first node when that saves
+// a node. A single page can't make a list, it is given two nodes that
+// won't fit.
+func freelistLayout(free uint64, cap int) (nodes uint64, headSeq uint64) {
+	if free == 0 {
+		return 0, 0
+	}
+	span := func(items uint64) uint64 {
+		return items/uint64(cap) + 2
+	}
+	for nodes < free && span(free-nodes) > nodes {
+		nodes++
+	}
+	if nodes < 2 {
+		return 2, 0
+	}
+	if items := free - nodes; items < (nodes-2)*uint64(cap) {
+		headSeq = (nodes-2)*uint64(cap) - items
+	}
+	return nodes, headSeq
+}
+
+// relocate copies the tree pages from cutoff on below it, and replaces the
+// freelist with one holding every other page below it. The new pages are
+// pending in page.updates, like pages reused from the freelist.
+func relocate(db *KV, owners []pageOwner, cutoff uint64) (err error) {
+	defer catchCorrupt(&err)
+	var slots []uint64
+	for ptr := uint64(1); ptr < cutoff; ptr++ {
+		if owners[ptr] == OWNER_FREE {
+			slots = append(slots, ptr)
+		}
+	}
+	place := func(page btreeplus.BNode) uint64 {
+		ptr := slots[0]
+		slots = slots[1:]
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.page.updates[ptr] = page
+		db.page.reused = append(db.page.reused, ptr)
+		return ptr
+	}
+
+	copied := map[uint64]bool{}
+	tree, err := btreeplus.NewBTree(db.pageRead, func(node btreeplus.BNode) uint64 {
+		// the tree may hand over a node bigger than a page
+		page := make(btreeplus.BNode, db.pageSize)
+		copy(page, node)
+		return place(page)
+	}, func(ptr uint64) { copied[ptr] = true }, treeOptions(db)...)
+	if err != nil {
+		return err
+	}
+	tree.SetRoot(db.tree.GetRoot())
+	if _, err := tree.Relocate(func(ptr uint64) bool { return ptr >= cutoff }); err != nil {
+		return err
+	}
+	db.tree.SetRoot(tree.GetRoot())
+
+	// what's left below the cutoff
+	used := map[uint64]bool{}
+	for _, ptr := range db.page.reused {
+		used[ptr] = true
+	}
+	var items []uint64
+	for ptr := uint64(1); ptr < cutoff; ptr++ {
+		if !used[ptr] && (owners[ptr] != OWNER_TREE || copied[ptr]) {
+			items = append(items, ptr)
+		}
+	}
+
+	fl := &db.freelist
+	nodes, headSeq := freelistLayout(uint64(len(items)), fl.cap)
+	// the nodes take the lowest free pages left
+	ptrs := slices.Clone(slots[:nodes])
+	for _, ptr := range ptrs {
+		used[ptr] = true
+	}
+	items = slices.DeleteFunc(items, func(ptr uint64) bool { return used[ptr] })
+	// the last one is only reserved
+	lnodes := make([]LNode, max(nodes, 1)-1)
+	for i := range lnodes {
+		lnodes[i] = NewLNode(int(db.pageSize))
+		place(btreeplus.BNode(lnodes[i]))
+		lnodes[i].setNext(ptrs[i+1])
+	}
+	for i, ptr := range items {
+		seq := headSeq + uint64(i)
+		lnodes[seq/uint64(fl.cap)].setItem(fl.seq2idx(seq), ptr, db.txid)
+	}
+
+	fl.headPage, fl.tailPage = 0, 0
+	if nodes > 0 {
+		fl.headPage, fl.tailPage = ptrs[0], ptrs[nodes-2]
+	}
+	fl.headSeq, fl.tailSeq = headSeq, headSeq+uint64(len(items))
+	db.page.flushedCount = cutoff
+	return nil
+}
+
+// CopyTo writes the last committed tree of db to a new database file at
+// path, with the same page layout and comparator, bulk loaded into full
+// pages. It is the offline compaction: once db is closed, the copy can take
+// the place of its file. path must not exist yet.
+func (db *KV) CopyTo(path string) error {
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("CopyTo: %w: %s", os.ErrExist, path)
+	}
+	dst := ProvisionKV(path, Options{
+		PageSize:          int(db.pageSize),
+		PrefixCompression: db.flags&META_FLAG_PREFIX != 0,
+		Comparator:        db.opts.comparator(),
+	})
+	if err := dst.Open(); err != nil {
+		return fmt.Errorf("CopyTo: %w", err)
+	}
+
+	err := copyTree(db, dst)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("CopyTo: %w", err)
+	}
+	return nil
+}
+
+// copyTree loads the pairs of src into dst.
+func copyTree(src, dst *KV) error {
+	rtx := src.BeginRead()
+	defer rtx.End()
+
+	var scanErr error
+	pairs := func(yield func(k, v btreeplus.ByteArr) bool) {
+		scanErr = scanTree(&rtx.tree, nil, nil, ScanOptions{}, yield)
+	}
+	if err := dst.BulkLoad(pairs, 100); err != nil {
+		return err
+	}
+	// a damaged page ends the scan early, the copy is short
+	return scanErr
+}
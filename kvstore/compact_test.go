@@ -0,0 +1,149 @@
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fillCompactKV writes 3000 keys, some with overflow values, then deletes
+// all but every tenth. It returns the keys left.
+func fillCompactKV(t *testing.T, db *KV) map[string][]byte {
+	left := map[string][]byte{}
+	for i := 0; i < 3000; i++ {
+		key, val := fmt.Sprintf("key-%05d", i), []byte(fmt.Sprintf("v%d", i))
+		if i%250 == 0 {
+			val = bytes.Repeat([]byte{byte(i)}, 10000)
+		}
+		assert.Nil(t, db.Set([]byte(key), val))
+		left[key] = val
+	}
+	tx := db.Begin()
+	for i := 0; i < 3000; i++ {
+		if i%10 != 0 {
+			key := fmt.Sprintf("key-%05d", i)
+			_, err := tx.Del([]byte(key))
+			assert.Nil(t, err)
+			delete(left, key)
+		}
+	}
+	assert.Nil(t, tx.Commit())
+	return left
+}
+
+func assertKeys(t *testing.T, db *KV, want map[string][]byte) {
+	pairs, err := db.Scan(nil, nil, ScanOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, pairs, len(want))
+	for _, pair := range pairs {
+		assert.Equal(t, want[string(pair.Key)], []byte(pair.Val), string(pair.Key))
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	return info.Size()
+}
+
+func TestCompact(t *testing.T) {
+	for _, opts := range []Options{{}, {PrefixCompression: true}, {PageSize: 16384},
+		{WAL: true}, {Durability: SyncPeriodic, SyncInterval: time.Hour}} {
+		path := filepath.Join(t.TempDir(), "kvstore.data")
+		db := ProvisionKV(path, opts)
+		assert.Nil(t, db.Open())
+		left := fillCompactKV(t, db)
+		// pages logged in WAL mode don't count yet
+		assert.Nil(t, db.Checkpoint())
+		before := db.Stat()
+
+		assert.Nil(t, db.Compact())
+		after := db.Stat()
+		assert.Less(t, after.Pages, before.Pages/2, "%+v", opts)
+		assert.Equal(t, after.Pages*uint64(after.PageSize), after.FileSize)
+		assert.Equal(t, int64(after.FileSize), fileSize(t, path))
+		report := db.Verify()
+		assert.True(t, report.OK(), "%+v: %v", opts, report.Problems)
+		assert.Equal(t, after.Pages-1, report.TreePages+report.FreelistPages+report.FreePages)
+		assertKeys(t, db, left)
+
+		// little more to gain: the first pass made room for copying parents
+		assert.Nil(t, db.Compact())
+		assert.LessOrEqual(t, db.Stat().Pages, after.Pages)
+		assert.True(t, db.Verify().OK())
+
+		// the file grows again from there
+		for i := 0; i < 500; i++ {
+			key, val := fmt.Sprintf("new-%05d", i), bytes.Repeat([]byte("n"), 100)
+			assert.Nil(t, db.Set([]byte(key), val))
+			left[key] = val
+		}
+		assert.True(t, db.Verify().OK())
+		assert.Nil(t, db.Close())
+
+		report, err := Check(path, opts)
+		assert.Nil(t, err)
+		assert.True(t, report.OK(), "%+v: %v", opts, report.Problems)
+		db = ProvisionKV(path, opts)
+		assert.Nil(t, db.Open())
+		assertKeys(t, db, left)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestCompactWaitsForReaders(t *testing.T) {
+	db := ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	fillCompactKV(t, db)
+
+	rtx := db.BeginRead()
+	done := make(chan error)
+	go func() { done <- db.Compact() }()
+	select {
+	case <-done:
+		t.Fatal("Compact didn't wait for the reader")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// the snapshot is still whole
+	val, err := rtx.Get([]byte("key-00010"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v10", string(val))
+	rtx.End()
+	assert.Nil(t, <-done)
+
+	val, err = db.Get([]byte("key-00010"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v10", string(val))
+}
+
+func TestCopyTo(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{PrefixCompression: true, PageSize: 8192}
+	db := ProvisionKV(filepath.Join(dir, "kvstore.data"), opts)
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	left := fillCompactKV(t, db)
+
+	path := filepath.Join(dir, "copy.data")
+	assert.Nil(t, db.CopyTo(path))
+	assert.ErrorIs(t, db.CopyTo(path), os.ErrExist)
+
+	report, err := Check(path, opts)
+	assert.Nil(t, err)
+	assert.True(t, report.OK(), report.Problems)
+	assert.Equal(t, uint64(len(left)), report.Keys)
+	assert.Less(t, fileSize(t, path), fileSize(t, db.Path)/2)
+
+	copied := ProvisionKV(path, opts)
+	assert.Nil(t, copied.Open())
+	defer copied.Close()
+	assert.Equal(t, 8192, copied.Stat().PageSize)
+	assert.True(t, copied.Stat().PrefixCompression)
+	assertKeys(t, copied, left)
+}
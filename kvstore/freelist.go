@@ -3,189 +3,243 @@ package kvstore
 import (
 	"beaver/btreeplus"
 	"encoding/binary"
+	"math"
 )
 
 // node format:
-// |pointers | unused |
-// | n*8B    |   ...  |
+// | magic | checksum | next page |        items         | unused |
+// |  4B   |    4B    |     8B    | n*(8B ptr + 8B ver)  |   ...  |
+//
+// ver is the txid of the update that freed the page. the checksum is at
+// the same place as in tree pages, see PAGE_CHECKSUM_POS.
 type LNode []byte
 
-// header format:
-// |magic| num of pointers | head position | tail position | prev file pointer | next file point
-// | 4B  | 8B | 8B | 8B | 8B | 8B
-
 const FL_SIG = "FL01"
-const FREE_LIST_HEADER_SIZE = len(FL_SIG) + 5*HEADER_ENTRY_SIZE
 const HEADER_ENTRY_SIZE = 8
-const FREE_LIST_CAP = (btreeplus.BTREE_PAGE_SIZE - FREE_LIST_HEADER_SIZE) / 8
-
-func PopulateFreeListNode(lnode LNode, pointerCount, headPos, tailPos, prevFP, nextFp uint64) {
-	copy(lnode[0:len(FL_SIG)], []byte(FL_SIG))
-
-}
-
-func (lnode LNode) getTotalPointers() uint64 {
-	return binary.LittleEndian.Uint64(lnode[len(FL_SIG) : len(FL_SIG)+HEADER_ENTRY_SIZE])
-}
-
-func (lnode LNode) setTotalPointers(v uint64) {
-	binary.LittleEndian.PutUint64(lnode[len(FL_SIG):len(FL_SIG)+HEADER_ENTRY_SIZE], v)
-}
-
-func (lnode LNode) getHeadPosition() uint64 {
-	return binary.LittleEndian.Uint64(lnode[len(FL_SIG)+HEADER_ENTRY_SIZE : len(FL_SIG)+2*HEADER_ENTRY_SIZE])
-}
-
-func (lnode LNode) setHeadPosition(v uint64) {
-	binary.LittleEndian.PutUint64(lnode[len(FL_SIG)+HEADER_ENTRY_SIZE:len(FL_SIG)+2*HEADER_ENTRY_SIZE], v)
-}
+const FL_NEXT_POS = PAGE_CHECKSUM_POS + PAGE_CHECKSUM_SIZE
+const FREE_LIST_HEADER_SIZE = FL_NEXT_POS + HEADER_ENTRY_SIZE
+const FREE_LIST_ITEM_SIZE = 2 * HEADER_ENTRY_SIZE
 
-func (lnode LNode) getTailPosition() uint64 {
-	return binary.LittleEndian.Uint64(lnode[len(FL_SIG)+(2*HEADER_ENTRY_SIZE) : len(FL_SIG)+(3*HEADER_ENTRY_SIZE)])
+// number of items in a node of pageSize bytes
+func freelistCap(pageSize int) int {
+	return (pageSize - FREE_LIST_HEADER_SIZE) / FREE_LIST_ITEM_SIZE
 }
 
-func (lnode LNode) setTailPosition(v uint64) {
-	binary.LittleEndian.PutUint64(lnode[len(FL_SIG)+(2*HEADER_ENTRY_SIZE):len(FL_SIG)+(3*HEADER_ENTRY_SIZE)], v)
+func NewLNode(pageSize int) LNode {
+	lnode := make(LNode, pageSize)
+	copy(lnode[0:len(FL_SIG)], []byte(FL_SIG))
+	return lnode
 }
 
-func (lnode LNode) prevFilePointer() (uint64, bool) {
-	val := binary.LittleEndian.Uint64(lnode[len(FL_SIG)+(3*HEADER_ENTRY_SIZE) : len(FL_SIG)+(4*HEADER_ENTRY_SIZE)])
-
-	return val, val == 0
+func (lnode LNode) getNext() uint64 {
+	return binary.LittleEndian.Uint64(lnode[FL_NEXT_POS:FREE_LIST_HEADER_SIZE])
 }
 
-func (lnode LNode) setPrevFilePointer(v uint64) {
-	binary.LittleEndian.PutUint64(lnode[len(FL_SIG)+(3*HEADER_ENTRY_SIZE):len(FL_SIG)+(4*HEADER_ENTRY_SIZE)], v)
+func (lnode LNode) setNext(v uint64) {
+	binary.LittleEndian.PutUint64(lnode[FL_NEXT_POS:FREE_LIST_HEADER_SIZE], v)
 }
 
-func (lnode LNode) nextFilePointer() (uint64, bool) {
-	val := binary.LittleEndian.Uint64(lnode[len(FL_SIG)+(4*HEADER_ENTRY_SIZE) : len(FL_SIG)+(5*HEADER_ENTRY_SIZE)])
-
-	return val, val == 0
+func (lnode LNode) getItem(idx int) (ptr uint64, ver uint64) {
+	pos := FREE_LIST_HEADER_SIZE + idx*FREE_LIST_ITEM_SIZE
+	ptr = binary.LittleEndian.Uint64(lnode[pos:])
+	ver = binary.LittleEndian.Uint64(lnode[pos+HEADER_ENTRY_SIZE:])
+	return ptr, ver
 }
 
-func (lnode LNode) setNextFilePointer(v uint64) {
-	binary.LittleEndian.PutUint64(lnode[len(FL_SIG)+(4*HEADER_ENTRY_SIZE):len(FL_SIG)+(5*HEADER_ENTRY_SIZE)], v)
+func (lnode LNode) setItem(idx int, ptr uint64, ver uint64) {
+	pos := FREE_LIST_HEADER_SIZE + idx*FREE_LIST_ITEM_SIZE
+	binary.LittleEndian.PutUint64(lnode[pos:], ptr)
+	binary.LittleEndian.PutUint64(lnode[pos+HEADER_ENTRY_SIZE:], ver)
 }
 
-func (node LNode) getPtr(idx int) uint64 {
-	return binary.LittleEndian.Uint64(node[FREE_LIST_HEADER_SIZE+idx*HEADER_ENTRY_SIZE:])
-}
+/*
+Freelist is a FIFO of unused page numbers, stored as a linked list of LNodes.
+Items are addressed by monotonic sequence numbers: an item's slot inside its
+node is seq % cap, so crossing a multiple of the capacity means
+moving on to the next node. Pages are pushed at the tail and popped at the
+head; a head node that has been emptied is itself recycled through the tail.
 
-func (node LNode) setPtr(idx int, ptr uint64) {
-	binary.LittleEndian.PutUint64(node[FREE_LIST_HEADER_SIZE+idx*HEADER_ENTRY_SIZE:FREE_LIST_HEADER_SIZE+(idx+1)*HEADER_ENTRY_SIZE], ptr)
-}
-
-// func (lnode LNode) isNodeFull() bool {
-// 	return BTREE_PAGE_SIZE == FREE_LIST_HEADER_SIZE + lnode.getTotalPointers() *
-// }
+Each item also remembers the version (txid) that freed it. A page freed by
+version v is still part of every tree older than v, so it is only handed
+out once no reader is left on such a version (see maxVer).
 
+A node is never written again once it is in the file: the durable meta page
+may point at it, and a torn write would take the list down with it. So
+every node reserves its successor when it is made, in its next pointer,
+and the first push after the tail node got written out leaves the rest of
+it empty and goes on in that successor. The empty slots read as page 0,
+which the head skips. The reserved page itself is only written once the
+tail moves on to it; the list doesn't read it before.
+*/
 type Freelist struct {
 	// callbacks for managing on-disk pages
-	get                func(uint64) btreeplus.BNode  // read a page
-	new                func(btreeplus.BNode) uint64  // append a new page
-	set                func(uint64, btreeplus.BNode) // update an existing page
-	currentPagePointer uint64
+	get func(uint64) btreeplus.BNode // read a page
+	new func(btreeplus.BNode) uint64 // append a new page
+	set func(uint64) btreeplus.BNode // update an existing page
 	// persisted data in the meta page
 	headPage uint64
 	headSeq  uint64
 	tailPage uint64
 	tailSeq  uint64
 	// in-memory states
-	maxSeq uint64 // saved `tailSeq` to prevent consuming newly added items
+	maxSeq   uint64 // saved `tailSeq` to prevent consuming newly added items
+	maxVer   uint64 // oldest version still being read, newer frees are kept
+	version  uint64 // version stamped on the items pushed
+	tailNew  bool   // the tail node isn't in the file yet, it may be updated
+	pageSize int
+	cap      int // items per node
 }
 
 func NewFreelist(get func(uint64) btreeplus.BNode,
 	new func(btreeplus.BNode) uint64,
-	set func(uint64, btreeplus.BNode)) Freelist {
+	set func(uint64) btreeplus.BNode, pageSize int) Freelist {
 	return Freelist{
-		get: get,
-		new: new,
-		set: set,
+		get:      get,
+		new:      new,
+		set:      set,
+		maxVer:   math.MaxUint64,
+		pageSize: pageSize,
+		cap:      freelistCap(pageSize),
 	}
+}
 
+func (fl *Freelist) seq2idx(seq uint64) int {
+	return int(seq % uint64(fl.cap))
 }
 
-func (fl *Freelist) SetParamsFromLNode(lnode LNode, currentPagePointer uint64) {
-	fl.headSeq = lnode.getHeadPosition()
-	fl.tailSeq = lnode.getTailPosition()
-	fl.headPage, _ = lnode.prevFilePointer()
-	fl.tailPage, _ = lnode.nextFilePointer()
+// SetMaxSeq makes everything pushed so far available to PopHead. It is
+// called once the pushes are committed, so pages freed by an update are
+// never handed out again before that update is durable.
+func (fl *Freelist) SetMaxSeq() {
 	fl.maxSeq = fl.tailSeq
-	fl.currentPagePointer = currentPagePointer
 }
 
-func seq2idx(seq uint64) int {
-	return int(seq) % FREE_LIST_CAP
+// TailWritten records that the tail node went to the file: the next push
+// leaves it alone.
+func (fl *Freelist) TailWritten() {
+	fl.tailNew = false
 }
 
 func (fl *Freelist) PushTail(ptr uint64) {
-	/*
-		1. if tail wraps to head, move to a new page
-		2. else just push value and update tail position
-		3. update the mem location
-	*/
-
-	if seq2idx(fl.tailSeq+1) == seq2idx(fl.headSeq) {
-
-		for seq2idx(fl.tailSeq+1) == seq2idx(fl.headSeq) {
-			if fl.tailSeq != 0 {
-				fl.SetParamsFromLNode(LNode(fl.get(fl.tailPage)), fl.tailPage)
-			} else {
-				// create new page
-				pageLNode := LNode(btreeplus.NewBnode())
-				pagePtr := fl.new(btreeplus.BNode(pageLNode))
-
-				// update current page with next ptr ref
-				curPageLNode := LNode(fl.get(fl.currentPagePointer))
-				curPageLNode.setNextFilePointer(pagePtr)
-
-				fl.set(pagePtr, btreeplus.BNode(pageLNode))
-
-				// update back ptr for new page
-				pageLNode.setPrevFilePointer(fl.currentPagePointer)
-				fl.currentPagePointer = pagePtr
-			}
-		}
-
+	// the list owns no node until the first push
+	if fl.tailPage == 0 {
+		fl.tailPage = fl.new(btreeplus.BNode(NewLNode(fl.pageSize)))
+		fl.headPage = fl.tailPage
+		LNode(fl.set(fl.tailPage)).setNext(fl.new(btreeplus.BNode(NewLNode(fl.pageSize))))
+		fl.tailNew = true
+	}
+	if !fl.tailNew {
+		fl.tailSeq += uint64(fl.cap - fl.seq2idx(fl.tailSeq))
+		flMoveTail(fl)
 	}
 
-	curpageNode := LNode(fl.get(fl.currentPagePointer))
-	curpageNode.setPtr(seq2idx(fl.tailSeq), ptr)
+	LNode(fl.set(fl.tailPage)).setItem(fl.seq2idx(fl.tailSeq), ptr, fl.version)
 	fl.tailSeq++
-	curpageNode.setTailPosition(fl.tailSeq)
-
-	fl.set(fl.currentPagePointer, btreeplus.BNode(curpageNode))
 
+	// the tail node is full
+	if fl.seq2idx(fl.tailSeq) == 0 {
+		flMoveTail(fl)
+	}
 }
 
-func (fl *Freelist) PopHead() (ptr uint64, exists bool) {
-	/*
-		1. if head moves into tail, return no exists
-		2. else return the head value and update head position
-		3. update the mem location
-	*/
-
-	for seq2idx(fl.headSeq+1) == seq2idx(fl.tailSeq) {
-		if fl.headPage != 0 {
-			fl.SetParamsFromLNode(LNode(fl.get(fl.headPage)), fl.headPage)
-		} else {
-			return 0, false
+// flMoveTail goes on with the successor the tail node reserved, which
+// reserves its own.
+func flMoveTail(fl *Freelist) {
+	next := LNode(fl.get(fl.tailPage)).getNext()
+	if next == 0 {
+		panic(&PageError{Ptr: fl.tailPage, Err: ErrFreelistEnd})
+	}
+	// prefer a free page, past the empty ends of the head nodes
+	var reserved uint64
+	var heads []uint64
+	for {
+		ptr, head := flPop(fl)
+		if head != 0 {
+			heads = append(heads, head)
+		}
+		if ptr != 0 || head == 0 {
+			reserved = ptr
+			break
+		}
+	}
+	if reserved == 0 {
+		reserved = fl.new(btreeplus.BNode(NewLNode(fl.pageSize)))
+	}
 
+	node := LNode(fl.set(next))
+	copy(node, NewLNode(fl.pageSize))
+	node.setNext(reserved)
+	fl.tailPage = next
+	fl.tailNew = true
+
+	// the removed head nodes are now free as well
+	for _, head := range heads {
+		node.setItem(fl.seq2idx(fl.tailSeq), head, fl.version)
+		fl.tailSeq++
+	}
+}
+
+// Len counts the pages on the list, which takes reading its nodes: the
+// sequence numbers also cover the slots left empty.
+func (fl *Freelist) Len() uint64 {
+	n := uint64(0)
+	node := fl.headPage
+	for seq := fl.headSeq; seq < fl.tailSeq; {
+		lnode := LNode(fl.get(node))
+		for ; seq < fl.tailSeq; seq++ {
+			if ptr, _ := lnode.getItem(fl.seq2idx(seq)); ptr == 0 {
+				seq += uint64(fl.cap - fl.seq2idx(seq))
+				break
+			}
+			n++
+			if fl.seq2idx(seq+1) == 0 {
+				seq++
+				break
+			}
 		}
+		node = lnode.getNext()
 	}
+	return n
+}
 
-	curpageNode := LNode(fl.get(fl.currentPagePointer))
-	ptr = curpageNode.getPtr(seq2idx(fl.headSeq))
-	exists = true
-	fl.headSeq++
-	curpageNode.setHeadPosition(fl.headSeq)
-	fl.set(fl.currentPagePointer, btreeplus.BNode(curpageNode))
-	return
+func (fl *Freelist) PopHead() (ptr uint64, exists bool) {
+	for {
+		ptr, head := flPop(fl)
+		if head != 0 {
+			// the emptied head node is recycled
+			fl.PushTail(head)
+		}
+		// past the empty end of a node, try the next one
+		if ptr != 0 || head == 0 {
+			return ptr, ptr != 0
+		}
+	}
 }
 
-/* free list needs to be able to do the following ->
-1. maintain enteries of free list info
-2. perform seeks
-3. perform updates refresh
-*/
+// remove one item from the head. also returns the head node when it got
+// emptied in the process, so the caller can release it. The item is 0 when
+// the head was at the empty end of a node, which is skipped.
+func flPop(fl *Freelist) (ptr uint64, head uint64) {
+	if fl.headSeq == fl.maxSeq {
+		return 0, 0
+	}
+
+	node := LNode(fl.get(fl.headPage))
+	ptr, ver := node.getItem(fl.seq2idx(fl.headSeq))
+	if ptr == 0 {
+		fl.headSeq += uint64(fl.cap - fl.seq2idx(fl.headSeq))
+	} else if ver > fl.maxVer {
+		return 0, 0 // a reader may still need it, as may every later item
+	} else {
+		fl.headSeq++
+	}
+
+	// move on to the next node once this one is consumed
+	if fl.seq2idx(fl.headSeq) == 0 {
+		head, fl.headPage = fl.headPage, node.getNext()
+		if fl.headPage == 0 {
+			panic(&PageError{Ptr: head, Err: ErrFreelistEnd})
+		}
+	}
+	return ptr, head
+}
@@ -0,0 +1,146 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// in-memory pages backing a standalone Freelist
+type flPages struct {
+	pages map[uint64]btreeplus.BNode
+	next  uint64
+}
+
+func newTestFreelist() (*Freelist, *flPages) {
+	store := &flPages{pages: map[uint64]btreeplus.BNode{}, next: 1}
+	fl := NewFreelist(
+		func(ptr uint64) btreeplus.BNode { return store.pages[ptr] },
+		func(node btreeplus.BNode) uint64 {
+			ptr := store.next
+			store.next++
+			store.pages[ptr] = node
+			return ptr
+		},
+		func(ptr uint64) btreeplus.BNode { return store.pages[ptr] },
+		btreeplus.BTREE_PAGE_SIZE,
+	)
+	return &fl, store
+}
+
+func TestFreelistFIFO(t *testing.T) {
+	fl, _ := newTestFreelist()
+
+	_, ok := fl.PopHead()
+	assert.False(t, ok)
+
+	// span a few nodes
+	total := 3*fl.cap + 10
+	for i := 0; i < total; i++ {
+		fl.PushTail(uint64(10000 + i))
+	}
+
+	// nothing is handed out until the pushes are committed
+	_, ok = fl.PopHead()
+	assert.False(t, ok)
+	fl.SetMaxSeq()
+
+	seen := map[uint64]bool{}
+	for {
+		ptr, ok := fl.PopHead()
+		if !ok {
+			break
+		}
+		assert.False(t, seen[ptr], "page %d popped twice", ptr)
+		seen[ptr] = true
+	}
+
+	for i := 0; i < total; i++ {
+		assert.True(t, seen[uint64(10000+i)])
+	}
+}
+
+func TestFreelistReusesPages(t *testing.T) {
+	db := openTestKV(t)
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 200; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d-%d", round, i))))
+		}
+	}
+	used := db.page.flushedCount
+
+	// overwriting the same keys should now be served from the freelist
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 200; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("w%d-%d", round, i))))
+		}
+	}
+	assert.LessOrEqual(t, db.page.flushedCount, used+5)
+
+	for i := 0; i < 200; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("k%03d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("w4-%d", i), string(val))
+	}
+}
+
+func TestFreelistSurvivesReopen(t *testing.T) {
+	db := ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"))
+	assert.Nil(t, db.Open())
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	}
+	head, tail := db.freelist.headSeq, db.freelist.tailSeq
+	assert.Nil(t, db.Close())
+
+	db = ProvisionKV(db.Path)
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	assert.Equal(t, head, db.freelist.headSeq)
+	assert.Equal(t, tail, db.freelist.tailSeq)
+
+	for i := 0; i < 300; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("k%03d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "v", string(val))
+	}
+	used := db.page.flushedCount
+	for i := 0; i < 300; i++ {
+		_, err := db.Del([]byte(fmt.Sprintf("k%03d", i)))
+		assert.Nil(t, err)
+	}
+	assert.LessOrEqual(t, db.page.flushedCount, used+2)
+}
+
+func TestFreelistNodesNotRewritten(t *testing.T) {
+	db := ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"))
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	}
+
+	// a torn write can only hit pages the durable meta page doesn't read
+	for i := 0; i < 500; i++ {
+		_, owners := survey(db, db.page.flushedCount, nil)
+		reserved := LNode(db.pageRead(db.freelist.tailPage)).getNext()
+		durable := map[uint64][]byte{}
+		for ptr, owner := range owners {
+			if (owner == OWNER_TREE || owner == OWNER_FREELIST) && uint64(ptr) != reserved {
+				durable[uint64(ptr)] = bytes.Clone(db.pageReadFile(uint64(ptr)))
+			}
+		}
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i%300)), []byte(fmt.Sprintf("v%d", i))))
+		for ptr, data := range durable {
+			if !bytes.Equal(data, db.pageReadFile(ptr)) {
+				t.Fatalf("update %d rewrote page %d, %s", i, ptr, ownerNames[owners[ptr]])
+			}
+		}
+	}
+	assert.True(t, db.Verify().OK())
+}
@@ -3,19 +3,29 @@ package kvstore
 import (
 	"beaver/btreeplus"
 	"beaver/helpers"
-	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 	"os"
+	"sync"
 
 	"golang.org/x/sys/unix"
 )
 
+// KV allows a single writer (Tx) and any number of concurrent readers
+// (ReadTx). Readers pin the root of the last committed tree; thanks to
+// copy-on-write, none of its pages change until it is freed, and freed
+// pages aren't reused while an older reader may still reach them.
 type KV struct {
 	Path     string
+	opts     Options
+	pageSize uint64
+	flags    uint32 // META_FLAG_* of the file
 	filePtr  *os.File
 	fd       int
-	tree     btreeplus.BTree
+	tree     btreeplus.BTree // working tree of the writer
 	freelist Freelist
+	nodes    *btreeplus.NodeCache // expanded pages, shared by every tree
 	mmap     struct {
 		totalMmapSizeBytes uint64
 		totalFileSizeBytes uint64
@@ -27,10 +37,45 @@ type KV struct {
 		toDelete     []uint64
 		nappend      uint64
 		updates      map[uint64]btreeplus.BNode
+		reused       []uint64 // keys of updates taken from the freelist
+		sealed       []byte   // copy of the page being written
 	}
 	lastUpdateFailed bool
+	txid             uint64 // number of the last committed update
+	metaSlot         uint64 // slot holding durableMeta
+	durableMeta      []byte // last meta record known to be on disk
+	unsynced         []byte // meta record waiting for the next periodic sync
+	wal              *wal   // nil outside WAL mode
+	syncer           *syncer
+
+	writer sync.Mutex // held by the open write transaction
+	queue  commitQueue
+	// guards what readers share with the writer: the mmap chunks and the
+	// two fields below
+	mu       sync.RWMutex
+	snapshot struct { // last committed tree, handed to new readers
+		root    uint64
+		version uint64
+	}
+	readers map[uint64]int // open read transactions per version
+	// Compact holds new readers back, and waits for the open ones to end
+	compacting bool
+	idle       sync.Cond // on mu, signalled when readers or compacting drop
 }
 
+// the errors of the tree, for the users of the KV
+var (
+	ErrEmptyKey    = btreeplus.ErrEmptyKey
+	ErrKeyTooLarge = btreeplus.ErrKeyTooLarge
+	ErrValTooLarge = btreeplus.ErrValTooLarge
+	ErrNotFound    = btreeplus.ErrNotFound
+	ErrUnsorted    = btreeplus.ErrUnsorted
+	ErrNotEmpty    = btreeplus.ErrNotEmpty
+	ErrCorrupt     = btreeplus.ErrCorrupt
+)
+
+var ErrClosed = errors.New("database is closed")
+
 // OS HELPER CODE
 
 func extendFile(db *KV, size uint64) error {
@@ -68,8 +113,10 @@ func extendMmap(db *KV, size uint64) error {
 		return fmt.Errorf("mmap :%w", err)
 	}
 
+	db.mu.Lock()
 	db.mmap.totalMmapSizeBytes += incrementSize
 	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	db.mu.Unlock()
 
 	return nil
 }
@@ -93,11 +140,25 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 	return int(fileStat.Size()), chunk, nil
 }
 
-func ProvisionKV(path string) *KV {
-	return &KV{Path: path}
+func ProvisionKV(path string, opts ...Options) *KV {
+	db := &KV{Path: path}
+	if len(opts) > 0 {
+		db.opts = opts[0]
+	}
+	return db
 }
 
 func (db *KV) Open() error {
+	if !btreeplus.ValidPageSize(db.opts.pageSize()) {
+		return fmt.Errorf("KV.Open: %w: %d", ErrPageSize, db.opts.PageSize)
+	}
+	if db.opts.PrefixCompression && db.opts.pageSize() > btreeplus.PREFIX_MAX_PAGE_SIZE {
+		return fmt.Errorf("KV.Open: %w: %d with prefix compression", ErrPageSize, db.opts.PageSize)
+	}
+	if name := db.opts.comparator().Name; name == "" || len(name) > META_CMP_SIZE {
+		return fmt.Errorf("KV.Open: %w: bad comparator name %q", ErrComparator, name)
+	}
+
 	// open file and stats
 	filePtr, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
@@ -109,6 +170,7 @@ func (db *KV) Open() error {
 	// peform mmapping
 	fileSize, chunk, err := mmapInit(db.filePtr)
 	if err != nil {
+		db.filePtr.Close()
 		return fmt.Errorf("KV.Open: %w", err)
 	}
 
@@ -122,20 +184,83 @@ func (db *KV) Open() error {
 		chunks:             [][]byte{chunk},
 	}
 
-	// db.freelist = NewFreelist(db.pageRead, db.pageAppend, db.pageWrite)
-	// db.tree = btreeplus.NewBTree(db.pageRead, db.pageAlloc, db.pageDelete)
-	db.tree = btreeplus.NewBTree(db.pageRead, db.pageAppend, db.pageDelete)
+	db.page.updates = make(map[uint64]btreeplus.BNode)
+
+	if err := readRoot(db, uint64(fileSize)); err != nil {
+		db.Close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+
+	if err := openWAL(db); err != nil {
+		db.Close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
 
-	readRoot(db, uint64(fileSize))
+	db.readers = make(map[uint64]int)
+	db.idle.L = &db.mu
+	publish(db)
 
+	if db.opts.Durability == SyncPeriodic {
+		startSyncer(db)
+	}
+
+	return nil
+}
+
+// initTree sets up the tree and the freelist once the page size is known.
+func initTree(db *KV) error {
+	db.nodes = btreeplus.NewNodeCache(btreeplus.PREFIX_CACHE_NODES)
+	tree, err := btreeplus.NewBTree(db.pageRead, db.pageAlloc, db.pageDelete, treeOptions(db)...)
+	if err != nil {
+		return err
+	}
+	db.freelist = NewFreelist(db.pageRead, db.pageAppend, db.pageWrite, int(db.pageSize))
+	db.tree = tree
 	return nil
 }
 
+// the layout of the pages of the file
+func treeOptions(db *KV) []btreeplus.Option {
+	opts := []btreeplus.Option{
+		btreeplus.WithPageSize(int(db.pageSize)),
+		btreeplus.WithComparator(db.opts.comparator()),
+	}
+	if db.flags&META_FLAG_PREFIX != 0 {
+		opts = append(opts, btreeplus.WithPrefixCompression(), btreeplus.WithNodeCache(db.nodes))
+	}
+	return opts
+}
+
+// Close releases the file, checkpointing first in WAL mode. Every
+// transaction must have ended before. Closing again fails with ErrClosed.
 func (db *KV) Close() error {
+	if db.filePtr == nil {
+		return ErrClosed
+	}
+	stopSyncer(db)
+
+	var err error
+	if db.wal != nil {
+		err = checkpoint(db)
+		db.wal.fp.Close()
+		db.wal = nil
+	} else {
+		err = syncNow(db)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	for _, mmapChunk := range db.mmap.chunks {
-		helpers.Assert(unix.Munmap(mmapChunk) == nil)
+		if unmapErr := unix.Munmap(mmapChunk); err == nil && unmapErr != nil {
+			err = fmt.Errorf("munmap: %w", unmapErr)
+		}
 	}
-	return db.filePtr.Close()
+	db.mmap.chunks = nil
+	if closeErr := db.filePtr.Close(); err == nil {
+		err = closeErr
+	}
+	db.filePtr = nil
+	return err
 }
 
 func (db *KV) pageRead(ptr uint64) btreeplus.BNode {
@@ -143,32 +268,67 @@ func (db *KV) pageRead(ptr uint64) btreeplus.BNode {
 		return node
 	}
 
+	if ptr >= db.page.flushedCount {
+		if ptr-db.page.flushedCount >= uint64(len(db.page.temp)) {
+			panic(&PageError{Ptr: ptr, Err: ErrPageRange})
+		}
+		return db.page.temp[ptr-db.page.flushedCount]
+	}
+
 	return db.pageReadFile(ptr)
 }
 
+// pageReadShared serves readers. They only reach committed pages, but in WAL
+// mode those may not have been checkpointed to the file yet.
+func (db *KV) pageReadShared(ptr uint64) btreeplus.BNode {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.pageRead(ptr)
+}
+
+// pageReadFile returns a page of the file after checking its checksum. It
+// has no way to return an error to the tree, a damaged page panics with a
+// *PageError, which the tree hands back to its caller (see catchCorrupt).
 func (db *KV) pageReadFile(ptr uint64) btreeplus.BNode {
+	page := db.pageMapped(ptr)
+	if err := verifyPage(ptr, page); err != nil {
+		panic(err)
+	}
+	return page
+}
+
+// pageMapped is the page as it is in the file, checked or not.
+func (db *KV) pageMapped(ptr uint64) btreeplus.BNode {
 	start := uint64(0)
 
 	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/btreeplus.BTREE_PAGE_SIZE
+		end := start + uint64(len(chunk))/db.pageSize
 		if ptr < end {
-			offset := btreeplus.BTREE_PAGE_SIZE * (ptr - start)
-			return chunk[offset : offset+btreeplus.BTREE_PAGE_SIZE]
+			offset := db.pageSize * (ptr - start)
+			return chunk[offset : offset+db.pageSize]
 		}
 		start = end
 	}
-	panic("bad ptr")
+	panic(&PageError{Ptr: ptr, Err: ErrPageRange})
 }
 
+// the writer changes the pending page state under db.mu, readers may be
+// looking at it
+
 func (db *KV) pageAppend(bnode btreeplus.BNode) uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	ptr := db.page.flushedCount + uint64(len(db.page.temp))
 	db.page.temp = append(db.page.temp, bnode)
 	return ptr
 }
 
 func (db *KV) pageAlloc(bnode btreeplus.BNode) uint64 {
-	if ptr, isOk := db.freelist.PopHead(); isOk == true { // try the free list
+	if ptr, isOk := db.freelist.PopHead(); isOk { // try the free list
+		db.mu.Lock()
+		defer db.mu.Unlock()
 		db.page.updates[ptr] = bnode
+		db.page.reused = append(db.page.reused, ptr)
 		return ptr
 	}
 
@@ -180,8 +340,15 @@ func (db *KV) pageWrite(ptr uint64) btreeplus.BNode {
 		return node
 	}
 
-	node := btreeplus.NewBnode()
+	// not flushed yet, the appended page can be modified directly
+	if ptr >= db.page.flushedCount {
+		return db.page.temp[ptr-db.page.flushedCount]
+	}
+
+	node := make(btreeplus.BNode, db.pageSize)
 	copy(node, db.pageReadFile(ptr))
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	db.page.updates[ptr] = node
 	return node
 }
@@ -190,59 +357,206 @@ func (db *KV) pageDelete(ptr uint64) {
 	db.page.toDelete = append(db.page.toDelete, ptr)
 }
 
-func updateOrRevert(db *KV, meta []byte) error {
+// commitPages writes out the pending pages and points the meta page at
+// them. After a failure the meta page on disk is in an unknown state and
+// gets repaired first thing on the next attempt.
+func commitPages(db *KV) error {
+	var err error
 	if db.lastUpdateFailed {
-		updateRoot(db)
-		fsync(db)
-		db.lastUpdateFailed = false
+		// the failed update may have left a valid record in the spare
+		// slot, pointing at pages that are about to be overwritten.
+		// replace it with the last durable one.
+		err = helpers.ErrMap(db, []func(*KV) error{
+			func(db *KV) error { return writeMetaSlot(db, db.durableMeta, db.metaSlot^1) },
+			fsync,
+		})
+		if err == nil {
+			db.lastUpdateFailed = false
+		}
 	}
-	// 2-phase update
-	err := performFileUpdate(db)
-	// revert on error
+
+	if err == nil {
+		db.freelist.version = db.txid
+		// 2-phase update
+		err = performFileUpdate(db)
+	}
+
 	if err != nil {
-		// the in-memory states can be reverted immediately to allow reads
-		loadMeta(db, meta)
-		// discard temporaries
-		db.page.temp = db.page.temp[:0]
-		// the on-disk meta page is in an unknown state;
-		// mark it to be rewritten on later recovery.
 		db.lastUpdateFailed = true
+		return err
 	}
-	return err
+	return nil
 }
 
-func (db *KV) Get(key btreeplus.ByteArr) (val btreeplus.ByteArr, exists bool) {
-	k, v := db.tree.Get(key)
-	return v, k != nil
+func updateOrRevert(db *KV, meta []byte) error {
+	db.txid++
+	err := commitPages(db)
+	// revert on error
+	if err != nil {
+		// the in-memory states can be reverted immediately to allow reads.
+		// outside WAL mode nothing stays pending across commits, so
+		// everything pending belongs to this update.
+		rollback(db, meta, pageMarks{})
+		return err
+	}
+	publish(db)
+	return nil
 }
 
-func (db *KV) Set(key, val btreeplus.ByteArr) error {
-	oldMeta := saveMeta(db)
-	if err := db.tree.Insert(key, val); err != nil {
-		return err
+// publish hands the committed tree to readers starting from now on.
+func publish(db *KV) {
+	db.mu.Lock()
+	db.snapshot.root = db.tree.GetRoot()
+	db.snapshot.version = db.txid
+	db.mu.Unlock()
+}
+
+// the oldest version a reader is on, MaxUint64 without readers. caller
+// holds db.mu.
+func oldestReader(db *KV) uint64 {
+	oldest := uint64(math.MaxUint64)
+	for version := range db.readers {
+		oldest = min(oldest, version)
 	}
-	return updateOrRevert(db, oldMeta)
+	return oldest
 }
 
-func (db *KV) Del(key btreeplus.ByteArr) (isDeleted bool, err error) {
-	if isDeleted, err = db.tree.Delete(key); err != nil {
-		return isDeleted, err
+// pageMarks records how far the pending page state reached at some point,
+// so that whatever was added after can be undone.
+type pageMarks struct {
+	temp     int
+	toDelete int
+	reused   int
+}
+
+func markPages(db *KV) pageMarks {
+	return pageMarks{
+		temp:     len(db.page.temp),
+		toDelete: len(db.page.toDelete),
+		reused:   len(db.page.reused),
+	}
+}
+
+// rollback returns to the state of meta, dropping the pages made since marks.
+func rollback(db *KV, meta []byte, marks pageMarks) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// pages pushed to the freelist since the last commit stay unavailable
+	maxSeq := db.freelist.maxSeq
+	loadMeta(db, meta)
+	db.freelist.maxSeq = maxSeq
+	db.page.temp = db.page.temp[:marks.temp]
+	db.page.toDelete = db.page.toDelete[:marks.toDelete]
+	for _, ptr := range db.page.reused[marks.reused:] {
+		delete(db.page.updates, ptr)
+	}
+	db.page.reused = db.page.reused[:marks.reused]
+}
+
+// pending reports whether there are changes waiting to be written out.
+func pending(db *KV) bool {
+	return len(db.page.temp) > 0 || len(db.page.toDelete) > 0 || len(db.page.updates) > 0
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (db *KV) Get(key btreeplus.ByteArr) (btreeplus.ByteArr, error) {
+	rtx := db.BeginRead()
+	defer rtx.End()
+
+	val, err := rtx.Get(key)
+	if err != nil {
+		return nil, err
 	}
+	// the page may be reused once the snapshot is released
+	return append(btreeplus.ByteArr{}, val...), nil
+}
 
-	return isDeleted, performFileUpdate(db)
+// Set and Del are each committed on their own, but concurrent calls may
+// share a commit (see submit). They return once the update is durable.
+func (db *KV) Set(key, val btreeplus.ByteArr) error {
+	req := &commitReq{key: key, val: val}
+	submit(db, req)
+	return req.err
+}
+
+// Del fails with ErrNotFound for a missing key.
+func (db *KV) Del(key btreeplus.ByteArr) (isDeleted bool, err error) {
+	req := &commitReq{key: key, del: true}
+	submit(db, req)
+	return req.isDeleted, req.err
 }
 
 func performFileUpdate(db *KV) error {
-	return helpers.ErrMap(db, []func(*KV) error{
-		writePages,
+	if err := writePages(db); err != nil {
+		return err
+	}
+
+	meta := saveMeta(db)
+	if db.opts.Durability == SyncPeriodic {
+		// the meta page follows with the next background sync
+		db.unsynced = meta
+		return nil
+	}
+	return flushMeta(db, meta)
+}
+
+// flushMeta makes the pages written so far durable, then points the meta
+// page at them.
+func flushMeta(db *KV, meta []byte) error {
+	err := helpers.ErrMap(db, []func(*KV) error{
 		fsync, // forces previous and next step to be ordered (page cache stuff)
-		updateRoot,
+		func(db *KV) error { return writeMetaSlot(db, meta, db.metaSlot^1) },
 		fsync,
 	})
+	if err != nil {
+		return err
+	}
+
+	db.metaSlot ^= 1
+	db.durableMeta = meta
+	db.unsynced = nil
+	// pages freed up to this update are now safe to hand out. in periodic
+	// mode later updates may have pushed more, those have to wait.
+	db.freelist.maxSeq = metaFreelistTail(meta)
+	return nil
 }
 
-func writePages(db *KV) error {
-	size := (db.page.flushedCount + uint64(len(db.page.temp))) * btreeplus.BTREE_PAGE_SIZE
+func writePages(db *KV) (err error) {
+	defer catchCorrupt(&err)
+	// release the pages replaced by this update. this may itself allocate
+	// freelist nodes, so it has to happen before anything is written.
+	for _, ptr := range db.page.toDelete {
+		db.freelist.PushTail(ptr)
+	}
+	db.page.toDelete = db.page.toDelete[:0]
+
+	if err := writeAppended(db); err != nil {
+		return err
+	}
+
+	// pages reused from the freelist are overwritten in place
+	for ptr, pageToFlush := range db.page.updates {
+		db.page.sealed = sealPage(db.page.sealed, pageToFlush)
+		if _, err := unix.Pwrite(db.fd, db.page.sealed, int64(ptr*db.pageSize)); err != nil {
+			return fmt.Errorf("write page: %w", err)
+		}
+	}
+
+	db.freelist.TailWritten()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.page.flushedCount += uint64(len(db.page.temp))
+	db.page.temp = db.page.temp[:0]
+	clear(db.page.updates)
+	db.page.reused = db.page.reused[:0]
+	return nil
+}
+
+// writeAppended writes the pages of page.temp after the flushed ones,
+// growing the file as needed.
+func writeAppended(db *KV) error {
+	size := (db.page.flushedCount + uint64(len(db.page.temp))) * db.pageSize
 	// page extension also needs to be done (via truncate)
 	if err := extendFile(db, size); err != nil {
 		return err
@@ -252,58 +566,27 @@ func writePages(db *KV) error {
 		return err
 	}
 
-	offset := db.page.flushedCount * btreeplus.BTREE_PAGE_SIZE
+	offset := db.page.flushedCount * db.pageSize
 	// todo -> implement flock here
 	// pwrite because pwritev unsupported on macos :(
 	for _, pageToFlush := range db.page.temp {
-		unix.Pwrite(db.fd, pageToFlush, int64(offset))
+		db.page.sealed = sealPage(db.page.sealed, pageToFlush)
+		if _, err := unix.Pwrite(db.fd, db.page.sealed, int64(offset)); err != nil {
+			return fmt.Errorf("write page: %w", err)
+		}
 		offset += uint64(len(pageToFlush))
 	}
-
-	db.page.flushedCount += uint64(len(db.page.temp))
-	db.page.temp = db.page.temp[:0]
 	return nil
 }
 
+// fsync flushes the database file the way the durability mode asks for.
 func fsync(db *KV) error {
-	return unix.Fsync(db.fd)
-}
-
-// META RELATED FNS
-
-const DB_SIG = "BEAVER01"
-
-// | sig | root_ptr | page_used |
-// | 8B  |    8B    |     8B    |
-func saveMeta(db *KV) []byte {
-	var data [24]byte
-	// fmt.Printf("META VALUES -> %v, %v, %v\n", DB_SIG, db.tree.GetRoot(), db.page.flushedCount)
-	copy(data[:8], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[8:], db.tree.GetRoot())
-	binary.LittleEndian.PutUint64(data[16:], db.page.flushedCount)
-	return data[:]
-}
-
-func loadMeta(db *KV, data []byte) {
-	helpers.Assert(DB_SIG == string(data[0:8]))
-	db.tree.SetRoot(binary.LittleEndian.Uint64(data[8:]))
-	db.page.flushedCount = binary.LittleEndian.Uint64(data[16:])
-}
-
-func readRoot(db *KV, fileSize uint64) error {
-	if fileSize == 0 {
-		db.page.flushedCount = 1
+	switch db.opts.Durability {
+	case SyncNone:
 		return nil
+	case SyncData:
+		return fdatasync(db.fd)
+	default:
+		return unix.Fsync(db.fd)
 	}
-
-	data := db.mmap.chunks[0]
-	loadMeta(db, data)
-	return nil
-}
-
-func updateRoot(db *KV) error {
-	if _, err := unix.Pwrite(db.fd, saveMeta(db), 0); err != nil {
-		return fmt.Errorf("write meta page: %w", err)
-	}
-	return nil
 }
@@ -0,0 +1,190 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLargeValues(t *testing.T) {
+	for _, walMode := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "kvstore.data")
+		db := ProvisionKV(path, Options{WAL: walMode})
+		assert.Nil(t, db.Open())
+
+		vals := map[string][]byte{}
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("k%02d", i)
+			vals[key] = bytes.Repeat([]byte{byte('a' + i)}, 5000*(i+1))
+			assert.Nil(t, db.Set([]byte(key), vals[key]))
+		}
+		// overwritten and deleted values release their chains
+		for round := 0; round < 5; round++ {
+			assert.Nil(t, db.Set([]byte("k00"), bytes.Repeat([]byte{'z'}, 40_000)))
+		}
+		_, err := db.Del([]byte("k01"))
+		assert.Nil(t, err)
+		delete(vals, "k01")
+		vals["k00"] = bytes.Repeat([]byte{'z'}, 40_000)
+		assert.Nil(t, db.Close())
+
+		db = ProvisionKV(path)
+		assert.Nil(t, db.Open())
+		used := db.page.flushedCount
+		for key, val := range vals {
+			got, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.True(t, bytes.Equal(val, got), "WAL %v, key %s", walMode, key)
+		}
+		res, err := db.Scan([]byte("k19"), nil, ScanOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, vals["k19"], []byte(res[0].Val))
+
+		// rewriting a value in place recycles its old pages
+		for round := 0; round < 5; round++ {
+			assert.Nil(t, db.Set([]byte("k00"), bytes.Repeat([]byte{'y'}, 40_000)))
+		}
+		assert.Less(t, db.page.flushedCount, used+20)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestPageSizes(t *testing.T) {
+	for _, pageSize := range btreeplus.PAGE_SIZES {
+		path := filepath.Join(t.TempDir(), "kvstore.data")
+		db := ProvisionKV(path, Options{PageSize: pageSize})
+		assert.Nil(t, db.Open())
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), bytes.Repeat([]byte{'v'}, i*20)))
+		}
+		for i := 0; i < 500; i += 3 {
+			_, err := db.Del([]byte(fmt.Sprintf("k%03d", i)))
+			assert.Nil(t, err)
+		}
+		assert.Nil(t, db.Close())
+
+		// the file keeps its page size whatever the options say
+		db = ProvisionKV(path)
+		assert.Nil(t, db.Open())
+		assert.Equal(t, uint64(pageSize), db.pageSize)
+		res, err := db.Scan(nil, nil, ScanOptions{})
+		assert.Nil(t, err)
+		assert.Len(t, res, 333)
+		for _, p := range res {
+			var i int
+			fmt.Sscanf(string(p.Key), "k%03d", &i)
+			assert.Equal(t, i*20, len(p.Val), "page size %d, key %s", pageSize, p.Key)
+		}
+		assert.Nil(t, db.Close())
+	}
+
+	db := ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"), Options{PageSize: 65536})
+	assert.ErrorIs(t, db.Open(), ErrPageSize)
+}
+
+func TestPrefixCompression(t *testing.T) {
+	key := func(i int) []byte { return []byte(fmt.Sprintf("tenant-7/bucket/photos/%05d", i)) }
+	pages := map[bool]uint64{}
+	for _, compress := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "kvstore.data")
+		db := ProvisionKV(path, Options{PrefixCompression: compress})
+		assert.Nil(t, db.Open())
+		tx := db.Begin()
+		for i := 0; i < 3000; i++ {
+			assert.Nil(t, tx.Set(key(i), []byte("v")))
+		}
+		assert.Nil(t, tx.Commit())
+		assert.Nil(t, db.Close())
+
+		// kept by the file, whatever the options say
+		db = ProvisionKV(path)
+		assert.Nil(t, db.Open())
+		assert.Equal(t, compress, db.flags&META_FLAG_PREFIX != 0)
+		for i := 0; i < 3000; i += 2 {
+			_, err := db.Del(key(i))
+			assert.Nil(t, err)
+		}
+		res, err := db.ScanPrefix([]byte("tenant-7/"), ScanOptions{})
+		assert.Nil(t, err)
+		assert.Len(t, res, 1500)
+		assert.Equal(t, key(1), []byte(res[0].Key))
+		pages[compress] = db.page.flushedCount
+		assert.Nil(t, db.Close())
+	}
+	assert.Less(t, pages[true], pages[false])
+
+	db := ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"), Options{PageSize: 32768, PrefixCompression: true})
+	assert.ErrorIs(t, db.Open(), ErrPageSize)
+}
+
+func TestComparator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := ProvisionKV(path, Options{Comparator: btreeplus.ReverseBytesComparator})
+	assert.Nil(t, db.Open())
+	for _, k := range []string{"b", "d", "a/1", "c", "a/2", "e"} {
+		assert.Nil(t, db.Set([]byte(k), []byte("v")))
+	}
+	assert.Nil(t, db.Close())
+
+	db = ProvisionKV(path, Options{Comparator: btreeplus.ReverseBytesComparator})
+	assert.Nil(t, db.Open())
+	res, err := db.Scan(nil, nil, ScanOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e", "d", "c", "b", "a/2", "a/1"}, scannedKeys(res))
+	res, err = db.Scan([]byte("d"), []byte("b"), ScanOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"d", "c"}, scannedKeys(res))
+	res, err = db.ScanPrefix([]byte("a/"), ScanOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a/2", "a/1"}, scannedKeys(res))
+	assert.Nil(t, db.Close())
+
+	// the file remembers its order, a different one is refused
+	db = ProvisionKV(path, Options{Comparator: btreeplus.CaseInsensitiveComparator})
+	assert.ErrorIs(t, db.Open(), ErrComparator)
+	db = ProvisionKV(path)
+	assert.ErrorIs(t, db.Open(), ErrComparator)
+}
+
+func TestStat(t *testing.T) {
+	db := ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"), Options{PageSize: 8192})
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), bytes.Repeat([]byte("v"), 100)))
+	}
+
+	stats := db.Stat()
+	assert.Equal(t, db.Path, stats.Path)
+	assert.Equal(t, 8192, stats.PageSize)
+	assert.Equal(t, "bytes", stats.Comparator)
+	assert.Equal(t, uint64(500), stats.Txid)
+	assert.Greater(t, stats.Pages, uint64(1))
+	assert.Greater(t, stats.FreePages, uint64(0), "copy-on-write frees the old pages")
+	assert.Less(t, stats.FreePages, stats.Pages)
+	assert.GreaterOrEqual(t, stats.FileSize, stats.Pages*8192)
+	assert.False(t, stats.WAL)
+}
+
+func TestKeyErrors(t *testing.T) {
+	db := ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"))
+	assert.Nil(t, db.Open())
+
+	assert.ErrorIs(t, db.Set(nil, []byte("v")), ErrEmptyKey)
+	assert.ErrorIs(t, db.Set(bytes.Repeat([]byte("k"), btreeplus.BTREE_MAX_KEY_SIZE+1), nil), ErrKeyTooLarge)
+	_, err := db.Get([]byte{})
+	assert.ErrorIs(t, err, ErrEmptyKey)
+	_, err = db.Get([]byte("k"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	deleted, err := db.Del([]byte("k"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.False(t, deleted)
+	assert.Equal(t, uint64(0), db.txid, "nothing to commit")
+
+	assert.Nil(t, db.Close())
+	assert.ErrorIs(t, db.Close(), ErrClosed)
+}
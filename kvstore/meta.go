@@ -0,0 +1,250 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"golang.org/x/sys/unix"
+)
+
+// META RELATED FNS
+
+const DB_SIG = "BEAVERDB"
+
+// files written before the meta page was versioned
+const LEGACY_DB_SIG = "BEAVER01"
+
+// 3 added page checksums
+const META_VERSION = 3
+
+/*
+| sig | version | page_size | txid | root_ptr | page_used | fl_head_page | fl_head_seq | fl_tail_page | fl_tail_seq | flags | comparator | reserved | crc |
+| 8B  |   4B    |    4B     |  8B  |    8B    |     8B    |      8B      |      8B     |      8B      |      8B     |  4B   |    32B     |   16B    | 4B  |
+
+the crc covers every byte before it. reserved bytes are zero. flags are
+META_FLAG_* bits describing the page format, and comparator the
+zero-padded name of the key order (empty for files predating it, which are
+in byte order). both are fixed at creation.
+
+page 0 holds two such records, one per META_SLOT_SIZE sector. meta writes
+alternate between them, so the record of the previous update is never
+touched while the new one is being written; Open picks the valid slot with
+the highest txid.
+*/
+const (
+	META_SIZE         = 128
+	META_SLOT_SIZE    = 512
+	META_SLOTS        = 2
+	META_VERSION_POS  = 8
+	META_PAGE_POS     = 12
+	META_TXID_POS     = 16
+	META_ROOT_POS     = 24
+	META_USED_POS     = 32
+	META_FL_HEAD_POS  = 40
+	META_FL_HSEQ_POS  = 48
+	META_FL_TAIL_POS  = 56
+	META_FL_TSEQ_POS  = 64
+	META_FLAGS_POS    = 72
+	META_CMP_POS      = 76
+	META_CMP_SIZE     = 32
+	META_CHECKSUM_POS = META_SIZE - 4
+)
+
+const (
+	META_FLAG_PREFIX = 1 << iota // pages are prefix compressed
+	META_FLAGS_KNOWN = META_FLAG_PREFIX
+)
+
+var (
+	ErrNotBeaverFile = errors.New("not a beaver database")
+	ErrMetaVersion   = errors.New("unsupported meta page version")
+	ErrMetaChecksum  = errors.New("meta page checksum mismatch")
+	ErrMetaCorrupt   = errors.New("meta page is inconsistent")
+)
+
+// MetaError is returned by Open when the meta page can't be trusted. Err is
+// one of the ErrMeta* / ErrNotBeaverFile values, possibly wrapped with detail.
+type MetaError struct {
+	Path string
+	Err  error
+}
+
+func (e *MetaError) Error() string {
+	return fmt.Sprintf("%s: bad meta page: %v", e.Path, e.Err)
+}
+
+func (e *MetaError) Unwrap() error {
+	return e.Err
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func saveMeta(db *KV) []byte {
+	var data [META_SIZE]byte
+	copy(data[:8], []byte(DB_SIG))
+	binary.LittleEndian.PutUint32(data[META_VERSION_POS:], META_VERSION)
+	binary.LittleEndian.PutUint32(data[META_PAGE_POS:], uint32(db.pageSize))
+	binary.LittleEndian.PutUint64(data[META_TXID_POS:], db.txid)
+	binary.LittleEndian.PutUint64(data[META_ROOT_POS:], db.tree.GetRoot())
+	binary.LittleEndian.PutUint64(data[META_USED_POS:], db.page.flushedCount)
+	binary.LittleEndian.PutUint64(data[META_FL_HEAD_POS:], db.freelist.headPage)
+	binary.LittleEndian.PutUint64(data[META_FL_HSEQ_POS:], db.freelist.headSeq)
+	binary.LittleEndian.PutUint64(data[META_FL_TAIL_POS:], db.freelist.tailPage)
+	binary.LittleEndian.PutUint64(data[META_FL_TSEQ_POS:], db.freelist.tailSeq)
+	binary.LittleEndian.PutUint32(data[META_FLAGS_POS:], db.flags)
+	copy(data[META_CMP_POS:META_CMP_POS+META_CMP_SIZE], db.tree.Comparator().Name)
+	binary.LittleEndian.PutUint32(data[META_CHECKSUM_POS:], crc32.Checksum(data[:META_CHECKSUM_POS], crcTable))
+	return data[:]
+}
+
+// verifyMeta checks a meta record read from a file of fileSize bytes.
+func verifyMeta(data []byte, fileSize uint64) error {
+	switch string(data[0:8]) {
+	case DB_SIG:
+	case LEGACY_DB_SIG:
+		return fmt.Errorf("%w: legacy format %q", ErrMetaVersion, LEGACY_DB_SIG)
+	default:
+		return ErrNotBeaverFile
+	}
+
+	if crc32.Checksum(data[:META_CHECKSUM_POS], crcTable) != binary.LittleEndian.Uint32(data[META_CHECKSUM_POS:]) {
+		return ErrMetaChecksum
+	}
+
+	if version := binary.LittleEndian.Uint32(data[META_VERSION_POS:]); version != META_VERSION {
+		return fmt.Errorf("%w: %d", ErrMetaVersion, version)
+	}
+
+	pageSize := binary.LittleEndian.Uint32(data[META_PAGE_POS:])
+	if !btreeplus.ValidPageSize(int(pageSize)) {
+		return fmt.Errorf("%w: unsupported page size %d", ErrMetaCorrupt, pageSize)
+	}
+
+	flags := binary.LittleEndian.Uint32(data[META_FLAGS_POS:])
+	if flags&^META_FLAGS_KNOWN != 0 {
+		return fmt.Errorf("%w: unknown flags %#x", ErrMetaVersion, flags)
+	}
+	if flags&META_FLAG_PREFIX != 0 && pageSize > btreeplus.PREFIX_MAX_PAGE_SIZE {
+		return fmt.Errorf("%w: prefix compression with %d byte pages", ErrMetaCorrupt, pageSize)
+	}
+
+	used := binary.LittleEndian.Uint64(data[META_USED_POS:])
+	if used*uint64(pageSize) > fileSize {
+		return fmt.Errorf("%w: %d pages used but the file holds %d bytes", ErrMetaCorrupt, used, fileSize)
+	}
+
+	for _, pos := range []int{META_ROOT_POS, META_FL_HEAD_POS, META_FL_TAIL_POS} {
+		if ptr := binary.LittleEndian.Uint64(data[pos:]); ptr >= used {
+			return fmt.Errorf("%w: page pointer %d beyond %d used pages", ErrMetaCorrupt, ptr, used)
+		}
+	}
+	return nil
+}
+
+// loadMeta restores a record produced by saveMeta (or checked by verifyMeta).
+func loadMeta(db *KV, data []byte) {
+	db.txid = binary.LittleEndian.Uint64(data[META_TXID_POS:])
+	db.tree.SetRoot(binary.LittleEndian.Uint64(data[META_ROOT_POS:]))
+	db.page.flushedCount = binary.LittleEndian.Uint64(data[META_USED_POS:])
+	db.freelist.headPage = binary.LittleEndian.Uint64(data[META_FL_HEAD_POS:])
+	db.freelist.headSeq = binary.LittleEndian.Uint64(data[META_FL_HSEQ_POS:])
+	db.freelist.tailPage = binary.LittleEndian.Uint64(data[META_FL_TAIL_POS:])
+	db.freelist.tailSeq = binary.LittleEndian.Uint64(data[META_FL_TSEQ_POS:])
+	db.freelist.SetMaxSeq()
+	db.freelist.TailWritten()
+}
+
+func metaTxid(data []byte) uint64 {
+	return binary.LittleEndian.Uint64(data[META_TXID_POS:])
+}
+
+func metaComparator(data []byte) string {
+	name := bytes.TrimRight(data[META_CMP_POS:META_CMP_POS+META_CMP_SIZE], "\x00")
+	if len(name) == 0 {
+		return btreeplus.BytesComparator.Name
+	}
+	return string(name)
+}
+
+func metaFreelistTail(data []byte) uint64 {
+	return binary.LittleEndian.Uint64(data[META_FL_TSEQ_POS:])
+}
+
+func readRoot(db *KV, fileSize uint64) error {
+	// too short to hold the slots, whatever it holds
+	if fileSize != 0 && fileSize < META_SLOTS*META_SLOT_SIZE {
+		return &MetaError{Path: db.Path, Err: fmt.Errorf("%w: %d bytes", ErrNotBeaverFile, fileSize)}
+	}
+	if fileSize == 0 || metaUnwritten(db.mmap.chunks[0]) {
+		db.pageSize = uint64(db.opts.pageSize())
+		if db.opts.PrefixCompression {
+			db.flags |= META_FLAG_PREFIX
+		}
+		if err := initTree(db); err != nil {
+			return err
+		}
+		db.page.flushedCount = 1
+		// nothing valid yet, the first update goes to slot 1
+		db.metaSlot = 0
+		db.durableMeta = make([]byte, META_SIZE)
+		return nil
+	}
+
+	var newest []byte
+	var newestSlot uint64
+	var slotErr error
+	for slot := 0; slot < META_SLOTS; slot++ {
+		data := db.mmap.chunks[0][slot*META_SLOT_SIZE:][:META_SIZE]
+		if err := verifyMeta(data, fileSize); err != nil {
+			// a slot that was never written reads as a foreign file,
+			// which says less than any other failure
+			if slotErr == nil || errors.Is(slotErr, ErrNotBeaverFile) {
+				slotErr = err
+			}
+			continue
+		}
+		if newest == nil || metaTxid(data) > metaTxid(newest) {
+			newest, newestSlot = data, uint64(slot)
+		}
+	}
+
+	if newest == nil {
+		return &MetaError{Path: db.Path, Err: slotErr}
+	}
+	// the file keeps the page size it was created with
+	db.pageSize = uint64(binary.LittleEndian.Uint32(newest[META_PAGE_POS:]))
+	db.flags = binary.LittleEndian.Uint32(newest[META_FLAGS_POS:])
+	if name, want := metaComparator(newest), db.opts.comparator().Name; name != want {
+		return fmt.Errorf("%w: %s is ordered by %q, not %q", ErrComparator, db.Path, name, want)
+	}
+	if err := initTree(db); err != nil {
+		return &MetaError{Path: db.Path, Err: err}
+	}
+	loadMeta(db, newest)
+	db.metaSlot = newestSlot
+	db.durableMeta = append([]byte{}, newest...)
+	return nil
+}
+
+// metaUnwritten tells whether no meta record was ever written: a crash
+// during the first update leaves the slots zeroed, with the pages it got to
+// write after them. Nothing was committed, so the file is still empty.
+func metaUnwritten(chunk []byte) bool {
+	for _, b := range chunk[:META_SLOTS*META_SLOT_SIZE] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func writeMetaSlot(db *KV, data []byte, slot uint64) error {
+	if _, err := unix.Pwrite(db.fd, data, int64(slot*META_SLOT_SIZE)); err != nil {
+		return fmt.Errorf("write meta page: %w", err)
+	}
+	return nil
+}
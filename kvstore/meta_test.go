@@ -0,0 +1,133 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetaRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, db.Set([]byte("k2"), []byte("v2")))
+	assert.Equal(t, uint64(2), db.txid)
+	assert.Nil(t, db.Close())
+
+	db = ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	assert.Equal(t, uint64(2), db.txid)
+	val, err := db.Get([]byte("k2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", string(val))
+}
+
+func TestMetaRejectsBadFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	valid := filepath.Join(dir, "valid")
+	db := ProvisionKV(valid)
+	assert.Nil(t, db.Open())
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, db.Close())
+	content, err := os.ReadFile(valid)
+	assert.Nil(t, err)
+
+	// a single update lands in the second slot
+	corrupt := append([]byte{}, content...)
+	corrupt[META_SLOT_SIZE+META_ROOT_POS] ^= 0xff
+
+	legacy := make([]byte, len(content))
+	copy(legacy, LEGACY_DB_SIG)
+
+	cases := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"foreign":  {[]byte("just some text that is not a database"), ErrNotBeaverFile},
+		"corrupt":  {corrupt, ErrMetaChecksum},
+		"legacy":   {legacy, ErrMetaVersion},
+		"truncate": {content[:4096], ErrMetaCorrupt},
+	}
+
+	for name, c := range cases {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(path, c.data, 0644))
+
+		err := ProvisionKV(path).Open()
+		var metaErr *MetaError
+		assert.True(t, errors.As(err, &metaErr), name)
+		assert.ErrorIs(t, err, c.err, name)
+	}
+}
+
+func TestMetaTornWriteFallsBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v2")))
+	assert.Nil(t, db.Close())
+
+	// simulate a crash halfway through writing the record of txid 2
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = fp.WriteAt(make([]byte, META_SIZE/2), (2%META_SLOTS)*META_SLOT_SIZE+META_SIZE/2)
+	assert.Nil(t, err)
+	assert.Nil(t, fp.Close())
+
+	db = ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	assert.Equal(t, uint64(1), db.txid)
+	val, err := db.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(val))
+
+	// the next update reuses the damaged slot
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v3")))
+	assert.Nil(t, db.Close())
+
+	db = ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	assert.Equal(t, uint64(2), db.txid)
+	val, _ = db.Get([]byte("k1"))
+	assert.Equal(t, "v3", string(val))
+}
+
+func TestMetaNeverWritten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, db.Close())
+
+	// simulate a crash during the first update, before its meta record:
+	// its pages are in the file, the slots are still zero
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = fp.WriteAt(make([]byte, 4096), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, fp.Close())
+
+	db = ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	assert.Equal(t, uint64(0), db.txid)
+	_, err = db.Get([]byte("k1"))
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.Nil(t, db.Set([]byte("k2"), []byte("v2")))
+	assert.Nil(t, db.Close())
+
+	db = ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	val, err := db.Get([]byte("k2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", string(val))
+}
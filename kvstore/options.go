@@ -0,0 +1,108 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"errors"
+	"time"
+)
+
+// Durability sets when commits are flushed to stable storage.
+type Durability int
+
+const (
+	// SyncFull fsyncs on every commit. A commit that returned survives a
+	// crash.
+	SyncFull Durability = iota
+	// SyncData is SyncFull using fdatasync, which skips file metadata not
+	// needed to read the data back. Same as SyncFull where unavailable.
+	SyncData
+	// SyncPeriodic fsyncs in the background every SyncInterval. A crash
+	// loses the commits since the last sync, but leaves the database
+	// consistent.
+	SyncPeriodic
+	// SyncNone never fsyncs. A crash of the machine may leave the database
+	// unreadable; meant for bulk loads, tests and rebuildable caches.
+	SyncNone
+)
+
+const DEFAULT_SYNC_INTERVAL = time.Second
+
+// Options tunes how a KV commits. The zero value commits every update by
+// writing out its pages with full fsyncs, like a KV provisioned without
+// options.
+type Options struct {
+	// PageSize is the page size of a new database file, one of
+	// btreeplus.PAGE_SIZES. 0 means btreeplus.BTREE_PAGE_SIZE. An existing
+	// file keeps the page size it was created with.
+	PageSize int
+	// PrefixCompression stores the shared prefix of the keys of a page
+	// once, fitting more keys per page. Like PageSize, it is chosen when
+	// the file is created; it needs pages of 16K at most.
+	PrefixCompression bool
+	// Comparator orders the keys, btreeplus.BytesComparator if unset. Its
+	// name is recorded in a new file, which can't be opened with another
+	// comparator afterwards.
+	Comparator btreeplus.Comparator
+	Durability Durability
+	// SyncInterval is the period of the background sync in SyncPeriodic
+	// mode. 0 means DEFAULT_SYNC_INTERVAL.
+	SyncInterval time.Duration
+
+	// WAL commits updates by appending them to a write-ahead log next to
+	// the database file, instead of writing the modified pages. The pages
+	// are written later, at a checkpoint.
+	WAL bool
+	// WALCheckpointSize is the log size in bytes that triggers a
+	// checkpoint. 0 means DEFAULT_WAL_CHECKPOINT_SIZE.
+	WALCheckpointSize int64
+	// WALCheckpointPages is the number of pages held in memory for the
+	// log that triggers a checkpoint, whatever the size of the log: small
+	// records still leave whole pages pending. 0 means
+	// DEFAULT_WAL_CHECKPOINT_PAGES.
+	WALCheckpointPages int
+}
+
+const (
+	DEFAULT_WAL_CHECKPOINT_SIZE  = 4 << 20
+	DEFAULT_WAL_CHECKPOINT_PAGES = 1024
+)
+
+var (
+	ErrPageSize   = btreeplus.ErrPageSize
+	ErrComparator = errors.New("comparator mismatch")
+)
+
+func (opts Options) comparator() btreeplus.Comparator {
+	if opts.Comparator.Compare == nil {
+		return btreeplus.BytesComparator
+	}
+	return opts.Comparator
+}
+
+func (opts Options) pageSize() int {
+	if opts.PageSize == 0 {
+		return btreeplus.BTREE_PAGE_SIZE
+	}
+	return opts.PageSize
+}
+
+func (opts Options) syncInterval() time.Duration {
+	if opts.SyncInterval <= 0 {
+		return DEFAULT_SYNC_INTERVAL
+	}
+	return opts.SyncInterval
+}
+
+func (opts Options) checkpointSize() int64 {
+	if opts.WALCheckpointSize <= 0 {
+		return DEFAULT_WAL_CHECKPOINT_SIZE
+	}
+	return opts.WALCheckpointSize
+}
+
+func (opts Options) checkpointPages() int {
+	if opts.WALCheckpointPages <= 0 {
+		return DEFAULT_WAL_CHECKPOINT_PAGES
+	}
+	return opts.WALCheckpointPages
+}
@@ -0,0 +1,140 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"bytes"
+)
+
+// ScanOptions tunes the bounds and order of KV.Scan. The zero value scans
+// [start, end) in ascending order without a limit.
+type ScanOptions struct {
+	ExcludeStart bool // skip a key equal to start
+	IncludeEnd   bool // keep a key equal to end
+	Limit        int  // max number of pairs returned, 0 means no limit
+	Reverse      bool // walk from end down to start
+}
+
+type KVPair struct {
+	Key btreeplus.ByteArr
+	Val btreeplus.ByteArr
+}
+
+// Scan returns the pairs with keys between start and end in key order. A nil
+// start or end leaves that side of the range open.
+func (db *KV) Scan(start, end btreeplus.ByteArr, opts ScanOptions) ([]KVPair, error) {
+	rtx := db.BeginRead()
+	defer rtx.End()
+	return rtx.Scan(start, end, opts)
+}
+
+// scanPairs collects the pairs of a Scan over tree.
+func scanPairs(tree *btreeplus.BTree, start, end btreeplus.ByteArr, opts ScanOptions) ([]KVPair, error) {
+	res := make([]KVPair, 0)
+	err := scanTree(tree, start, end, opts, func(k, v btreeplus.ByteArr) bool {
+		res = append(res, copyPair(k, v))
+		return opts.Limit <= 0 || len(res) < opts.Limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// the iterator hands out slices of mmapped pages, which get reused
+func copyPair(k, v btreeplus.ByteArr) KVPair {
+	return KVPair{
+		Key: append(btreeplus.ByteArr{}, k...),
+		Val: append(btreeplus.ByteArr{}, v...),
+	}
+}
+
+// ScanPrefix returns every pair whose key starts with prefix. The bounds
+// come from the prefix itself, so only Limit and Reverse of opts apply.
+func (db *KV) ScanPrefix(prefix btreeplus.ByteArr, opts ScanOptions) ([]KVPair, error) {
+	rtx := db.BeginRead()
+	defer rtx.End()
+
+	opts = ScanOptions{Limit: opts.Limit, Reverse: opts.Reverse}
+	if rtx.tree.Comparator().Name == btreeplus.BytesComparator.Name {
+		return rtx.Scan(prefix, PrefixEnd(prefix), opts)
+	}
+
+	// in any other order the keys sharing a prefix needn't be next to each
+	// other, every key has to be looked at
+	res := make([]KVPair, 0)
+	err := scanTree(&rtx.tree, nil, nil, opts, func(k, v btreeplus.ByteArr) bool {
+		if bytes.HasPrefix(k, prefix) {
+			res = append(res, copyPair(k, v))
+		}
+		return opts.Limit <= 0 || len(res) < opts.Limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// PrefixEnd is the smallest key greater than every key carrying prefix, nil
+// if there is none: the end of the range to scan for the prefix.
+func PrefixEnd(prefix btreeplus.ByteArr) btreeplus.ByteArr {
+	end := append(btreeplus.ByteArr{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// scanTree feeds fn with the pairs in range until it returns false. The
+// error is that of a damaged page.
+func scanTree(tree *btreeplus.BTree, start, end btreeplus.ByteArr, opts ScanOptions,
+	fn func(k, v btreeplus.ByteArr) bool) error {
+
+	afterStart := func(k btreeplus.ByteArr) bool {
+		if start == nil {
+			return true
+		}
+		c := tree.Compare(k, start)
+		return c > 0 || (c == 0 && !opts.ExcludeStart)
+	}
+
+	beforeEnd := func(k btreeplus.ByteArr) bool {
+		if end == nil {
+			return true
+		}
+		c := tree.Compare(k, end)
+		return c < 0 || (c == 0 && opts.IncludeEnd)
+	}
+
+	if opts.Reverse {
+		var iter *btreeplus.BIter
+		if end == nil {
+			iter = tree.SeekLast()
+		} else {
+			iter = tree.SeekLE(end)
+		}
+
+		for ; iter.Valid() && afterStart(iter.Key()); iter.Prev() {
+			if beforeEnd(iter.Key()) && !emit(iter, fn) {
+				break
+			}
+		}
+		return iter.Err()
+	}
+
+	iter := tree.Seek(start)
+	for ; iter.Valid() && beforeEnd(iter.Key()); iter.Next() {
+		if afterStart(iter.Key()) && !emit(iter, fn) {
+			break
+		}
+	}
+	return iter.Err()
+}
+
+// emit feeds fn with the pair at iter, unless its value can't be read
+func emit(iter *btreeplus.BIter, fn func(k, v btreeplus.ByteArr) bool) bool {
+	val := iter.Val()
+	return iter.Err() == nil && fn(iter.Key(), val)
+}
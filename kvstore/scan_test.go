@@ -0,0 +1,90 @@
+package kvstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestKV(t *testing.T) *KV {
+	db := ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"))
+	assert.Nil(t, db.Open())
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func scannedKeys(pairs []KVPair) []string {
+	keys := make([]string, 0, len(pairs))
+	for _, p := range pairs {
+		keys = append(keys, string(p.Key))
+	}
+	return keys
+}
+
+func TestScanBounds(t *testing.T) {
+	db := openTestKV(t)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+
+	res, err := db.Scan([]byte("k2"), []byte("k5"), ScanOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"k2", "k3", "k4"}, scannedKeys(res))
+	assert.Equal(t, "v2", string(res[0].Val))
+
+	res, _ = db.Scan([]byte("k2"), []byte("k5"), ScanOptions{ExcludeStart: true, IncludeEnd: true})
+	assert.Equal(t, []string{"k3", "k4", "k5"}, scannedKeys(res))
+
+	res, _ = db.Scan(nil, []byte("k3"), ScanOptions{})
+	assert.Equal(t, []string{"k0", "k1", "k2"}, scannedKeys(res))
+
+	res, _ = db.Scan([]byte("k7"), nil, ScanOptions{})
+	assert.Equal(t, []string{"k7", "k8", "k9"}, scannedKeys(res))
+
+	res, _ = db.Scan([]byte("k5"), []byte("k2"), ScanOptions{})
+	assert.Empty(t, res)
+}
+
+func TestScanReverseAndLimit(t *testing.T) {
+	db := openTestKV(t)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v")))
+	}
+
+	res, _ := db.Scan([]byte("k2"), []byte("k5"), ScanOptions{Reverse: true})
+	assert.Equal(t, []string{"k4", "k3", "k2"}, scannedKeys(res))
+
+	res, _ = db.Scan([]byte("k2"), []byte("k5"), ScanOptions{Reverse: true, ExcludeStart: true, IncludeEnd: true})
+	assert.Equal(t, []string{"k5", "k4", "k3"}, scannedKeys(res))
+
+	res, _ = db.Scan(nil, nil, ScanOptions{Reverse: true, Limit: 2})
+	assert.Equal(t, []string{"k9", "k8"}, scannedKeys(res))
+
+	res, _ = db.Scan(nil, nil, ScanOptions{Limit: 3})
+	assert.Equal(t, []string{"k0", "k1", "k2"}, scannedKeys(res))
+}
+
+func TestScanPrefix(t *testing.T) {
+	db := openTestKV(t)
+	for _, k := range []string{"user/1/a", "user/1/b", "user/12/a", "user/2/a", "users", "user/1\xff"} {
+		assert.Nil(t, db.Set([]byte(k), []byte("v")))
+	}
+
+	res, err := db.ScanPrefix([]byte("user/1/"), ScanOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user/1/a", "user/1/b"}, scannedKeys(res))
+
+	res, _ = db.ScanPrefix([]byte("user/1"), ScanOptions{Reverse: true, Limit: 2})
+	assert.Equal(t, []string{"user/1\xff", "user/12/a"}, scannedKeys(res))
+
+	res, _ = db.ScanPrefix([]byte("nope"), ScanOptions{})
+	assert.Empty(t, res)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, "ab", string(PrefixEnd([]byte("aa"))))
+	assert.Equal(t, "b", string(PrefixEnd([]byte("a\xff"))))
+	assert.Nil(t, PrefixEnd([]byte("\xff\xff")))
+}
@@ -0,0 +1,32 @@
+package kvstore
+
+// Stats describes an open KV, as of the last commit.
+type Stats struct {
+	Path              string
+	PageSize          int
+	PrefixCompression bool
+	Comparator        string
+	Txid              uint64 // number of the last committed update
+	Pages             uint64 // pages in the file, page 0 included
+	FreePages         uint64 // pages on the freelist, waiting for reuse
+	FileSize          uint64 // bytes allocated to the file
+	WAL               bool
+}
+
+func (db *KV) Stat() Stats {
+	// no update is half done while the writer lock is held
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	return Stats{
+		Path:              db.Path,
+		PageSize:          int(db.pageSize),
+		PrefixCompression: db.flags&META_FLAG_PREFIX != 0,
+		Comparator:        db.tree.Comparator().Name,
+		Txid:              db.txid,
+		Pages:             db.page.flushedCount,
+		FreePages:         db.freelist.Len(),
+		FileSize:          db.mmap.totalFileSizeBytes,
+		WAL:               db.wal != nil,
+	}
+}
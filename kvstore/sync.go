@@ -0,0 +1,70 @@
+package kvstore
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+In SyncPeriodic mode commits write their pages without syncing, and keep
+the meta record that points at them in db.unsynced instead of writing it
+(the WAL isn't synced either). The syncer then makes everything durable at
+once every SyncInterval. Until then the meta page on disk still points at
+the last synced tree, whose pages are not overwritten: pages freed since
+aren't handed out again before the sync (see flushMeta).
+*/
+type syncer struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startSyncer(db *KV) {
+	db.syncer = &syncer{stop: make(chan struct{}), done: make(chan struct{})}
+	go func(s *syncer) {
+		defer close(s.done)
+		ticker := time.NewTicker(db.opts.syncInterval())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+
+			db.writer.Lock()
+			// a failure is retried on the next tick, the data stays
+			// pending meanwhile
+			syncNow(db)
+			db.writer.Unlock()
+		}
+	}(db.syncer)
+}
+
+func stopSyncer(db *KV) {
+	if db.syncer == nil {
+		return
+	}
+	close(db.syncer.stop)
+	<-db.syncer.done
+	db.syncer = nil
+}
+
+// syncNow makes the commits so far durable. Caller holds db.writer.
+func syncNow(db *KV) error {
+	if db.wal != nil && db.wal.unsynced {
+		if err := unix.Fsync(int(db.wal.fp.Fd())); err != nil {
+			return fmt.Errorf("sync WAL: %w", err)
+		}
+		db.wal.unsynced = false
+	}
+	if db.unsynced == nil {
+		return nil
+	}
+	if err := flushMeta(db, db.unsynced); err != nil {
+		db.lastUpdateFailed = true
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build linux
+
+package kvstore
+
+import "golang.org/x/sys/unix"
+
+func fdatasync(fd int) error {
+	return unix.Fdatasync(fd)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package kvstore
+
+import "golang.org/x/sys/unix"
+
+// no fdatasync on darwin and the BSDs, fall back to a full fsync
+func fdatasync(fd int) error {
+	return unix.Fsync(fd)
+}
@@ -0,0 +1,87 @@
+package kvstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDurabilityModes(t *testing.T) {
+	for _, durability := range []Durability{SyncFull, SyncData, SyncPeriodic, SyncNone} {
+		for _, walMode := range []bool{false, true} {
+			path := filepath.Join(t.TempDir(), "kvstore.data")
+			opts := Options{Durability: durability, WAL: walMode}
+			db := ProvisionKV(path, opts)
+			assert.Nil(t, db.Open())
+			for i := 0; i < 100; i++ {
+				assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+			}
+			assert.Nil(t, db.Close())
+
+			db = ProvisionKV(path, opts)
+			assert.Nil(t, db.Open())
+			res, err := db.Scan(nil, nil, ScanOptions{})
+			assert.Nil(t, err)
+			assert.Len(t, res, 100, "durability %d, WAL %v", durability, walMode)
+			assert.Nil(t, db.Close())
+		}
+	}
+}
+
+func syncedTxid(db *KV) uint64 {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	return metaTxid(db.durableMeta)
+}
+
+func TestSyncPeriodic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := ProvisionKV(path, Options{Durability: SyncPeriodic, SyncInterval: 10 * time.Millisecond})
+	assert.Nil(t, db.Open())
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	for syncedTxid(db) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	crash(db)
+
+	db = ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	val, err := db.Get([]byte("k1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(val))
+}
+
+func TestSyncPeriodicCrashKeepsLastSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := ProvisionKV(path, Options{Durability: SyncPeriodic, SyncInterval: time.Hour})
+	assert.Nil(t, db.Open())
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v1")))
+	}
+	db.writer.Lock()
+	assert.Nil(t, syncNow(db))
+	db.writer.Unlock()
+
+	// rewrite everything a few times: the pages freed on the way must not
+	// overwrite the synced tree
+	for round := 2; round <= 5; round++ {
+		for i := 0; i < 200; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", round))))
+		}
+	}
+	crash(db)
+
+	db = ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	res, err := db.Scan(nil, nil, ScanOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, res, 200)
+	for _, p := range res {
+		assert.Equal(t, "v1", string(p.Val))
+	}
+}
@@ -0,0 +1,176 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"errors"
+)
+
+var ErrTxDone = errors.New("transaction already committed or aborted")
+
+// Tx applies a batch of updates atomically. The changes are buffered in the
+// page state of the KV (page.temp, page.updates, page.toDelete) like any
+// single update; Commit writes them out with one updateOrRevert (or one log
+// record in WAL mode), and Abort reloads the meta record saved at Begin,
+// discarding the pages buffered since.
+//
+// There is at most one Tx at a time: Begin blocks until the previous one
+// has been committed or aborted. Every Tx must be ended with either.
+type Tx struct {
+	db    *KV
+	meta  []byte    // state to go back to on Abort
+	marks pageMarks // pending pages that predate the Tx (WAL mode)
+	ops   []walOp   // updates to log on Commit (WAL mode)
+	done  bool
+}
+
+func (db *KV) Begin() *Tx {
+	db.writer.Lock()
+
+	// readers showing up from now on see at least the current version,
+	// which doesn't reach any page freed so far
+	db.mu.Lock()
+	db.freelist.maxVer = oldestReader(db)
+	db.mu.Unlock()
+
+	return &Tx{db: db, meta: saveMeta(db), marks: markPages(db)}
+}
+
+// Get sees the changes made earlier in the transaction. It fails with
+// ErrNotFound for a missing key.
+func (tx *Tx) Get(key btreeplus.ByteArr) (btreeplus.ByteArr, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	_, val, err := tx.db.tree.Get(key)
+	return val, err
+}
+
+// Set and Del leave the transaction as it was when they fail, even half
+// way through on a damaged page.
+func (tx *Tx) Set(key, val btreeplus.ByteArr) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	meta, marks := saveMeta(tx.db), markPages(tx.db)
+	if err := tx.db.tree.Insert(key, val); err != nil {
+		rollback(tx.db, meta, marks)
+		return err
+	}
+	if tx.db.wal != nil {
+		tx.ops = append(tx.ops, newWalOp(key, val, false))
+	}
+	return nil
+}
+
+func (tx *Tx) Del(key btreeplus.ByteArr) (isDeleted bool, err error) {
+	if tx.done {
+		return false, ErrTxDone
+	}
+	meta, marks := saveMeta(tx.db), markPages(tx.db)
+	if isDeleted, err = tx.db.tree.Delete(key); err != nil {
+		rollback(tx.db, meta, marks)
+		return isDeleted, err
+	}
+	if tx.db.wal != nil {
+		tx.ops = append(tx.ops, newWalOp(key, nil, true))
+	}
+	return isDeleted, nil
+}
+
+func (tx *Tx) Scan(start, end btreeplus.ByteArr, opts ScanOptions) ([]KVPair, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return scanPairs(&tx.db.tree, start, end, opts)
+}
+
+// Commit makes every change of the transaction durable, or none of them.
+// On failure the KV is left as it was before Begin.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	defer tx.db.writer.Unlock()
+
+	// any change to the tree allocates pages
+	if markPages(tx.db) == tx.marks {
+		return nil // read-only
+	}
+	if tx.db.wal != nil {
+		return commitWAL(tx.db, tx)
+	}
+	return updateOrRevert(tx.db, tx.meta)
+}
+
+func (tx *Tx) Abort() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	rollback(tx.db, tx.meta, tx.marks)
+	tx.db.writer.Unlock()
+}
+
+// ReadTx is a consistent view of the KV as of BeginRead. It doesn't block
+// the writer nor other readers, and later commits stay invisible to it.
+// Slices returned by Get are only valid until End.
+type ReadTx struct {
+	db      *KV
+	tree    btreeplus.BTree
+	version uint64
+	done    bool
+}
+
+func (db *KV) BeginRead() *ReadTx {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for db.compacting {
+		db.idle.Wait()
+	}
+
+	// the options are those of db.tree, already accepted by initTree
+	tree, _ := btreeplus.NewBTree(db.pageReadShared, nil, nil, treeOptions(db)...)
+	rtx := &ReadTx{
+		db:      db,
+		tree:    tree,
+		version: db.snapshot.version,
+	}
+	rtx.tree.SetRoot(db.snapshot.root)
+	db.readers[rtx.version]++
+	return rtx
+}
+
+// Get fails with ErrNotFound for a missing key.
+func (rtx *ReadTx) Get(key btreeplus.ByteArr) (btreeplus.ByteArr, error) {
+	if rtx.done {
+		return nil, ErrTxDone
+	}
+	_, val, err := rtx.tree.Get(key)
+	return val, err
+}
+
+func (rtx *ReadTx) Scan(start, end btreeplus.ByteArr, opts ScanOptions) ([]KVPair, error) {
+	if rtx.done {
+		return nil, ErrTxDone
+	}
+	return scanPairs(&rtx.tree, start, end, opts)
+}
+
+// End releases the snapshot, letting the pages it pins be reused.
+func (rtx *ReadTx) End() {
+	if rtx.done {
+		return
+	}
+	rtx.done = true
+
+	db := rtx.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.readers[rtx.version]--; db.readers[rtx.version] == 0 {
+		delete(db.readers, rtx.version)
+	}
+	if len(db.readers) == 0 {
+		db.idle.Broadcast()
+	}
+}
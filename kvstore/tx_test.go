@@ -0,0 +1,188 @@
+package kvstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	assert.Nil(t, db.Set([]byte("gone"), []byte("v")))
+
+	tx := db.Begin()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, tx.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	deleted, err := tx.Del([]byte("gone"))
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+
+	// changes are visible inside the transaction
+	val, err := tx.Get([]byte("k042"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v42", string(val))
+	res, err := tx.Scan([]byte("k010"), []byte("k013"), ScanOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"k010", "k011", "k012"}, scannedKeys(res))
+
+	assert.Nil(t, tx.Commit())
+	assert.Equal(t, uint64(2), db.txid, "the whole batch is a single commit")
+	assert.ErrorIs(t, tx.Set([]byte("late"), []byte("v")), ErrTxDone)
+	assert.Nil(t, db.Close())
+
+	db = ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("k%03d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("v%d", i), string(val))
+	}
+	_, err = db.Get([]byte("gone"))
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestTxAbort(t *testing.T) {
+	db := openTestKV(t)
+	assert.Nil(t, db.Set([]byte("keep"), []byte("v1")))
+	used, txid := db.page.flushedCount, db.txid
+
+	tx := db.Begin()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, tx.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	}
+	assert.Nil(t, tx.Set([]byte("keep"), []byte("v2")))
+	_, err := tx.Del([]byte("keep"))
+	assert.Nil(t, err)
+	tx.Abort()
+
+	val, err := db.Get([]byte("keep"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(val))
+	_, err = db.Get([]byte("k000"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, used, db.page.flushedCount)
+	assert.Equal(t, txid, db.txid)
+	assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+
+	// the KV is still usable afterwards
+	assert.Nil(t, db.Set([]byte("after"), []byte("v")))
+	_, err = db.Get([]byte("after"))
+	assert.Nil(t, err)
+}
+
+func TestTxReadOnlyCommit(t *testing.T) {
+	db := openTestKV(t)
+	assert.Nil(t, db.Set([]byte("k"), []byte("v")))
+
+	tx := db.Begin()
+	_, err := tx.Get([]byte("k"))
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit())
+	assert.Equal(t, uint64(1), db.txid)
+}
+
+func TestReadTxSnapshot(t *testing.T) {
+	db := openTestKV(t)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("old")))
+	}
+
+	rtx := db.BeginRead()
+	// rewrite everything a few times; the pages of the snapshot must survive
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("new%d", round))))
+		}
+	}
+	assert.Nil(t, db.Set([]byte("k999"), []byte("new")))
+
+	for i := 0; i < 200; i++ {
+		val, err := rtx.Get([]byte(fmt.Sprintf("k%03d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "old", string(val))
+	}
+	_, err := rtx.Get([]byte("k999"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	res, err := rtx.Scan(nil, nil, ScanOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, res, 200)
+	rtx.End()
+
+	// once released, the pinned pages go back into circulation
+	used := db.page.flushedCount
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("again")))
+		}
+	}
+	assert.LessOrEqual(t, db.page.flushedCount, used+5)
+}
+
+func TestConcurrentReaders(t *testing.T) {
+	// WAL mode writes the pages readers already see at each checkpoint
+	for _, opts := range []Options{{}, {WAL: true, PrefixCompression: true, WALCheckpointPages: 4}} {
+		db := ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"), opts)
+		assert.Nil(t, db.Open())
+		const nkeys = 100
+
+		for i := 0; i < nkeys; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("0")))
+		}
+
+		// every commit sets all keys to the same value, so a consistent
+		// snapshot never mixes two of them
+		stop := make(chan struct{})
+		errs := make(chan error, 8)
+		for r := 0; r < 8; r++ {
+			go func() {
+				for {
+					select {
+					case <-stop:
+						errs <- nil
+						return
+					default:
+					}
+
+					rtx := db.BeginRead()
+					res, _ := rtx.Scan(nil, nil, ScanOptions{})
+					rtx.End()
+					if len(res) != nkeys {
+						errs <- fmt.Errorf("got %d keys", len(res))
+						return
+					}
+					for _, p := range res {
+						if string(p.Val) != string(res[0].Val) {
+							errs <- fmt.Errorf("mixed snapshot: %s vs %s", p.Val, res[0].Val)
+							return
+						}
+					}
+				}
+			}()
+		}
+
+		for round := 1; round <= 20; round++ {
+			tx := db.Begin()
+			for i := 0; i < nkeys; i++ {
+				key := []byte(fmt.Sprintf("k%03d", i))
+				if i%2 == 0 {
+					_, err := tx.Del(key)
+					assert.Nil(t, err)
+				}
+				assert.Nil(t, tx.Set(key, []byte(fmt.Sprint(round))))
+			}
+			assert.Nil(t, tx.Commit())
+		}
+		close(stop)
+
+		for r := 0; r < 8; r++ {
+			assert.Nil(t, <-errs, "%+v", opts)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,277 @@
+package kvstore
+
+import (
+	"beaver/btreeplus"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+In WAL mode a commit only appends the updates of the transaction to the log
+and fsyncs it. The pages they produced stay pending in memory (page.temp,
+page.updates, page.toDelete) across commits, and are written out with the
+meta page by a checkpoint, which then empties the log.
+
+record format:
+| crc | size | txid | nops |  ops  |
+| 4B  |  4B  |  8B  |  4B  |  ...  |
+
+op format:
+| kind | klen | vlen | key | val |
+|  1B  |  4B  |  4B  | ... | ... |
+
+size is the number of bytes following it, which the crc covers as well.
+records are replayed on Open when their txid is newer than the meta page;
+replay stops at the first incomplete or damaged record, which is what a
+crash in the middle of an append leaves behind.
+*/
+const (
+	WAL_SUFFIX        = "-wal"
+	WAL_HEADER_SIZE   = 8
+	WAL_RECORD_HEADER = 12 // txid + nops
+	WAL_OP_HEADER     = 9
+)
+
+const (
+	walOpSet byte = 1
+	walOpDel byte = 2
+)
+
+var ErrWALCorrupt = errors.New("write-ahead log is inconsistent")
+
+type walOp struct {
+	kind byte
+	key  []byte
+	val  []byte
+}
+
+// key and val are copied, the caller may reuse them before Commit
+func newWalOp(key, val btreeplus.ByteArr, del bool) walOp {
+	op := walOp{kind: walOpSet, key: append([]byte{}, key...), val: append([]byte{}, val...)}
+	if del {
+		op.kind = walOpDel
+		op.val = nil
+	}
+	return op
+}
+
+type wal struct {
+	fp       *os.File
+	size     int64           // end of the last complete record
+	sync     func(int) error // run after each append, nil to leave it to the syncer
+	unsynced bool            // appended since the last sync
+}
+
+func walPath(path string) string {
+	return path + WAL_SUFFIX
+}
+
+func encodeWALRecord(txid uint64, ops []walOp) []byte {
+	size := WAL_RECORD_HEADER
+	for _, op := range ops {
+		size += WAL_OP_HEADER + len(op.key) + len(op.val)
+	}
+
+	rec := make([]byte, WAL_HEADER_SIZE+size)
+	binary.LittleEndian.PutUint32(rec[4:], uint32(size))
+	binary.LittleEndian.PutUint64(rec[8:], txid)
+	binary.LittleEndian.PutUint32(rec[16:], uint32(len(ops)))
+
+	pos := WAL_HEADER_SIZE + WAL_RECORD_HEADER
+	for _, op := range ops {
+		rec[pos] = op.kind
+		binary.LittleEndian.PutUint32(rec[pos+1:], uint32(len(op.key)))
+		binary.LittleEndian.PutUint32(rec[pos+5:], uint32(len(op.val)))
+		pos += WAL_OP_HEADER
+		pos += copy(rec[pos:], op.key)
+		pos += copy(rec[pos:], op.val)
+	}
+
+	binary.LittleEndian.PutUint32(rec[0:], crc32.Checksum(rec[4:], crcTable))
+	return rec
+}
+
+// decodeWALRecord parses the record at the start of data. ok is false if
+// data doesn't start with a complete, intact record.
+func decodeWALRecord(data []byte) (txid uint64, ops []walOp, n int, ok bool) {
+	if len(data) < WAL_HEADER_SIZE+WAL_RECORD_HEADER {
+		return 0, nil, 0, false
+	}
+	size := int(binary.LittleEndian.Uint32(data[4:]))
+	if size < WAL_RECORD_HEADER || len(data)-WAL_HEADER_SIZE < size {
+		return 0, nil, 0, false
+	}
+	n = WAL_HEADER_SIZE + size
+	if crc32.Checksum(data[4:n], crcTable) != binary.LittleEndian.Uint32(data[0:]) {
+		return 0, nil, 0, false
+	}
+
+	txid = binary.LittleEndian.Uint64(data[8:])
+	nops := int(binary.LittleEndian.Uint32(data[16:]))
+	pos := WAL_HEADER_SIZE + WAL_RECORD_HEADER
+	for i := 0; i < nops; i++ {
+		if n-pos < WAL_OP_HEADER {
+			return 0, nil, 0, false
+		}
+		op := walOp{kind: data[pos]}
+		klen := int(binary.LittleEndian.Uint32(data[pos+1:]))
+		vlen := int(binary.LittleEndian.Uint32(data[pos+5:]))
+		pos += WAL_OP_HEADER
+		if n-pos < klen+vlen {
+			return 0, nil, 0, false
+		}
+		op.key = data[pos : pos+klen]
+		op.val = data[pos+klen : pos+klen+vlen]
+		pos += klen + vlen
+		ops = append(ops, op)
+	}
+	return txid, ops, n, pos == n
+}
+
+// append writes rec at the end of the log and makes it durable. On error
+// the log is cut back, so the record doesn't survive a restart either.
+func (w *wal) append(rec []byte) error {
+	_, err := unix.Pwrite(int(w.fp.Fd()), rec, w.size)
+	if err == nil && w.sync != nil {
+		err = w.sync(int(w.fp.Fd()))
+	}
+	if err != nil {
+		// best effort: a leftover record is overwritten by the next append
+		w.fp.Truncate(w.size)
+		return fmt.Errorf("append to WAL: %w", err)
+	}
+	w.size += int64(len(rec))
+	w.unsynced = w.sync == nil
+	return nil
+}
+
+// reset empties the log. It needs no fsync: records that come back after a
+// crash are older than the meta page and skipped by replay.
+func (w *wal) reset() error {
+	if err := w.fp.Truncate(0); err != nil {
+		return fmt.Errorf("truncate WAL: %w", err)
+	}
+	w.size = 0
+	return nil
+}
+
+// openWAL opens the log of db, replays what it holds and checkpoints the
+// result. Outside WAL mode a log left over from an earlier run is removed
+// once replayed.
+func openWAL(db *KV) error {
+	path := walPath(db.Path)
+	if !db.opts.WAL {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+	}
+
+	fp, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open WAL: %w", err)
+	}
+	db.wal = &wal{fp: fp}
+	switch db.opts.Durability {
+	case SyncFull:
+		db.wal.sync = unix.Fsync
+	case SyncData:
+		db.wal.sync = fdatasync
+	}
+
+	err = replayWAL(db)
+	if err == nil {
+		err = checkpoint(db)
+	}
+	if err == nil && !db.opts.WAL {
+		err = os.Remove(path)
+	}
+	if err != nil || !db.opts.WAL {
+		fp.Close()
+		db.wal = nil
+	}
+	return err
+}
+
+func replayWAL(db *KV) error {
+	data, err := os.ReadFile(db.wal.fp.Name())
+	if err != nil {
+		return fmt.Errorf("read WAL: %w", err)
+	}
+
+	for pos := 0; pos < len(data); {
+		txid, ops, n, ok := decodeWALRecord(data[pos:])
+		if !ok || (txid > db.txid && txid != db.txid+1) {
+			break // torn tail
+		}
+		pos += n
+
+		if txid <= db.txid {
+			continue // already checkpointed
+		}
+		for _, op := range ops {
+			switch op.kind {
+			case walOpSet:
+				err = db.tree.Insert(op.key, op.val)
+			case walOpDel:
+				_, err = db.tree.Delete(op.key)
+			default:
+				err = ErrWALCorrupt
+			}
+			if err != nil {
+				return fmt.Errorf("replay WAL txid %d: %w", txid, err)
+			}
+		}
+		db.txid = txid
+	}
+	return nil
+}
+
+// commitWAL commits tx by logging its updates. The tree was already
+// modified in memory, so once the record is durable the commit is done.
+func commitWAL(db *KV, tx *Tx) error {
+	if err := db.wal.append(encodeWALRecord(db.txid+1, tx.ops)); err != nil {
+		rollback(db, tx.meta, tx.marks)
+		return err
+	}
+	db.txid++
+	publish(db)
+
+	pendingPages := len(db.page.temp) + len(db.page.updates)
+	if db.wal.size >= db.opts.checkpointSize() || pendingPages >= db.opts.checkpointPages() {
+		// the update is durable in the log already. a failed checkpoint
+		// is retried by the next one, the log keeps growing meanwhile.
+		checkpoint(db)
+	}
+	return nil
+}
+
+// checkpoint writes out the pages of the updates that are only in the log
+// so far, then empties the log. Caller holds db.writer.
+func checkpoint(db *KV) error {
+	if db.txid != metaTxid(db.durableMeta) || db.lastUpdateFailed {
+		if err := commitPages(db); err != nil {
+			return fmt.Errorf("checkpoint: %w", err)
+		}
+	}
+	// the log may only go once the meta page is durable
+	if err := syncNow(db); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	return db.wal.reset()
+}
+
+// Checkpoint writes the updates logged since the last checkpoint to the
+// database file. It is a no-op outside WAL mode.
+func (db *KV) Checkpoint() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if db.wal == nil {
+		return nil
+	}
+	return checkpoint(db)
+}
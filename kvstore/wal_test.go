@@ -0,0 +1,151 @@
+package kvstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+// crash drops db like a killed process would, without checkpointing nor
+// syncing.
+func crash(db *KV) {
+	stopSyncer(db)
+	if db.wal != nil {
+		db.wal.fp.Close()
+	}
+	for _, chunk := range db.mmap.chunks {
+		unix.Munmap(chunk)
+	}
+	db.filePtr.Close()
+}
+
+func walTestKV(t *testing.T, path string) *KV {
+	db := ProvisionKV(path, Options{WAL: true, WALCheckpointSize: 1 << 30})
+	assert.Nil(t, db.Open())
+	return db
+}
+
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := walTestKV(t, path)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	_, err := db.Del([]byte("k007"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), db.page.flushedCount, "nothing checkpointed yet")
+
+	// readers see the logged updates
+	val, err := db.Get([]byte("k100"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v100", string(val))
+	crash(db)
+
+	// replayed even outside WAL mode, the log is gone afterwards
+	db = ProvisionKV(path)
+	assert.Nil(t, db.Open())
+	for i := 0; i < 200; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("k%03d", i)))
+		if i == 7 {
+			assert.ErrorIs(t, err, ErrNotFound)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("v%d", i), string(val))
+		}
+	}
+	assert.Equal(t, uint64(201), db.txid)
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(walPath(path))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := ProvisionKV(path, Options{WAL: true, WALCheckpointSize: 4096})
+	assert.Nil(t, db.Open())
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	}
+	assert.Less(t, db.wal.size, int64(4096))
+	assert.Greater(t, db.page.flushedCount, uint64(1))
+
+	assert.Nil(t, db.Checkpoint())
+	assert.Equal(t, int64(0), db.wal.size)
+	assert.Equal(t, db.txid, metaTxid(db.durableMeta))
+	crash(db)
+
+	db = walTestKV(t, path)
+	defer db.Close()
+	res, err := db.Scan(nil, nil, ScanOptions{})
+	assert.Nil(t, err)
+	assert.Len(t, res, 500)
+}
+
+func TestWALCheckpointPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := ProvisionKV(path, Options{WAL: true, Durability: SyncNone, WALCheckpointPages: 64})
+	assert.Nil(t, db.Open())
+	defer db.Close()
+	// small records, the log stays far below its checkpoint size
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("k%04d", i%500)), []byte("v")))
+		assert.Less(t, len(db.page.temp)+len(db.page.updates), 64)
+	}
+	assert.Less(t, db.wal.size, int64(DEFAULT_WAL_CHECKPOINT_SIZE))
+	assert.Greater(t, db.Stat().Pages, uint64(1))
+	assert.True(t, db.Verify().OK())
+}
+
+func TestWALAbort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := walTestKV(t, path)
+	assert.Nil(t, db.Set([]byte("keep"), []byte("v1")))
+
+	tx := db.Begin()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, tx.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	}
+	assert.Nil(t, tx.Set([]byte("keep"), []byte("v2")))
+	tx.Abort()
+
+	// the update committed before the aborted one is still pending
+	assert.Equal(t, 1, len(db.page.temp))
+	val, err := db.Get([]byte("keep"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(val))
+
+	assert.Nil(t, db.Set([]byte("next"), []byte("v")))
+	crash(db)
+
+	db = walTestKV(t, path)
+	defer db.Close()
+	res, err := db.Scan(nil, nil, ScanOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"keep", "next"}, scannedKeys(res))
+	val, _ = db.Get([]byte("keep"))
+	assert.Equal(t, "v1", string(val))
+}
+
+func TestWALTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	db := walTestKV(t, path)
+	assert.Nil(t, db.Set([]byte("k1"), []byte("v1")))
+	assert.Nil(t, db.Set([]byte("k2"), []byte("v2")))
+	size := db.wal.size
+	crash(db)
+
+	// cut the last record short, as a crash during its append would
+	assert.Nil(t, os.Truncate(walPath(path), size-3))
+
+	db = walTestKV(t, path)
+	defer db.Close()
+	_, err := db.Get([]byte("k1"))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("k2"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, uint64(1), db.txid)
+}
@@ -1,52 +1,131 @@
+// Command beaver reads and writes a kvstore database file.
+//
+//	beaver [flags] <db-path> <command> [args]
+//	beaver [flags] <db-path>              interactive shell
+//
+// Keys and values are given as text unless -input says otherwise, and
+// printed as -format says.
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
 	"beaver/btreeplus"
 	"beaver/kvstore"
 )
 
-func main() {
-	// btreeplus.Run()
-
-	// fl, err := os.OpenFile("/Users/kernel/Documents/Playgrounds/go-beaver/go-beaver/temp.etc", os.O_RDWR|os.O_CREATE, 06444)
-	// if err != nil {
-	// 	println(err)
-	// 	os.Exit(1)
-	// }
+// errors the user made, rather than the database
+var errUsage = errors.New("usage")
 
-	// fl.Truncate(1024)
-
-	// fmt.Println(fl.Name())
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
 
-	// mmap, err := unix.Mmap(int(fl.Fd()), 0, 100, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+var comparators = map[string]btreeplus.Comparator{}
 
-	// if err != nil {
-	// 	println(err)
-	// 	os.Exit(1)
-	// }
+func init() {
+	for _, cmp := range []btreeplus.Comparator{
+		btreeplus.BytesComparator,
+		btreeplus.ReverseBytesComparator,
+		btreeplus.CaseInsensitiveComparator,
+		btreeplus.Int64BEComparator,
+	} {
+		comparators[cmp.Name] = cmp
+	}
+}
 
-	// copy(mmap, "hellorooni")
-	// unix.Msync(mmap, unix.MS_SYNC)
+var durabilities = map[string]kvstore.Durability{
+	"full":     kvstore.SyncFull,
+	"data":     kvstore.SyncData,
+	"periodic": kvstore.SyncPeriodic,
+	"none":     kvstore.SyncNone,
+}
 
-	// unix.Munmap(mmap)
-	// fl.Close()
+// run is main without the process: it returns the exit status, 2 for a
+// usage error and 1 for any other.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("beaver", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "text", "output encoding of keys and values: text, hex or base64")
+	input := flags.String("input", "text", "encoding of the keys and values given: text, hex or base64")
+	pageSize := flags.Int("page-size", 0, "page size of a new database file")
+	prefix := flags.Bool("prefix-compression", false, "prefix-compress the pages of a new database file")
+	cmpName := flags.String("comparator", btreeplus.BytesComparator.Name, "key order: bytes, bytes-reverse, ascii-case-insensitive or int64-be")
+	wal := flags.Bool("wal", false, "commit through a write-ahead log")
+	syncMode := flags.String("sync", "full", "durability: full, data, periodic or none")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: beaver [flags] <db-path> [command [args]]\n\ncommands:\n")
+		printCommands(stderr)
+		fmt.Fprintf(stderr, "\nwithout a command, beaver reads commands from stdin\n\nflags:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 1 {
+		flags.Usage()
+		return 2
+	}
 
-	myStore := kvstore.ProvisionKV("/Users/kernel/Documents/Playgrounds/go-beaver/go-beaver/kvstore.data")
+	opts := kvstore.Options{PageSize: *pageSize, PrefixCompression: *prefix, WAL: *wal}
+	var ok bool
+	if opts.Comparator, ok = comparators[*cmpName]; !ok {
+		fmt.Fprintf(stderr, "beaver: unknown comparator %q\n", *cmpName)
+		return 2
+	}
+	if opts.Durability, ok = durabilities[*syncMode]; !ok {
+		fmt.Fprintf(stderr, "beaver: unknown sync mode %q\n", *syncMode)
+		return 2
+	}
+	sh := &shell{out: stdout}
+	for name, enc := range map[string]*string{"format": format, "input": input} {
+		if _, ok := encodings[*enc]; !ok {
+			fmt.Fprintf(stderr, "beaver: unknown -%s %q\n", name, *enc)
+			return 2
+		}
+	}
+	sh.format, sh.input = encodings[*format], encodings[*input]
 
-	err := myStore.Open()
-	if err != nil {
-		println(err)
+	// checking a file doesn't open it, so a damaged one can be checked too
+	if flags.NArg() == 2 && flags.Arg(1) == "check" {
+		report, err := kvstore.Check(flags.Arg(0), opts)
+		if err == nil {
+			err = printReport(stdout, report)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "beaver: %v\n", err)
+			return 1
+		}
+		return 0
 	}
 
-	// myStore.Set(btreeplus.ByteArr("k1"), btreeplus.ByteArr("mickey1"))
-	// myStore.Set(btreeplus.ByteArr("k2"), btreeplus.ByteArr("mickey2"))
-	// myStore.Set(btreeplus.ByteArr("k3"), btreeplus.ByteArr("the clan"))
+	sh.db = kvstore.ProvisionKV(flags.Arg(0), opts)
+	if err := sh.db.Open(); err != nil {
+		fmt.Fprintf(stderr, "beaver: %v\n", err)
+		return 1
+	}
 
-	res, exists := myStore.Get(btreeplus.ByteArr("k1"))
-	if exists {
-		println(string(res))
+	var err error
+	if flags.NArg() == 1 {
+		err = sh.repl(stdin, stderr)
 	} else {
-		println(exists)
+		err = sh.exec(flags.Args()[1:])
+	}
+	if closeErr := sh.db.Close(); err == nil {
+		err = closeErr
 	}
 
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(stderr, "beaver: %v\n", err)
+		return 2
+	}
+	fmt.Fprintf(stderr, "beaver: %v\n", err)
+	return 1
 }
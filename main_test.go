@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// beaver runs the command line, returning its status and outputs.
+func beaver(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	status := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	for _, kv := range [][2]string{{"k1", "hello"}, {"k2", "a b"}, {"k3", "\x00\xff"}} {
+		status, _, stderr := beaver("", path, "set", kv[0], kv[1])
+		assert.Equal(t, 0, status, stderr)
+	}
+
+	status, stdout, _ := beaver("", path, "get", "k1")
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "hello\n", stdout)
+	_, stdout, _ = beaver("", "-format", "hex", path, "get", "k3")
+	assert.Equal(t, "00ff\n", stdout)
+	_, stdout, _ = beaver("", "-format", "base64", path, "get", "k2")
+	assert.Equal(t, "YSBi\n", stdout)
+	_, stdout, _ = beaver("", "-input", "hex", path, "get", "6b31")
+	assert.Equal(t, "hello\n", stdout)
+
+	_, stdout, _ = beaver("", path, "scan", "k2")
+	assert.Equal(t, "k2\ta b\nk3\t\x00\xff\n", stdout)
+	_, stdout, _ = beaver("", path, "scan", "-reverse", "-limit", "1")
+	assert.Equal(t, "k3\t\x00\xff\n", stdout)
+	_, stdout, _ = beaver("", path, "scan", "-prefix", "k1")
+	assert.Equal(t, "k1\thello\n", stdout)
+
+	status, _, _ = beaver("", path, "del", "k1")
+	assert.Equal(t, 0, status)
+	status, _, stderr := beaver("", path, "get", "k1")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr, "key not found")
+
+	status, stdout, _ = beaver("", path, "stat")
+	assert.Equal(t, 0, status)
+	assert.Contains(t, stdout, "page size:          4096\n")
+	assert.Contains(t, stdout, "txid:               4\n")
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	beaver("", path, "set", "k1", "v1")
+	beaver("", path, "set", "k2", "v2")
+
+	status, stdout, _ := beaver("", path, "check")
+	assert.Equal(t, 0, status)
+	assert.Contains(t, stdout, "keys:               2\n")
+	_, stdout, _ = beaver("check\n", path)
+	assert.Contains(t, stdout, "keys:               2\n")
+
+	// break every page but the meta page
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	for i := 4096; i < len(data); i++ {
+		data[i] = 0x07
+	}
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+	status, stdout, stderr := beaver("", path, "check")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stdout, "page checksum mismatch")
+	assert.Contains(t, stderr, "problems found")
+}
+
+func TestCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	var script strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&script, "set k%03d %s\n", i, strings.Repeat("v", 1000))
+	}
+	for i := 1; i < 200; i++ {
+		fmt.Fprintf(&script, "del k%03d\n", i)
+	}
+	status, _, stderr := beaver(script.String(), path)
+	assert.Equal(t, 0, status, stderr)
+
+	status, stdout, _ := beaver("", path, "compact")
+	assert.Equal(t, 0, status)
+	// the meta page and a leaf
+	assert.Regexp(t, `^pages: \d+ -> 2\nfile size: \d+ -> 8192\n$`, stdout)
+
+	copyPath := filepath.Join(t.TempDir(), "copy.data")
+	status, _, _ = beaver("", path, "compact", copyPath)
+	assert.Equal(t, 0, status)
+	_, stdout, _ = beaver("", copyPath, "get", "k000")
+	assert.Equal(t, strings.Repeat("v", 1000)+"\n", stdout)
+	status, _, stderr = beaver("", path, "compact", copyPath)
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr, "file already exists")
+}
+
+func TestUsageErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	for _, args := range [][]string{
+		{},
+		{"-format", "octal", path, "stat"},
+		{"-comparator", "random", path, "stat"},
+		{path, "get"},
+		{path, "fly"},
+		{path, "scan", "-prefix", "k", "a"},
+		{"-input", "hex", path, "get", "zz"},
+	} {
+		status, _, _ := beaver("", args...)
+		assert.Equal(t, 2, status, args)
+	}
+
+	status, _, stderr := beaver("", "-page-size", "1000", path, "stat")
+	assert.Equal(t, 1, status)
+	assert.Contains(t, stderr, "page size")
+}
+
+func TestREPL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	status, stdout, stderr := beaver("set 'two words' \"x y\"\n\nget 'two words'\nget nope\nbogus\nexit\nget 'two words'\n", path)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "beaver> beaver> beaver> x y\nbeaver> beaver> beaver> ", stdout)
+	assert.Equal(t, "error: key not found: nope\nerror: usage: unknown command \"bogus\", try help\n", stderr)
+
+	// EOF ends the shell too
+	status, stdout, _ = beaver("get 'two words'", path)
+	assert.Equal(t, 0, status)
+	assert.Equal(t, "beaver> x y\nbeaver> \n", stdout)
+}
@@ -0,0 +1,278 @@
+package query
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+
+	"beaver/relstore"
+)
+
+var ErrType = errors.New("type error")
+
+// eval computes e on a row. Like in SQL, an operator with a null operand
+// gives null, and a WHERE clause keeps the rows it is true for.
+func eval(e Expr, row relstore.Record) (any, error) {
+	switch e := e.(type) {
+	case Literal:
+		return e.Value, nil
+	case ColumnRef:
+		v, ok := row[e.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNoColumn, e.Name)
+		}
+		return v, nil
+	case *Unary:
+		v, err := eval(e.Operand, row)
+		if err != nil {
+			return nil, err
+		}
+		return evalUnary(e.Op, v)
+	case *Binary:
+		return evalBinary(e, row)
+	}
+	return nil, fmt.Errorf("%w: unknown expression %T", ErrType, e)
+}
+
+func evalUnary(op string, v any) (any, error) {
+	switch op {
+	case "IS NULL":
+		return v == nil, nil
+	case "IS NOT NULL":
+		return v != nil, nil
+	}
+	if v == nil {
+		return nil, nil
+	}
+	switch op {
+	case "NOT":
+		if b, ok := v.(bool); ok {
+			return !b, nil
+		}
+	case "-":
+		return arith("-", int64(0), v)
+	}
+	return nil, fmt.Errorf("%w: %s %T", ErrType, op, v)
+}
+
+func evalBinary(e *Binary, row relstore.Record) (any, error) {
+	left, err := eval(e.Left, row)
+	if err != nil {
+		return nil, err
+	}
+	// false AND x and true OR x don't depend on x
+	if lb, ok := left.(bool); ok && (e.Op == "AND" && !lb || e.Op == "OR" && lb) {
+		return lb, nil
+	}
+	right, err := eval(e.Right, row)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.Op {
+	case "AND", "OR":
+		for _, v := range []any{left, right} {
+			if _, ok := v.(bool); v != nil && !ok {
+				return nil, fmt.Errorf("%w: %s on %T", ErrType, e.Op, v)
+			}
+		}
+		// left is true for AND and false for OR, or null
+		if rb, ok := right.(bool); ok && (e.Op == "AND" && !rb || e.Op == "OR" && rb) {
+			return rb, nil
+		}
+		if left == nil || right == nil {
+			return nil, nil
+		}
+		return right, nil
+	}
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	switch e.Op {
+	case "+", "-", "*", "/":
+		return arith(e.Op, left, right)
+	}
+
+	c, err := compare(left, right)
+	if err != nil {
+		return nil, err
+	}
+	switch e.Op {
+	case "=":
+		return c == 0, nil
+	case "!=":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	}
+	return c >= 0, nil
+}
+
+// compare orders two non-null values. Numbers compare by value whatever
+// their types, strings and blobs bytewise, false before true.
+func compare(a, b any) (int, error) {
+	switch a := a.(type) {
+	case int64, uint64, float64:
+		if isNumber(b) {
+			return compareNumbers(a, b), nil
+		}
+	case string:
+		switch b := b.(type) {
+		case string:
+			return cmpOrdered(a, b), nil
+		case []byte:
+			return bytes.Compare([]byte(a), b), nil
+		}
+	case []byte:
+		switch b := b.(type) {
+		case string:
+			return bytes.Compare(a, []byte(b)), nil
+		case []byte:
+			return bytes.Compare(a, b), nil
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			return cmpOrdered(boolInt(a), boolInt(b)), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: can't compare %T with %T", ErrType, a, b)
+}
+
+func isNumber(v any) bool {
+	switch v.(type) {
+	case int64, uint64, float64:
+		return true
+	}
+	return false
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func cmpOrdered[T int | int64 | uint64 | float64 | string](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// integers compare exactly, a float against anything as a float
+func compareNumbers(a, b any) int {
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return cmpOrdered(a, b)
+		case uint64:
+			if a < 0 {
+				return -1
+			}
+			return cmpOrdered(uint64(a), b)
+		}
+	case uint64:
+		switch b := b.(type) {
+		case uint64:
+			return cmpOrdered(a, b)
+		case int64:
+			return -compareNumbers(b, a)
+		}
+	}
+	return cmpOrdered(toFloat(a), toFloat(b))
+}
+
+func toFloat(v any) float64 {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	}
+	return v.(float64)
+}
+
+// arith computes on int64 unless a float is involved, or both operands are
+// uint64.
+func arith(op string, a, b any) (any, error) {
+	if !isNumber(a) || !isNumber(b) {
+		return nil, fmt.Errorf("%w: %T %s %T", ErrType, a, op, b)
+	}
+	_, af := a.(float64)
+	_, bf := b.(float64)
+	if af || bf {
+		x, y := toFloat(a), toFloat(b)
+		switch op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		}
+		return x / y, nil
+	}
+
+	au, aIsU := a.(uint64)
+	bu, bIsU := b.(uint64)
+	if aIsU && bIsU {
+		switch op {
+		case "+":
+			return au + bu, nil
+		case "-":
+			return au - bu, nil
+		case "*":
+			return au * bu, nil
+		}
+		if bu == 0 {
+			return nil, fmt.Errorf("%w: division by zero", ErrType)
+		}
+		return au / bu, nil
+	}
+
+	x, ok1 := toInt(a)
+	y, ok2 := toInt(b)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("%w: integer overflow", ErrType)
+	}
+	switch op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	}
+	if y == 0 {
+		return nil, fmt.Errorf("%w: division by zero", ErrType)
+	}
+	return x / y, nil
+}
+
+func toInt(v any) (int64, bool) {
+	if u, ok := v.(uint64); ok {
+		return int64(u), u <= math.MaxInt64
+	}
+	return v.(int64), true
+}
+
+// truth tells whether a WHERE clause keeps a row.
+func truth(v any) (bool, error) {
+	switch v := v.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	}
+	return false, fmt.Errorf("%w: condition is a %T, not a bool", ErrType, v)
+}
@@ -0,0 +1,293 @@
+// Package query runs a small SQL-like language on relstore tables:
+//
+//	SELECT * | col, ... FROM t [WHERE expr] [ORDER BY col [ASC|DESC], ...] [LIMIT n]
+//	INSERT INTO t (col, ...) VALUES (expr, ...), ...
+//	UPDATE t SET col = expr, ... [WHERE expr]
+//	DELETE FROM t [WHERE expr]
+//
+// WHERE clauses are served by a range scan of the primary key or of an
+// index when they compare its leading columns with literals (see plan).
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"beaver/relstore"
+)
+
+var ErrNoColumn = errors.New("no such column")
+
+// Result is the outcome of a statement: the rows of a SELECT, with the
+// names of their columns, or the number of rows an INSERT, UPDATE or DELETE
+// changed.
+type Result struct {
+	Columns  []string
+	Rows     [][]any
+	Affected int
+}
+
+// Exec parses and runs a statement. Statements that write run in a
+// transaction of their own: either all of their rows change, or none.
+func Exec(db *relstore.DB, src string) (*Result, error) {
+	stmt, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return ExecStatement(db, stmt)
+}
+
+func ExecStatement(db *relstore.DB, stmt Statement) (*Result, error) {
+	if sel, ok := stmt.(*Select); ok {
+		return execSelect(db, sel)
+	}
+
+	tx := db.Begin()
+	var res *Result
+	var err error
+	switch stmt := stmt.(type) {
+	case *Insert:
+		res, err = execInsert(tx, stmt)
+	case *Update:
+		res, err = execUpdate(tx, stmt)
+	case *Delete:
+		res, err = execDelete(tx, stmt)
+	default:
+		err = fmt.Errorf("unknown statement %T", stmt)
+	}
+	if err != nil {
+		tx.Abort()
+		return nil, err
+	}
+	return res, tx.Commit()
+}
+
+// rowSource reads tables, through a relstore.DB or a relstore.Tx.
+type rowSource interface {
+	Table(name string) (*relstore.TableDef, error)
+	Scan(table string, r relstore.Range) ([]relstore.Record, error)
+	ScanIndex(table, index string, r relstore.Range) ([]relstore.Record, error)
+}
+
+func execSelect(db *relstore.DB, stmt *Select) (*Result, error) {
+	def, err := db.Table(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	cols := stmt.Columns
+	if cols == nil {
+		for _, col := range def.Columns {
+			cols = append(cols, col.Name)
+		}
+	}
+	names := append([]string{}, cols...)
+	for _, term := range stmt.OrderBy {
+		names = append(names, term.Column)
+	}
+	if err := checkColumns(def, names, stmt.Where); err != nil {
+		return nil, err
+	}
+
+	rows, err := selectRows(db, def, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+	if err := sortRows(rows, stmt.OrderBy); err != nil {
+		return nil, err
+	}
+	if stmt.Limit >= 0 && len(rows) > stmt.Limit {
+		rows = rows[:stmt.Limit]
+	}
+
+	res := &Result{Columns: cols, Rows: make([][]any, 0, len(rows))}
+	for _, row := range rows {
+		vals := make([]any, len(cols))
+		for i, col := range cols {
+			vals[i] = row[col]
+		}
+		res.Rows = append(res.Rows, vals)
+	}
+	return res, nil
+}
+
+func execInsert(tx *relstore.Tx, stmt *Insert) (*Result, error) {
+	def, err := tx.Table(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkColumns(def, stmt.Columns, nil); err != nil {
+		return nil, err
+	}
+	for _, exprs := range stmt.Rows {
+		rec := relstore.Record{}
+		for i, e := range exprs {
+			v, err := eval(e, relstore.Record{})
+			if err != nil {
+				return nil, err
+			}
+			rec[stmt.Columns[i]] = v
+		}
+		if err := tx.Insert(def.Name, rec); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{Affected: len(stmt.Rows)}, nil
+}
+
+func execUpdate(tx *relstore.Tx, stmt *Update) (*Result, error) {
+	def, err := tx.Table(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, set := range stmt.Set {
+		if _, i, ok := def.Column(set.Column); ok && i < def.PKeys {
+			return nil, fmt.Errorf("%w: can't update primary key column %s", ErrType, set.Column)
+		}
+		names = append(names, set.Column)
+		if err := checkColumns(def, nil, set.Value); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkColumns(def, names, stmt.Where); err != nil {
+		return nil, err
+	}
+
+	rows, err := selectRows(tx, def, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		// the new values are computed from the row as it was
+		rec := primaryKey(def, row)
+		for _, set := range stmt.Set {
+			if rec[set.Column], err = eval(set.Value, row); err != nil {
+				return nil, err
+			}
+		}
+		if err := tx.Update(def.Name, rec); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{Affected: len(rows)}, nil
+}
+
+func execDelete(tx *relstore.Tx, stmt *Delete) (*Result, error) {
+	def, err := tx.Table(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkColumns(def, nil, stmt.Where); err != nil {
+		return nil, err
+	}
+	rows, err := selectRows(tx, def, stmt.Where)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if _, err := tx.Delete(def.Name, primaryKey(def, row)); err != nil {
+			return nil, err
+		}
+	}
+	return &Result{Affected: len(rows)}, nil
+}
+
+func primaryKey(def *relstore.TableDef, row relstore.Record) relstore.Record {
+	rec := relstore.Record{}
+	for _, col := range def.Columns[:def.PKeys] {
+		rec[col.Name] = row[col.Name]
+	}
+	return rec
+}
+
+// checkColumns makes sure names and the columns used by where exist, so
+// that mistakes are reported even when no row is read.
+func checkColumns(def *relstore.TableDef, names []string, where Expr) error {
+	names = append(names, exprColumns(where)...)
+	for _, name := range names {
+		if _, _, ok := def.Column(name); !ok {
+			return fmt.Errorf("%w: %s.%s", ErrNoColumn, def.Name, name)
+		}
+	}
+	return nil
+}
+
+func exprColumns(e Expr) []string {
+	switch e := e.(type) {
+	case ColumnRef:
+		return []string{e.Name}
+	case *Unary:
+		return exprColumns(e.Operand)
+	case *Binary:
+		return append(exprColumns(e.Left), exprColumns(e.Right)...)
+	}
+	return nil
+}
+
+// selectRows reads the rows where is true for, through the range of keys
+// chosen by plan.
+func selectRows(src rowSource, def *relstore.TableDef, where Expr) ([]relstore.Record, error) {
+	index, r := plan(def, where)
+	var rows []relstore.Record
+	var err error
+	if index == "" {
+		rows, err = src.Scan(def.Name, r)
+	} else {
+		rows, err = src.ScanIndex(def.Name, index, r)
+	}
+	if err != nil || where == nil {
+		return rows, err
+	}
+
+	// the range may hold more rows than where selects
+	kept := rows[:0]
+	for _, row := range rows {
+		v, err := eval(where, row)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := truth(v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			kept = append(kept, row)
+		}
+	}
+	return kept, nil
+}
+
+// sortRows sorts by the ORDER BY terms, nulls first.
+func sortRows(rows []relstore.Record, terms []OrderTerm) error {
+	if len(terms) == 0 {
+		return nil
+	}
+	var err error
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, term := range terms {
+			a, b := rows[i][term.Column], rows[j][term.Column]
+			c := 0
+			switch {
+			case a == nil && b == nil:
+			case a == nil:
+				c = -1
+			case b == nil:
+				c = 1
+			default:
+				var cmpErr error
+				if c, cmpErr = compare(a, b); cmpErr != nil {
+					err = cmpErr
+				}
+			}
+			if term.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return err
+}
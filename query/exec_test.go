@@ -0,0 +1,173 @@
+package query
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"beaver/kvstore"
+	"beaver/relstore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestDB(t *testing.T) *relstore.DB {
+	kv := kvstore.ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"))
+	assert.Nil(t, kv.Open())
+	t.Cleanup(func() { kv.Close() })
+	db := relstore.NewDB(kv)
+	assert.Nil(t, db.CreateTable(&relstore.TableDef{
+		Name: "users",
+		Columns: []relstore.Column{
+			{Name: "org", Type: relstore.TYPE_STRING},
+			{Name: "id", Type: relstore.TYPE_INT64},
+			{Name: "name", Type: relstore.TYPE_STRING},
+			{Name: "score", Type: relstore.TYPE_FLOAT64},
+		},
+		PKeys: 2,
+		Indexes: []relstore.IndexDef{
+			{Name: "by_name", Columns: []string{"name"}, Unique: true},
+			{Name: "by_score", Columns: []string{"score"}},
+		},
+	}))
+	return db
+}
+
+func mustExec(t *testing.T, db *relstore.DB, src string) *Result {
+	res, err := Exec(db, src)
+	assert.Nil(t, err, src)
+	return res
+}
+
+func column(res *Result, i int) []any {
+	vals := []any{}
+	for _, row := range res.Rows {
+		vals = append(vals, row[i])
+	}
+	return vals
+}
+
+func fillUsers(t *testing.T, db *relstore.DB) {
+	src := "INSERT INTO users (org, id, name, score) VALUES "
+	for i := 0; i < 20; i++ {
+		if i > 0 {
+			src += ", "
+		}
+		src += fmt.Sprintf("('%s', %d, 'user%02d', %d.5)", []string{"acme", "initech"}[i%2], i, i, i%5)
+	}
+	assert.Equal(t, 20, mustExec(t, db, src).Affected)
+}
+
+func TestSelect(t *testing.T) {
+	db := openTestDB(t)
+	fillUsers(t, db)
+
+	res := mustExec(t, db, "SELECT * FROM users")
+	assert.Equal(t, []string{"org", "id", "name", "score"}, res.Columns)
+	assert.Len(t, res.Rows, 20)
+
+	res = mustExec(t, db, "SELECT id FROM users WHERE org = 'initech' AND id >= 5 AND id < 11")
+	assert.Equal(t, []any{int64(5), int64(7), int64(9)}, column(res, 0))
+
+	res = mustExec(t, db, "SELECT id, score FROM users WHERE score > 4 ORDER BY id DESC LIMIT 3")
+	assert.Equal(t, []any{int64(19), int64(14), int64(9)}, column(res, 0))
+	assert.Equal(t, []any{4.5, 4.5, 4.5}, column(res, 1))
+
+	res = mustExec(t, db, "SELECT name FROM users WHERE 'user07' = name OR name = 'user08' ORDER BY name")
+	assert.Equal(t, []any{"user07", "user08"}, column(res, 0))
+
+	res = mustExec(t, db, "SELECT id FROM users WHERE score * 2 = 1 AND org != 'acme'")
+	assert.Equal(t, []any{int64(5), int64(15)}, column(res, 0))
+
+	res = mustExec(t, db, "SELECT id FROM users WHERE org = 'acme' ORDER BY score DESC, id LIMIT 4")
+	assert.Equal(t, []any{int64(4), int64(14), int64(8), int64(18)}, column(res, 0))
+
+	_, err := Exec(db, "SELECT nope FROM users")
+	assert.ErrorIs(t, err, ErrNoColumn)
+	_, err = Exec(db, "SELECT * FROM users WHERE name = 3")
+	assert.ErrorIs(t, err, ErrType)
+	_, err = Exec(db, "SELECT * FROM groups")
+	assert.ErrorIs(t, err, relstore.ErrTableNotFound)
+}
+
+func TestPlan(t *testing.T) {
+	db := openTestDB(t)
+	def, err := db.Table("users")
+	assert.Nil(t, err)
+	where := func(src string) Expr {
+		stmt, err := Parse("SELECT * FROM users WHERE " + src)
+		assert.Nil(t, err)
+		return stmt.(*Select).Where
+	}
+
+	for _, c := range []struct {
+		where string
+		index string
+		r     relstore.Range
+	}{
+		{"org = 'a' AND id > 3", "", relstore.Range{Start: []any{"a", int64(3)}, ExcludeStart: true, End: []any{"a"}, IncludeEnd: true}},
+		{"org = 'a' AND id = 3", "", relstore.Range{Start: []any{"a", int64(3)}, End: []any{"a", int64(3)}, IncludeEnd: true}},
+		{"id = 3", "", relstore.Range{}},
+		{"name = 'x' AND org < 'b'", "by_name", relstore.Range{Start: []any{"x"}, End: []any{"x"}, IncludeEnd: true}},
+		{"score <= 2 AND 1 < score", "by_score", relstore.Range{Start: []any{1.0}, ExcludeStart: true, End: []any{2.0}, IncludeEnd: true}},
+		{"org = 'a' OR name = 'x'", "", relstore.Range{}},
+		{"name = 3", "", relstore.Range{}},
+	} {
+		index, r := plan(def, where(c.where))
+		assert.Equal(t, c.index, index, c.where)
+		assert.Equal(t, c.r, r, c.where)
+	}
+}
+
+func TestWrites(t *testing.T) {
+	db := openTestDB(t)
+	fillUsers(t, db)
+
+	res := mustExec(t, db, "UPDATE users SET score = score + 10, name = name WHERE org = 'acme' AND id < 6")
+	assert.Equal(t, 3, res.Affected)
+	res = mustExec(t, db, "SELECT id, score FROM users WHERE score >= 10")
+	assert.Equal(t, []any{int64(0), int64(2), int64(4)}, column(res, 0))
+	assert.Equal(t, []any{10.5, 12.5, 14.5}, column(res, 1))
+
+	res = mustExec(t, db, "DELETE FROM users WHERE score < 1")
+	assert.Equal(t, 3, res.Affected)
+	res = mustExec(t, db, "SELECT id FROM users WHERE score < 1")
+	assert.Empty(t, res.Rows)
+
+	// a failing statement changes nothing
+	_, err := Exec(db, "INSERT INTO users (org, id, name) VALUES ('x', 1, 'new'), ('x', 2, 'user01')")
+	assert.ErrorIs(t, err, relstore.ErrUniqueViolation)
+	res = mustExec(t, db, "SELECT id FROM users WHERE org = 'x'")
+	assert.Empty(t, res.Rows)
+	_, err = Exec(db, "UPDATE users SET name = 'same'")
+	assert.ErrorIs(t, err, relstore.ErrUniqueViolation)
+	res = mustExec(t, db, "SELECT name FROM users WHERE name = 'same'")
+	assert.Empty(t, res.Rows)
+
+	_, err = Exec(db, "UPDATE users SET id = 1")
+	assert.ErrorIs(t, err, ErrType)
+	_, err = Exec(db, "UPDATE users SET score = 'high'")
+	assert.ErrorIs(t, err, relstore.ErrBadRecord)
+	_, err = Exec(db, "DELETE FROM users WHERE nope = 1")
+	assert.ErrorIs(t, err, ErrNoColumn)
+
+	res = mustExec(t, db, "DELETE FROM users")
+	assert.Equal(t, 17, res.Affected)
+}
+
+func TestNulls(t *testing.T) {
+	db := openTestDB(t)
+	mustExec(t, db, "INSERT INTO users (org, id, name) VALUES ('a', 1, 'x'), ('a', 2, NULL)")
+	mustExec(t, db, "INSERT INTO users (org, id, score) VALUES ('a', 3, 1.0)")
+
+	res := mustExec(t, db, "SELECT id FROM users WHERE score IS NULL")
+	assert.Equal(t, []any{int64(1), int64(2)}, column(res, 0))
+	res = mustExec(t, db, "SELECT id FROM users WHERE score < 5")
+	assert.Equal(t, []any{int64(3)}, column(res, 0))
+	res = mustExec(t, db, "SELECT id FROM users WHERE NOT (score < 5)")
+	assert.Empty(t, res.Rows)
+	res = mustExec(t, db, "SELECT id FROM users WHERE score < 5 OR name = 'x'")
+	assert.Equal(t, []any{int64(1), int64(3)}, column(res, 0))
+	res = mustExec(t, db, "SELECT id FROM users ORDER BY name DESC")
+	assert.Equal(t, []any{int64(1), int64(2), int64(3)}, column(res, 0))
+}
@@ -0,0 +1,171 @@
+package query
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrSyntax = errors.New("syntax error")
+
+type tokenKind int
+
+const (
+	TOKEN_EOF tokenKind = iota
+	TOKEN_IDENT
+	TOKEN_KEYWORD
+	TOKEN_NUMBER
+	TOKEN_STRING
+	TOKEN_BLOB
+	TOKEN_SYMBOL
+)
+
+type token struct {
+	kind tokenKind
+	text string // keywords are upper-cased, strings unquoted
+	val  any    // value of numbers and blobs
+	pos  int
+}
+
+var keywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "ORDER": true, "BY": true,
+	"ASC": true, "DESC": true, "LIMIT": true, "INSERT": true, "INTO": true,
+	"VALUES": true, "UPDATE": true, "SET": true, "DELETE": true, "AND": true,
+	"OR": true, "NOT": true, "IS": true, "NULL": true, "TRUE": true,
+	"FALSE": true,
+}
+
+// two-character symbols come first so they win over their first character
+var symbols = []string{"<=", ">=", "!=", "<>", "(", ")", ",", ";", "*", "=", "<", ">", "+", "-", "/"}
+
+func tokenize(src string) ([]token, error) {
+	tokens := []token{}
+	for pos := 0; pos < len(src); {
+		c := src[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+		case (c == 'x' || c == 'X') && pos+1 < len(src) && src[pos+1] == '\'':
+			text, end, err := quoted(src, pos+1)
+			if err != nil {
+				return nil, err
+			}
+			data, err := hex.DecodeString(text)
+			if err != nil {
+				return nil, fmt.Errorf("%w at %d: bad blob literal", ErrSyntax, pos)
+			}
+			tokens = append(tokens, token{kind: TOKEN_BLOB, text: text, val: data, pos: pos})
+			pos = end
+			continue
+		case isIdentStart(c):
+			end := pos
+			for end < len(src) && (isIdentStart(src[end]) || isDigit(src[end])) {
+				end++
+			}
+			word := src[pos:end]
+			if upper := strings.ToUpper(word); keywords[upper] {
+				tokens = append(tokens, token{kind: TOKEN_KEYWORD, text: upper, pos: pos})
+			} else {
+				tokens = append(tokens, token{kind: TOKEN_IDENT, text: word, pos: pos})
+			}
+			pos = end
+			continue
+		case isDigit(c) || (c == '.' && pos+1 < len(src) && isDigit(src[pos+1])):
+			tok, end, err := number(src, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			pos = end
+			continue
+		case c == '\'':
+			text, end, err := quoted(src, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: TOKEN_STRING, text: text, pos: pos})
+			pos = end
+			continue
+		}
+
+		matched := false
+		for _, sym := range symbols {
+			if strings.HasPrefix(src[pos:], sym) {
+				tokens = append(tokens, token{kind: TOKEN_SYMBOL, text: sym, pos: pos})
+				pos += len(sym)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("%w at %d: unexpected %q", ErrSyntax, pos, c)
+		}
+	}
+	return append(tokens, token{kind: TOKEN_EOF, pos: len(src)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// quoted reads the string starting with the quote at pos; a doubled quote
+// stands for one.
+func quoted(src string, pos int) (string, int, error) {
+	var sb strings.Builder
+	for i := pos + 1; i < len(src); i++ {
+		if src[i] != '\'' {
+			sb.WriteByte(src[i])
+			continue
+		}
+		if i+1 < len(src) && src[i+1] == '\'' {
+			sb.WriteByte('\'')
+			i++
+			continue
+		}
+		return sb.String(), i + 1, nil
+	}
+	return "", 0, fmt.Errorf("%w at %d: unterminated string", ErrSyntax, pos)
+}
+
+// number reads an integer, which becomes an int64 (or a uint64 if too large),
+// or a float64 if it has a fraction or an exponent.
+func number(src string, pos int) (token, int, error) {
+	end, isFloat := pos, false
+scan:
+	for ; end < len(src); end++ {
+		c := src[end]
+		switch {
+		case isDigit(c):
+		case c == '.' || c == 'e' || c == 'E':
+			isFloat = true
+		case (c == '+' || c == '-') && (src[end-1] == 'e' || src[end-1] == 'E'):
+		default:
+			break scan
+		}
+	}
+	text := src[pos:end]
+	tok := token{kind: TOKEN_NUMBER, text: text, pos: pos}
+	if !isFloat {
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			tok.val = i
+			return tok, end, nil
+		}
+		if u, err := strconv.ParseUint(text, 10, 64); err == nil {
+			tok.val = u
+			return tok, end, nil
+		}
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return tok, 0, fmt.Errorf("%w at %d: bad number %q", ErrSyntax, pos, text)
+	}
+	tok.val = f
+	return tok, end, nil
+}
@@ -0,0 +1,457 @@
+package query
+
+import (
+	"fmt"
+	"math"
+)
+
+// Statement is one of *Select, *Insert, *Update and *Delete.
+type Statement interface{}
+
+// Select reads rows of Table. Columns are the columns to return, all of
+// them if nil; Limit is -1 without a LIMIT clause.
+type Select struct {
+	Table   string
+	Columns []string
+	Where   Expr
+	OrderBy []OrderTerm
+	Limit   int
+}
+
+type OrderTerm struct {
+	Column string
+	Desc   bool
+}
+
+type Insert struct {
+	Table   string
+	Columns []string
+	Rows    [][]Expr
+}
+
+type Update struct {
+	Table string
+	Set   []Assignment
+	Where Expr
+}
+
+type Assignment struct {
+	Column string
+	Value  Expr
+}
+
+type Delete struct {
+	Table string
+	Where Expr
+}
+
+// Expr is one of Literal, ColumnRef, *Unary and *Binary.
+type Expr interface{}
+
+// Literal holds an int64, uint64, float64, string, []byte, bool or nil.
+type Literal struct {
+	Value any
+}
+
+type ColumnRef struct {
+	Name string
+}
+
+// Unary is NOT, - or the postfix IS NULL and IS NOT NULL.
+type Unary struct {
+	Op      string
+	Operand Expr
+}
+
+// Binary is AND, OR, a comparison or an arithmetic operator.
+type Binary struct {
+	Op          string
+	Left, Right Expr
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a single statement, optionally followed by a semicolon.
+// Keywords are case-insensitive, strings are single-quoted and x'0aff' is a
+// blob.
+func Parse(src string) (Statement, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	stmt, err := p.statement()
+	if err != nil {
+		return nil, err
+	}
+	p.symbol(";")
+	if tok := p.peek(); tok.kind != TOKEN_EOF {
+		return nil, p.errorf("unexpected %q after the statement", tok.text)
+	}
+	return stmt, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != TOKEN_EOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w at %d: %s", ErrSyntax, p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+// keyword and symbol consume the next token if it is the one given.
+func (p *parser) keyword(kw string) bool {
+	if tok := p.peek(); tok.kind == TOKEN_KEYWORD && tok.text == kw {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) symbol(sym string) bool {
+	if tok := p.peek(); tok.kind == TOKEN_SYMBOL && tok.text == sym {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.keyword(kw) {
+		return p.errorf("expected %s", kw)
+	}
+	return nil
+}
+
+func (p *parser) expectSymbol(sym string) error {
+	if !p.symbol(sym) {
+		return p.errorf("expected %q", sym)
+	}
+	return nil
+}
+
+func (p *parser) ident() (string, error) {
+	if tok := p.peek(); tok.kind == TOKEN_IDENT {
+		p.pos++
+		return tok.text, nil
+	}
+	return "", p.errorf("expected a name")
+}
+
+func (p *parser) identList() ([]string, error) {
+	names := []string{}
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.symbol(",") {
+			return names, nil
+		}
+	}
+}
+
+func (p *parser) statement() (Statement, error) {
+	switch {
+	case p.keyword("SELECT"):
+		return p.selectStmt()
+	case p.keyword("INSERT"):
+		return p.insertStmt()
+	case p.keyword("UPDATE"):
+		return p.updateStmt()
+	case p.keyword("DELETE"):
+		return p.deleteStmt()
+	}
+	return nil, p.errorf("expected SELECT, INSERT, UPDATE or DELETE")
+}
+
+func (p *parser) selectStmt() (*Select, error) {
+	stmt := &Select{Limit: -1}
+	if !p.symbol("*") {
+		cols, err := p.identList()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Columns = cols
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Table = table
+	if stmt.Where, err = p.where(); err != nil {
+		return nil, err
+	}
+
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			term := OrderTerm{Column: col}
+			if !p.keyword("ASC") {
+				term.Desc = p.keyword("DESC")
+			}
+			stmt.OrderBy = append(stmt.OrderBy, term)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		tok := p.next()
+		n, ok := tok.val.(int64)
+		if tok.kind != TOKEN_NUMBER || !ok || n < 0 || n > math.MaxInt32 {
+			return nil, p.errorf("bad LIMIT %q", tok.text)
+		}
+		stmt.Limit = int(n)
+	}
+	return stmt, nil
+}
+
+func (p *parser) insertStmt() (*Insert, error) {
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &Insert{Table: table}
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	if stmt.Columns, err = p.identList(); err != nil {
+		return nil, err
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		row := []Expr{}
+		for {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, e)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		if len(row) != len(stmt.Columns) {
+			return nil, p.errorf("%d values for %d columns", len(row), len(stmt.Columns))
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.symbol(",") {
+			return stmt, nil
+		}
+	}
+}
+
+func (p *parser) updateStmt() (*Update, error) {
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &Update{Table: table}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		val, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Set = append(stmt.Set, Assignment{Column: col, Value: val})
+		if !p.symbol(",") {
+			break
+		}
+	}
+	stmt.Where, err = p.where()
+	return stmt, err
+}
+
+func (p *parser) deleteStmt() (*Delete, error) {
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	stmt := &Delete{Table: table}
+	stmt.Where, err = p.where()
+	return stmt, err
+}
+
+// where parses an optional WHERE clause.
+func (p *parser) where() (Expr, error) {
+	if !p.keyword("WHERE") {
+		return nil, nil
+	}
+	return p.expr()
+}
+
+// Operators by increasing precedence: OR, AND, NOT, comparisons and IS,
+// + and -, * and /, unary minus.
+func (p *parser) expr() (Expr, error) {
+	return p.binary(0)
+}
+
+var binaryLevels = [][]string{
+	{"OR"},
+	{"AND"},
+	nil, // NOT
+	{"=", "!=", "<>", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+func (p *parser) binary(level int) (Expr, error) {
+	if level == len(binaryLevels) {
+		return p.unary()
+	}
+	if binaryLevels[level] == nil {
+		if p.keyword("NOT") {
+			operand, err := p.binary(level)
+			return &Unary{Op: "NOT", Operand: operand}, err
+		}
+		return p.binary(level + 1)
+	}
+
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if level == 3 && p.keyword("IS") {
+			op := "IS NULL"
+			if p.keyword("NOT") {
+				op = "IS NOT NULL"
+			}
+			if err := p.expectKeyword("NULL"); err != nil {
+				return nil, err
+			}
+			left = &Unary{Op: op, Operand: left}
+			continue
+		}
+		op, ok := p.operator(binaryLevels[level])
+		if !ok {
+			return left, nil
+		}
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Op: op, Left: left, Right: right}
+	}
+}
+
+func (p *parser) operator(ops []string) (string, bool) {
+	for _, op := range ops {
+		if p.keyword(op) || p.symbol(op) {
+			if op == "<>" {
+				return "!=", true
+			}
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) unary() (Expr, error) {
+	if p.symbol("-") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		// fold negative numbers, the planner only knows literals
+		if lit, ok := operand.(Literal); ok {
+			switch v := lit.Value.(type) {
+			case int64:
+				if v != math.MinInt64 {
+					return Literal{Value: -v}, nil
+				}
+			case uint64:
+				if v == 1<<63 {
+					return Literal{Value: int64(math.MinInt64)}, nil
+				}
+			case float64:
+				return Literal{Value: -v}, nil
+			}
+		}
+		return &Unary{Op: "-", Operand: operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (Expr, error) {
+	tok := p.next()
+	switch tok.kind {
+	case TOKEN_NUMBER, TOKEN_BLOB:
+		return Literal{Value: tok.val}, nil
+	case TOKEN_STRING:
+		return Literal{Value: tok.text}, nil
+	case TOKEN_IDENT:
+		return ColumnRef{Name: tok.text}, nil
+	case TOKEN_KEYWORD:
+		switch tok.text {
+		case "NULL":
+			return Literal{Value: nil}, nil
+		case "TRUE":
+			return Literal{Value: true}, nil
+		case "FALSE":
+			return Literal{Value: false}, nil
+		}
+	case TOKEN_SYMBOL:
+		if tok.text == "(" {
+			e, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expectSymbol(")")
+		}
+	}
+	if tok.kind == TOKEN_EOF {
+		return nil, p.errorf("unexpected end of statement")
+	}
+	p.pos--
+	return nil, p.errorf("unexpected %q", tok.text)
+}
@@ -0,0 +1,89 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelect(t *testing.T) {
+	stmt, err := Parse("select id, name FROM users WHERE org = 'acme' AND NOT (score >= -1.5 OR name IS NULL) ORDER BY score DESC, id LIMIT 10;")
+	assert.Nil(t, err)
+	assert.Equal(t, &Select{
+		Table:   "users",
+		Columns: []string{"id", "name"},
+		Where: &Binary{Op: "AND",
+			Left: &Binary{Op: "=", Left: ColumnRef{Name: "org"}, Right: Literal{Value: "acme"}},
+			Right: &Unary{Op: "NOT", Operand: &Binary{Op: "OR",
+				Left:  &Binary{Op: ">=", Left: ColumnRef{Name: "score"}, Right: Literal{Value: -1.5}},
+				Right: &Unary{Op: "IS NULL", Operand: ColumnRef{Name: "name"}},
+			}},
+		},
+		OrderBy: []OrderTerm{{Column: "score", Desc: true}, {Column: "id"}},
+		Limit:   10,
+	}, stmt)
+
+	stmt, err = Parse("SELECT * FROM t")
+	assert.Nil(t, err)
+	assert.Equal(t, &Select{Table: "t", Limit: -1}, stmt)
+}
+
+func TestParseExpr(t *testing.T) {
+	stmt, err := Parse("DELETE FROM t WHERE a + 2 * b <> x'00ff' OR c = 'it''s' AND d = TRUE")
+	assert.Nil(t, err)
+	assert.Equal(t, &Binary{Op: "OR",
+		Left: &Binary{Op: "!=",
+			Left:  &Binary{Op: "+", Left: ColumnRef{Name: "a"}, Right: &Binary{Op: "*", Left: Literal{Value: int64(2)}, Right: ColumnRef{Name: "b"}}},
+			Right: Literal{Value: []byte{0, 0xff}},
+		},
+		Right: &Binary{Op: "AND",
+			Left:  &Binary{Op: "=", Left: ColumnRef{Name: "c"}, Right: Literal{Value: "it's"}},
+			Right: &Binary{Op: "=", Left: ColumnRef{Name: "d"}, Right: Literal{Value: true}},
+		},
+	}, stmt.(*Delete).Where)
+
+	stmt, err = Parse("DELETE FROM t WHERE n = 18446744073709551615 AND m = -9223372036854775808 AND f = 1e3")
+	assert.Nil(t, err)
+	terms := conjuncts(stmt.(*Delete).Where)
+	assert.Equal(t, Literal{Value: uint64(18446744073709551615)}, terms[0].(*Binary).Right)
+	assert.Equal(t, Literal{Value: int64(-9223372036854775808)}, terms[1].(*Binary).Right)
+	assert.Equal(t, Literal{Value: 1000.0}, terms[2].(*Binary).Right)
+}
+
+func TestParseWrites(t *testing.T) {
+	stmt, err := Parse("INSERT INTO t (a, b) VALUES (1, 'x'), (2, NULL)")
+	assert.Nil(t, err)
+	assert.Equal(t, &Insert{Table: "t", Columns: []string{"a", "b"}, Rows: [][]Expr{
+		{Literal{Value: int64(1)}, Literal{Value: "x"}},
+		{Literal{Value: int64(2)}, Literal{Value: nil}},
+	}}, stmt)
+
+	stmt, err = Parse("UPDATE t SET a = a + 1, b = 'y' WHERE a < 3")
+	assert.Nil(t, err)
+	assert.Equal(t, &Update{Table: "t",
+		Set: []Assignment{
+			{Column: "a", Value: &Binary{Op: "+", Left: ColumnRef{Name: "a"}, Right: Literal{Value: int64(1)}}},
+			{Column: "b", Value: Literal{Value: "y"}},
+		},
+		Where: &Binary{Op: "<", Left: ColumnRef{Name: "a"}, Right: Literal{Value: int64(3)}},
+	}, stmt)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"SELEC * FROM t",
+		"SELECT * FROM",
+		"SELECT * FROM t WHERE",
+		"SELECT * FROM t WHERE a = 'open",
+		"SELECT * FROM t LIMIT -1",
+		"SELECT * FROM t extra",
+		"INSERT INTO t (a, b) VALUES (1)",
+		"UPDATE t SET a 1",
+		"DELETE FROM t WHERE a = x'0g'",
+		"SELECT * FROM t WHERE a # 1",
+	} {
+		_, err := Parse(src)
+		assert.ErrorIs(t, err, ErrSyntax, src)
+	}
+}
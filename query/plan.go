@@ -0,0 +1,154 @@
+package query
+
+import (
+	"beaver/relstore"
+)
+
+// bounds gathers what the WHERE clause says about a column: its value, or
+// a lower and an upper bound.
+type bounds struct {
+	eq           any
+	hasEq        bool
+	lower, upper *bound
+}
+
+type bound struct {
+	val       any
+	inclusive bool
+}
+
+// plan chooses how to read the rows a WHERE clause may select: through the
+// primary key ("") or an index, over a range of it. Only the comparisons of
+// a column with a literal joined by AND narrow the range; the rows are
+// filtered by the whole clause afterwards anyway.
+//
+// The key whose leading columns are most constrained wins: every column
+// compared with = counts 2, and can be followed by one bounded by <, <=, >
+// or >=, which counts 1. The primary key wins ties.
+func plan(def *relstore.TableDef, where Expr) (string, relstore.Range) {
+	cons := constraints(def, where)
+	best, bestCols, bestScore := "", def.Columns[:def.PKeys], score(def.Columns[:def.PKeys], cons)
+	for _, index := range def.Indexes {
+		cols := indexColumns(def, &index)
+		if s := score(cols, cons); s > bestScore {
+			best, bestCols, bestScore = index.Name, cols, s
+		}
+	}
+	if bestScore == 0 {
+		return "", relstore.Range{}
+	}
+	return best, keyRange(bestCols, cons)
+}
+
+func indexColumns(def *relstore.TableDef, index *relstore.IndexDef) []relstore.Column {
+	cols := []relstore.Column{}
+	for _, name := range index.Columns {
+		col, _, _ := def.Column(name)
+		cols = append(cols, col)
+	}
+	return cols
+}
+
+func score(cols []relstore.Column, cons map[string]*bounds) int {
+	s := 0
+	for _, col := range cols {
+		b := cons[col.Name]
+		switch {
+		case b == nil:
+			return s
+		case b.hasEq:
+			s += 2
+			continue
+		case b.lower != nil || b.upper != nil:
+			return s + 1
+		}
+		return s
+	}
+	return s
+}
+
+func keyRange(cols []relstore.Column, cons map[string]*bounds) relstore.Range {
+	var eqs []any
+	for _, col := range cols {
+		b := cons[col.Name]
+		if b != nil && b.hasEq {
+			eqs = append(eqs, b.eq)
+			continue
+		}
+
+		r := relstore.Range{}
+		if len(eqs) > 0 {
+			r = relstore.Range{Start: eqs, End: eqs, IncludeEnd: true}
+		}
+		if b != nil && b.lower != nil {
+			r.Start = append(eqs[:len(eqs):len(eqs)], b.lower.val)
+			r.ExcludeStart = !b.lower.inclusive
+		}
+		if b != nil && b.upper != nil {
+			r.End = append(eqs[:len(eqs):len(eqs)], b.upper.val)
+			r.IncludeEnd = b.upper.inclusive
+		}
+		return r
+	}
+	return relstore.Range{Start: eqs, End: eqs, IncludeEnd: true}
+}
+
+// flipped turns "literal op column" into "column op literal"
+var flipped = map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// constraints collects the bounds set by the comparisons in the AND-ed
+// terms of where. Literals that don't fit the type of their column are left
+// to the filter.
+func constraints(def *relstore.TableDef, where Expr) map[string]*bounds {
+	cons := map[string]*bounds{}
+	for _, term := range conjuncts(where) {
+		bin, ok := term.(*Binary)
+		if !ok {
+			continue
+		}
+		ref, isRef := bin.Left.(ColumnRef)
+		lit, isLit := bin.Right.(Literal)
+		op := bin.Op
+		if !isRef || !isLit {
+			ref, isRef = bin.Right.(ColumnRef)
+			lit, isLit = bin.Left.(Literal)
+			op = flipped[op]
+		}
+		if _, isCmp := flipped[op]; !isRef || !isLit || !isCmp || lit.Value == nil {
+			continue
+		}
+		col, _, ok := def.Column(ref.Name)
+		if !ok {
+			continue
+		}
+		val, ok := col.Type.Convert(lit.Value)
+		if !ok {
+			continue
+		}
+
+		b := cons[col.Name]
+		if b == nil {
+			b = &bounds{}
+			cons[col.Name] = b
+		}
+		switch op {
+		case "=":
+			b.eq, b.hasEq = val, true
+		case ">", ">=":
+			b.lower = &bound{val: val, inclusive: op == ">="}
+		case "<", "<=":
+			b.upper = &bound{val: val, inclusive: op == "<="}
+		}
+	}
+	return cons
+}
+
+func conjuncts(e Expr) []Expr {
+	if bin, ok := e.(*Binary); ok && bin.Op == "AND" {
+		return append(conjuncts(bin.Left), conjuncts(bin.Right)...)
+	}
+	if e == nil {
+		return nil
+	}
+	return []Expr{e}
+}
@@ -0,0 +1,282 @@
+// Package relstore is a table layer over kvstore.KV: tables with typed
+// columns, a primary key and secondary indexes, whose rows and index
+// entries are stored as KV pairs under per-table and per-index key
+// prefixes. Table definitions are kept in a catalog in the same
+// KV (see CATALOG_META).
+package relstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"beaver/btreeplus"
+	"beaver/kvstore"
+	"beaver/tuple"
+)
+
+var (
+	ErrRowExists       = errors.New("row already exists")
+	ErrRowNotFound     = errors.New("row not found")
+	ErrUniqueViolation = errors.New("duplicate value in unique index")
+)
+
+// DB wraps an open KV, which it doesn't own: the caller opens and closes it.
+type DB struct {
+	kv     *kvstore.KV
+	mu     sync.Mutex
+	tables map[string]*TableDef // committed definitions read so far
+}
+
+func NewDB(kv *kvstore.KV) *DB {
+	return &DB{kv: kv, tables: map[string]*TableDef{}}
+}
+
+// what reading a row needs, from either kind of KV transaction
+type kvReader interface {
+	Get(key btreeplus.ByteArr) (btreeplus.ByteArr, error)
+	Scan(start, end btreeplus.ByteArr, opts kvstore.ScanOptions) ([]kvstore.KVPair, error)
+}
+
+// Tx groups table updates in a single KV transaction. Like kvstore.Tx, it
+// must be ended with Commit or Abort.
+type Tx struct {
+	db      *DB
+	kv      *kvstore.Tx
+	created map[string]*TableDef
+}
+
+func (db *DB) Begin() *Tx {
+	return &Tx{db: db, kv: db.kv.Begin(), created: map[string]*TableDef{}}
+}
+
+func (tx *Tx) Commit() error {
+	if err := tx.kv.Commit(); err != nil {
+		return err
+	}
+	tx.db.mu.Lock()
+	for name, def := range tx.created {
+		tx.db.tables[name] = def
+	}
+	tx.db.mu.Unlock()
+	return nil
+}
+
+func (tx *Tx) Abort() {
+	tx.kv.Abort()
+}
+
+// update runs fn in a transaction of its own.
+func (db *DB) update(fn func(tx *Tx) error) error {
+	tx := db.Begin()
+	if err := fn(tx); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) CreateTable(def *TableDef) error {
+	return db.update(func(tx *Tx) error { return tx.CreateTable(def) })
+}
+
+// Table returns the definition of a committed table.
+func (db *DB) Table(name string) (*TableDef, error) {
+	rtx := db.kv.BeginRead()
+	defer rtx.End()
+	return db.table(rtx, name)
+}
+
+func (db *DB) Insert(table string, rec Record) error {
+	return db.update(func(tx *Tx) error { return tx.Insert(table, rec) })
+}
+
+func (db *DB) Update(table string, rec Record) error {
+	return db.update(func(tx *Tx) error { return tx.Update(table, rec) })
+}
+
+func (db *DB) Upsert(table string, rec Record) error {
+	return db.update(func(tx *Tx) error { return tx.Upsert(table, rec) })
+}
+
+func (db *DB) Delete(table string, rec Record) (deleted bool, err error) {
+	err = db.update(func(tx *Tx) error {
+		deleted, err = tx.Delete(table, rec)
+		return err
+	})
+	return deleted, err
+}
+
+// Get looks up the row with the primary key of rec, in the last committed
+// version of the table.
+func (db *DB) Get(table string, rec Record) (Record, bool, error) {
+	rtx := db.kv.BeginRead()
+	defer rtx.End()
+	def, err := db.table(rtx, table)
+	if err != nil {
+		return nil, false, err
+	}
+	return getRow(rtx, def, rec)
+}
+
+func getRow(kv kvReader, def *TableDef, rec Record) (Record, bool, error) {
+	key, err := encodeKey(def, rec)
+	if err != nil {
+		return nil, false, err
+	}
+	val, err := kv.Get(key)
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	row, err := decodeRow(def, key, val)
+	return row, err == nil, err
+}
+
+// Get sees the changes made earlier in the transaction.
+func (tx *Tx) Get(table string, rec Record) (Record, bool, error) {
+	def, err := tx.table(table)
+	if err != nil {
+		return nil, false, err
+	}
+	return getRow(tx.kv, def, rec)
+}
+
+const (
+	MODE_UPSERT = iota // insert or replace
+	MODE_INSERT        // only add a new row
+	MODE_UPDATE        // only change an existing row
+)
+
+// Insert adds a row; columns missing from rec are null. It fails with
+// ErrRowExists if the primary key is taken.
+func (tx *Tx) Insert(table string, rec Record) error {
+	return tx.write(table, rec, MODE_INSERT)
+}
+
+// Update changes the columns present in rec of the row with its primary
+// key, keeping the others. It fails with ErrRowNotFound if there is no
+// such row.
+func (tx *Tx) Update(table string, rec Record) error {
+	return tx.write(table, rec, MODE_UPDATE)
+}
+
+// Upsert stores rec whether or not its primary key exists, replacing the
+// whole row if it does.
+func (tx *Tx) Upsert(table string, rec Record) error {
+	return tx.write(table, rec, MODE_UPSERT)
+}
+
+func (tx *Tx) write(table string, rec Record, mode int) error {
+	def, err := tx.table(table)
+	if err != nil {
+		return err
+	}
+	old, exists, err := getRow(tx.kv, def, rec)
+	if err != nil {
+		return err
+	}
+	switch {
+	case mode == MODE_INSERT && exists:
+		return fmt.Errorf("%w: %s", ErrRowExists, def.Name)
+	case mode == MODE_UPDATE && !exists:
+		return fmt.Errorf("%w: %s", ErrRowNotFound, def.Name)
+	}
+	if mode == MODE_UPDATE {
+		merged := Record{}
+		for name, v := range old {
+			merged[name] = v
+		}
+		for name, v := range rec {
+			merged[name] = v
+		}
+		rec = merged
+	}
+
+	key, err := encodeKey(def, rec)
+	if err != nil {
+		return err
+	}
+	val, err := encodeVal(def, rec)
+	if err != nil {
+		return err
+	}
+
+	// everything is checked before the first change, so that a failed
+	// write leaves the transaction as it was
+	entries := make([][]byte, 0, len(def.Indexes))
+	for i := range def.Indexes {
+		index := &def.Indexes[i]
+		vals, pkey, hasNull, err := encodeIndexKey(def, index, rec, key)
+		if err != nil {
+			return err
+		}
+		if index.Unique && !hasNull {
+			if err := checkUnique(tx.kv, def, index, vals, pkey); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, append(vals, pkey...))
+	}
+
+	if exists {
+		if err := deleteIndexEntries(tx.kv, def, old, key); err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		if err := tx.kv.Set(entry, []byte{}); err != nil {
+			return err
+		}
+	}
+	return tx.kv.Set(key, val)
+}
+
+// checkUnique fails if another row than pkey has the indexed values vals.
+func checkUnique(kv kvReader, def *TableDef, index *IndexDef, vals, pkey []byte) error {
+	entries, err := kv.Scan(vals, tuple.PrefixEnd(vals), kvstore.ScanOptions{Limit: 2})
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !bytes.Equal(entry.Key[len(vals):], pkey) {
+			return fmt.Errorf("%w: %s.%s", ErrUniqueViolation, def.Name, index.Name)
+		}
+	}
+	return nil
+}
+
+func deleteIndexEntries(kv *kvstore.Tx, def *TableDef, row Record, key []byte) error {
+	for i := range def.Indexes {
+		vals, pkey, _, err := encodeIndexKey(def, &def.Indexes[i], row, key)
+		if err != nil {
+			return err
+		}
+		if _, err := kv.Del(append(vals, pkey...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the row with the primary key of rec.
+func (tx *Tx) Delete(table string, rec Record) (bool, error) {
+	def, err := tx.table(table)
+	if err != nil {
+		return false, err
+	}
+	key, err := encodeKey(def, rec)
+	if err != nil {
+		return false, err
+	}
+	old, exists, err := getRow(tx.kv, def, rec)
+	if err != nil || !exists {
+		return false, err
+	}
+	if err := deleteIndexEntries(tx.kv, def, old, key); err != nil {
+		return false, err
+	}
+	return tx.kv.Del(key)
+}
@@ -0,0 +1,144 @@
+package relstore
+
+import (
+	"path/filepath"
+	"testing"
+
+	"beaver/kvstore"
+	"beaver/tuple"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestDB(t *testing.T) *DB {
+	kv := kvstore.ProvisionKV(filepath.Join(t.TempDir(), "kvstore.data"))
+	assert.Nil(t, kv.Open())
+	t.Cleanup(func() { kv.Close() })
+	return NewDB(kv)
+}
+
+func usersDef() *TableDef {
+	return &TableDef{
+		Name: "users",
+		Columns: []Column{
+			{Name: "org", Type: TYPE_STRING},
+			{Name: "id", Type: TYPE_INT64},
+			{Name: "name", Type: TYPE_STRING},
+			{Name: "score", Type: TYPE_FLOAT64},
+			{Name: "avatar", Type: TYPE_BYTES},
+		},
+		PKeys: 2,
+	}
+}
+
+func TestCreateTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvstore.data")
+	kv := kvstore.ProvisionKV(path)
+	assert.Nil(t, kv.Open())
+	db := NewDB(kv)
+	assert.Nil(t, db.CreateTable(usersDef()))
+	assert.Nil(t, db.CreateTable(&TableDef{Name: "tags", Columns: []Column{{Name: "tag", Type: TYPE_STRING}}, PKeys: 1}))
+	assert.ErrorIs(t, db.CreateTable(usersDef()), ErrTableExists)
+
+	for _, def := range []*TableDef{
+		{Name: "@catalog", Columns: []Column{{Name: "a", Type: TYPE_STRING}}, PKeys: 1},
+		{Name: "nokey", Columns: []Column{{Name: "a", Type: TYPE_STRING}}, PKeys: 0},
+		{Name: "dup", Columns: []Column{{Name: "a", Type: TYPE_STRING}, {Name: "a", Type: TYPE_BOOL}}, PKeys: 1},
+		{Name: "badtype", Columns: []Column{{Name: "a", Type: 42}}, PKeys: 1},
+	} {
+		assert.ErrorIs(t, db.CreateTable(def), ErrBadSchema, def.Name)
+	}
+
+	// the catalog is stored in the KV
+	assert.Nil(t, kv.Close())
+	kv = kvstore.ProvisionKV(path)
+	assert.Nil(t, kv.Open())
+	defer kv.Close()
+	db = NewDB(kv)
+	def, err := db.Table("users")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(TABLE_PREFIX_MIN), def.Prefix)
+	assert.Equal(t, usersDef().Columns, def.Columns)
+	def, err = db.Table("tags")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(TABLE_PREFIX_MIN+1), def.Prefix)
+	_, err = db.Table("nope")
+	assert.ErrorIs(t, err, ErrTableNotFound)
+}
+
+func TestRecords(t *testing.T) {
+	db := openTestDB(t)
+	assert.Nil(t, db.CreateTable(usersDef()))
+
+	assert.Nil(t, db.Insert("users", Record{"org": "acme", "id": 1, "name": "ann", "score": 3}))
+	assert.ErrorIs(t, db.Insert("users", Record{"org": "acme", "id": 1}), ErrRowExists)
+	assert.Nil(t, db.Insert("users", Record{"org": "acme", "id": 2, "name": "bob"}))
+
+	row, ok, err := db.Get("users", Record{"org": "acme", "id": 1})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, Record{"org": "acme", "id": int64(1), "name": "ann", "score": 3.0, "avatar": nil}, row)
+
+	// Update keeps the columns it isn't given, Upsert doesn't
+	assert.Nil(t, db.Update("users", Record{"org": "acme", "id": 1, "avatar": []byte{1, 2}}))
+	row, _, _ = db.Get("users", Record{"org": "acme", "id": 1})
+	assert.Equal(t, "ann", row["name"])
+	assert.Equal(t, []byte{1, 2}, row["avatar"])
+	assert.ErrorIs(t, db.Update("users", Record{"org": "acme", "id": 3, "name": "cy"}), ErrRowNotFound)
+
+	assert.Nil(t, db.Upsert("users", Record{"org": "acme", "id": 1, "name": "ann b."}))
+	assert.Nil(t, db.Upsert("users", Record{"org": "acme", "id": 3, "name": "cy"}))
+	row, _, _ = db.Get("users", Record{"org": "acme", "id": 1})
+	assert.Equal(t, Record{"org": "acme", "id": int64(1), "name": "ann b.", "score": nil, "avatar": nil}, row)
+
+	deleted, err := db.Delete("users", Record{"org": "acme", "id": 2})
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	_, ok, err = db.Get("users", Record{"org": "acme", "id": 2})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// records are checked against the schema
+	assert.ErrorIs(t, db.Insert("users", Record{"org": "acme", "id": "x"}), ErrBadRecord)
+	assert.ErrorIs(t, db.Insert("users", Record{"org": "acme", "id": 4, "age": 3}), ErrBadRecord)
+	assert.ErrorIs(t, db.Insert("users", Record{"org": "acme"}), ErrBadRecord)
+	assert.ErrorIs(t, db.Insert("groups", Record{"id": 1}), ErrTableNotFound)
+}
+
+func TestTx(t *testing.T) {
+	db := openTestDB(t)
+
+	tx := db.Begin()
+	def := usersDef()
+	assert.Nil(t, tx.CreateTable(def))
+	assert.Zero(t, def.Prefix, "the caller's definition is left alone")
+	created, err := tx.Table("users")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(TABLE_PREFIX_MIN), created.Prefix)
+	assert.Nil(t, tx.Insert("users", Record{"org": "acme", "id": 1, "name": "ann"}))
+	row, ok, err := tx.Get("users", Record{"org": "acme", "id": 1})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "ann", row["name"])
+	tx.Abort()
+
+	// neither the table nor the row survive the abort
+	_, err = db.Table("users")
+	assert.ErrorIs(t, err, ErrTableNotFound)
+
+	tx = db.Begin()
+	assert.Nil(t, tx.CreateTable(usersDef()))
+	assert.Nil(t, tx.Insert("users", Record{"org": "acme", "id": 1, "name": "ann"}))
+	assert.Nil(t, tx.Commit())
+	row, ok, err = db.Get("users", Record{"org": "acme", "id": 1})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "ann", row["name"])
+}
+
+func TestBadCatalog(t *testing.T) {
+	db := openTestDB(t)
+	next, _ := tuple.Encode("not a prefix")
+	assert.Nil(t, db.kv.Set(catalogKey(CATALOG_META, "next_prefix"), next))
+	assert.ErrorIs(t, db.CreateTable(usersDef()), kvstore.ErrCorrupt)
+}
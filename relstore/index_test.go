@@ -0,0 +1,154 @@
+package relstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func indexedUsersDef() *TableDef {
+	def := usersDef()
+	def.Indexes = []IndexDef{
+		{Name: "by_name", Columns: []string{"name"}, Unique: true},
+		{Name: "by_org_score", Columns: []string{"org", "score"}},
+	}
+	return def
+}
+
+func ids(rows []Record) []int64 {
+	res := []int64{}
+	for _, row := range rows {
+		res = append(res, row["id"].(int64))
+	}
+	return res
+}
+
+func TestIndexes(t *testing.T) {
+	db := openTestDB(t)
+	assert.Nil(t, db.CreateTable(indexedUsersDef()))
+	def, err := db.Table("users")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(TABLE_PREFIX_MIN+1), def.Indexes[0].Prefix)
+	assert.Equal(t, uint64(TABLE_PREFIX_MIN+2), def.Indexes[1].Prefix)
+
+	for i := 0; i < 10; i++ {
+		org := []string{"acme", "initech"}[i%2]
+		assert.Nil(t, db.Insert("users", Record{"org": org, "id": i, "name": fmt.Sprintf("user%d", i), "score": float64(i % 4)}))
+	}
+
+	rows, err := db.ScanIndex("users", "by_name", Range{Start: []any{"user3"}, End: []any{"user3"}, IncludeEnd: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{3}, ids(rows))
+
+	// by the leading column only, then by both
+	rows, err = db.ScanIndex("users", "by_org_score", Range{Start: []any{"acme"}, End: []any{"acme"}, IncludeEnd: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 4, 8, 2, 6}, ids(rows))
+	rows, err = db.ScanIndex("users", "by_org_score", Range{Start: []any{"acme", 0}, End: []any{"acme", 2}, ExcludeStart: true})
+	assert.Nil(t, err)
+	assert.Empty(t, ids(rows))
+	rows, err = db.ScanIndex("users", "by_org_score", Range{Start: []any{"initech", 1}, Reverse: true, Limit: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{7, 3, 9}, ids(rows))
+
+	// updates and deletes move the entries along
+	assert.Nil(t, db.Update("users", Record{"org": "initech", "id": 3, "score": 0.5}))
+	rows, _ = db.ScanIndex("users", "by_org_score", Range{Start: []any{"initech"}, End: []any{"initech", 1}})
+	assert.Equal(t, []int64{3}, ids(rows))
+	deleted, err := db.Delete("users", Record{"org": "acme", "id": 4})
+	assert.Nil(t, err)
+	assert.True(t, deleted)
+	rows, _ = db.ScanIndex("users", "by_name", Range{})
+	assert.Len(t, rows, 9)
+
+	_, err = db.ScanIndex("users", "by_age", Range{})
+	assert.ErrorIs(t, err, ErrIndexNotFound)
+}
+
+func TestUniqueIndex(t *testing.T) {
+	db := openTestDB(t)
+	assert.Nil(t, db.CreateTable(indexedUsersDef()))
+	assert.Nil(t, db.Insert("users", Record{"org": "acme", "id": 1, "name": "ann"}))
+
+	assert.ErrorIs(t, db.Insert("users", Record{"org": "acme", "id": 2, "name": "ann"}), ErrUniqueViolation)
+	assert.ErrorIs(t, db.Upsert("users", Record{"org": "initech", "id": 1, "name": "ann"}), ErrUniqueViolation)
+	// a row doesn't conflict with itself
+	assert.Nil(t, db.Update("users", Record{"org": "acme", "id": 1, "name": "ann", "score": 1}))
+	// nulls are never equal
+	assert.Nil(t, db.Insert("users", Record{"org": "acme", "id": 2}))
+	assert.Nil(t, db.Insert("users", Record{"org": "acme", "id": 3}))
+
+	// a failed write leaves nothing behind, even inside a transaction
+	tx := db.Begin()
+	assert.ErrorIs(t, tx.Update("users", Record{"org": "acme", "id": 2, "name": "ann"}), ErrUniqueViolation)
+	assert.Nil(t, tx.Commit())
+	rows, err := db.ScanIndex("users", "by_name", Range{})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2, 3, 1}, ids(rows))
+
+	// the name is free again once its row is renamed
+	assert.Nil(t, db.Update("users", Record{"org": "acme", "id": 1, "name": "anne"}))
+	assert.Nil(t, db.Update("users", Record{"org": "acme", "id": 2, "name": "ann"}))
+}
+
+func TestNulValues(t *testing.T) {
+	db := openTestDB(t)
+	def := usersDef()
+	def.Indexes = []IndexDef{
+		{Name: "by_name", Columns: []string{"name"}, Unique: true},
+		{Name: "by_avatar", Columns: []string{"avatar"}, Unique: true},
+	}
+	assert.Nil(t, db.CreateTable(def))
+
+	// a value isn't a duplicate of a longer one it is a prefix of up to a NUL
+	assert.Nil(t, db.Insert("users", Record{"org": "acme", "id": 1, "name": "a\x00b", "avatar": []byte{1, 0, 2}}))
+	assert.Nil(t, db.Insert("users", Record{"org": "acme", "id": 2, "name": "a", "avatar": []byte{1}}))
+	assert.Nil(t, db.Insert("users", Record{"org": "acme", "id": 3, "name": "a\x00", "avatar": []byte{1, 0}}))
+	assert.ErrorIs(t, db.Insert("users", Record{"org": "acme", "id": 4, "name": "a\x00"}), ErrUniqueViolation)
+	assert.ErrorIs(t, db.Insert("users", Record{"org": "acme", "id": 4, "avatar": []byte{1}}), ErrUniqueViolation)
+
+	for _, c := range []struct {
+		index string
+		r     Range
+		ids   []int64
+	}{
+		{"by_name", Range{Start: []any{"a"}, End: []any{"a"}, IncludeEnd: true}, []int64{2}},
+		{"by_name", Range{Start: []any{"a"}, ExcludeStart: true}, []int64{3, 1}},
+		{"by_name", Range{End: []any{"a\x00"}, IncludeEnd: true}, []int64{2, 3}},
+		{"by_avatar", Range{Start: []any{[]byte{1}}, End: []any{[]byte{1}}, IncludeEnd: true}, []int64{2}},
+		{"by_avatar", Range{Start: []any{[]byte{1}}, ExcludeStart: true}, []int64{3, 1}},
+		{"by_avatar", Range{End: []any{[]byte{1, 0}}, IncludeEnd: true}, []int64{2, 3}},
+	} {
+		rows, err := db.ScanIndex("users", c.index, c.r)
+		assert.Nil(t, err)
+		assert.Equal(t, c.ids, ids(rows), "%s %+v", c.index, c.r)
+	}
+}
+
+func TestScan(t *testing.T) {
+	db := openTestDB(t)
+	assert.Nil(t, db.CreateTable(usersDef()))
+	assert.Nil(t, db.CreateTable(&TableDef{Name: "tags", Columns: []Column{{Name: "tag", Type: TYPE_STRING}}, PKeys: 1}))
+	assert.Nil(t, db.Insert("tags", Record{"tag": "x"}))
+	for _, org := range []string{"acme", "globex", "initech"} {
+		for i := 0; i < 3; i++ {
+			assert.Nil(t, db.Insert("users", Record{"org": org, "id": i}))
+		}
+	}
+
+	// only the rows of the table
+	rows, err := db.Scan("users", Range{})
+	assert.Nil(t, err)
+	assert.Len(t, rows, 9)
+	rows, err = db.Scan("users", Range{Start: []any{"globex"}, End: []any{"globex"}, IncludeEnd: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{0, 1, 2}, ids(rows))
+	rows, err = db.Scan("users", Range{Start: []any{"acme"}, ExcludeStart: true, Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, "globex", rows[0]["org"])
+	assert.Len(t, rows, 2)
+
+	_, err = db.Scan("users", Range{Start: []any{"acme", 1, "extra"}})
+	assert.ErrorIs(t, err, ErrBadRecord)
+}
@@ -0,0 +1,193 @@
+package relstore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"beaver/tuple"
+)
+
+// Record is a row, by column name. Decoded records hold the Go type of each
+// ColumnType: int64, uint64, float64, string, []byte or bool, and nil for a
+// null.
+type Record map[string]any
+
+var ErrBadRecord = errors.New("record doesn't match the table")
+
+// A row is stored as
+//
+//	key: tuple(prefix, primary key columns...)
+//	val: tuple(other columns...)
+//
+// both in the order of TableDef.Columns, and each index entry as
+//
+//	key: tuple(index prefix, index columns..., primary key columns...)
+//	val: empty
+//
+// The primary key makes the entries of rows sharing the indexed values
+// distinct, and leads back to the row.
+func encodeKey(def *TableDef, rec Record) ([]byte, error) {
+	key, _ := tuple.Encode(def.Prefix)
+	for _, col := range def.Columns[:def.PKeys] {
+		v, err := columnValue(def, col, rec)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return nil, fmt.Errorf("%w: %s.%s: primary key column is missing", ErrBadRecord, def.Name, col.Name)
+		}
+		key, _ = tuple.Append(key, v)
+	}
+	return key, nil
+}
+
+// encodeIndexKey returns the entry of rec in index, split before the
+// primary key. hasNull tells if an indexed column is null.
+func encodeIndexKey(def *TableDef, index *IndexDef, rec Record, rowKey []byte) (vals, pkey []byte, hasNull bool, err error) {
+	vals, _ = tuple.Encode(index.Prefix)
+	for _, col := range def.columns(index.Columns) {
+		v, err := columnValue(def, col, rec)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		hasNull = hasNull || v == nil
+		vals, _ = tuple.Append(vals, v)
+	}
+	tablePrefix, _ := tuple.Encode(def.Prefix)
+	return vals, rowKey[len(tablePrefix):], hasNull, nil
+}
+
+// decodeIndexKey returns the primary key of the row of an index entry.
+func decodeIndexKey(def *TableDef, index *IndexDef, key []byte) (Record, error) {
+	elems, err := tuple.Decode(key)
+	if err != nil {
+		return nil, err
+	}
+	elems = elems[1:]
+	if len(elems) != len(index.Columns)+def.PKeys {
+		return nil, fmt.Errorf("%w: %s.%s: bad index entry", ErrBadRecord, def.Name, index.Name)
+	}
+	rec := Record{}
+	for i, col := range def.Columns[:def.PKeys] {
+		rec[col.Name] = elems[len(index.Columns)+i]
+	}
+	return rec, nil
+}
+
+// encodePrefix encodes prefix followed by the values of the leading cols,
+// as given by a Range bound.
+func encodePrefix(def *TableDef, prefix uint64, cols []Column, vals []any) ([]byte, error) {
+	if len(vals) > len(cols) {
+		return nil, fmt.Errorf("%w: %s: %d values for %d columns", ErrBadRecord, def.Name, len(vals), len(cols))
+	}
+	key, _ := tuple.Encode(prefix)
+	for i, v := range vals {
+		v, err := columnValue(def, cols[i], Record{cols[i].Name: v})
+		if err != nil {
+			return nil, err
+		}
+		key, _ = tuple.Append(key, v)
+	}
+	return key, nil
+}
+
+func encodeVal(def *TableDef, rec Record) ([]byte, error) {
+	for name := range rec {
+		if _, _, ok := def.Column(name); !ok {
+			return nil, fmt.Errorf("%w: %s has no column %q", ErrBadRecord, def.Name, name)
+		}
+	}
+	val := []byte{}
+	for _, col := range def.Columns[def.PKeys:] {
+		v, err := columnValue(def, col, rec)
+		if err != nil {
+			return nil, err
+		}
+		val, _ = tuple.Append(val, v)
+	}
+	return val, nil
+}
+
+func decodeRow(def *TableDef, key, val []byte) (Record, error) {
+	keyElems, err := tuple.Decode(key)
+	if err != nil {
+		return nil, err
+	}
+	valElems, err := tuple.Decode(val)
+	if err != nil {
+		return nil, err
+	}
+	elems := append(keyElems[1:], valElems...)
+	if len(elems) != len(def.Columns) {
+		return nil, fmt.Errorf("%w: %s: stored row has %d columns, not %d",
+			ErrBadRecord, def.Name, len(elems), len(def.Columns))
+	}
+	rec := Record{}
+	for i, col := range def.Columns {
+		rec[col.Name] = elems[i]
+	}
+	return rec, nil
+}
+
+// columnValue returns the value of col in rec converted to the type of the
+// column, nil if it's null or missing.
+func columnValue(def *TableDef, col Column, rec Record) (any, error) {
+	v := rec[col.Name]
+	if v == nil {
+		return nil, nil
+	}
+	if conv, ok := convert(col.Type, reflect.ValueOf(v)); ok {
+		return conv, nil
+	}
+	return nil, fmt.Errorf("%w: %s.%s: %T value for a %v column", ErrBadRecord, def.Name, col.Name, v, col.Type)
+}
+
+// Convert returns v as the Go type of the values of t, or false if v can't
+// be stored in a column of type t. nil stays nil.
+func (t ColumnType) Convert(v any) (any, bool) {
+	if v == nil {
+		return nil, true
+	}
+	return convert(t, reflect.ValueOf(v))
+}
+
+// any integer fits a numeric column as long as its value does
+func convert(t ColumnType, v reflect.Value) (any, bool) {
+	switch t {
+	case TYPE_INT64:
+		if v.CanInt() {
+			return v.Int(), true
+		}
+		if v.CanUint() && v.Uint() <= 1<<63-1 {
+			return int64(v.Uint()), true
+		}
+	case TYPE_UINT64:
+		if v.CanUint() {
+			return v.Uint(), true
+		}
+		if v.CanInt() && v.Int() >= 0 {
+			return uint64(v.Int()), true
+		}
+	case TYPE_FLOAT64:
+		if v.CanFloat() {
+			return v.Float(), true
+		}
+		if v.CanInt() {
+			return float64(v.Int()), true
+		}
+	case TYPE_STRING:
+		if v.Kind() == reflect.String {
+			return v.String(), true
+		}
+	case TYPE_BYTES:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Bytes(), true
+		}
+	case TYPE_BOOL:
+		if v.Kind() == reflect.Bool {
+			return v.Bool(), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,131 @@
+package relstore
+
+import (
+	"fmt"
+
+	"beaver/kvstore"
+	"beaver/tuple"
+)
+
+// Range selects rows by the leading columns of the primary key or of an
+// index. Start and End hold values for the first columns, in order; a row
+// is compared to them on those columns only, so Start: []any{"acme"} is
+// every row whose first column is "acme" onwards. A nil bound leaves that
+// side open. Like kvstore.ScanOptions, the range includes Start but not End
+// unless told otherwise.
+type Range struct {
+	Start        []any
+	End          []any
+	ExcludeStart bool
+	IncludeEnd   bool
+	Limit        int
+	Reverse      bool
+}
+
+// Scan returns the rows of table in primary key order.
+func (tx *Tx) Scan(table string, r Range) ([]Record, error) {
+	def, err := tx.table(table)
+	if err != nil {
+		return nil, err
+	}
+	return scanRows(tx.kv, def, nil, r)
+}
+
+// ScanIndex returns the rows of table in the order of index, selected by
+// the indexed columns.
+func (tx *Tx) ScanIndex(table, index string, r Range) ([]Record, error) {
+	def, err := tx.table(table)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := def.Index(index)
+	if err != nil {
+		return nil, err
+	}
+	return scanRows(tx.kv, def, idx, r)
+}
+
+// Scan and ScanIndex read the last committed version of the table.
+func (db *DB) Scan(table string, r Range) ([]Record, error) {
+	rtx := db.kv.BeginRead()
+	defer rtx.End()
+	def, err := db.table(rtx, table)
+	if err != nil {
+		return nil, err
+	}
+	return scanRows(rtx, def, nil, r)
+}
+
+func (db *DB) ScanIndex(table, index string, r Range) ([]Record, error) {
+	rtx := db.kv.BeginRead()
+	defer rtx.End()
+	def, err := db.table(rtx, table)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := def.Index(index)
+	if err != nil {
+		return nil, err
+	}
+	return scanRows(rtx, def, idx, r)
+}
+
+// scanRows scans the rows of def, or the entries of index if not nil, and
+// fetches the rows they point to.
+func scanRows(kv kvReader, def *TableDef, index *IndexDef, r Range) ([]Record, error) {
+	prefix, cols := def.Prefix, def.Columns[:def.PKeys]
+	if index != nil {
+		prefix, cols = index.Prefix, def.columns(index.Columns)
+	}
+	start, end, err := rangeKeys(def, prefix, cols, r)
+	if err != nil {
+		return nil, err
+	}
+	pairs, err := kv.Scan(start, end, kvstore.ScanOptions{Limit: r.Limit, Reverse: r.Reverse})
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]Record, 0, len(pairs))
+	for _, pair := range pairs {
+		if index == nil {
+			row, err := decodeRow(def, pair.Key, pair.Val)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+			continue
+		}
+		pkey, err := decodeIndexKey(def, index, pair.Key)
+		if err != nil {
+			return nil, err
+		}
+		row, ok, err := getRow(kv, def, pkey)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: %s.%s: entry without a row", ErrBadRecord, def.Name, index.Name)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// rangeKeys turns r into a KV key range [start, end). Every key extending an
+// encoded bound sorts right after it, up to tuple.PrefixEnd of the bound.
+func rangeKeys(def *TableDef, prefix uint64, cols []Column, r Range) (start, end []byte, err error) {
+	if start, err = encodePrefix(def, prefix, cols, r.Start); err != nil {
+		return nil, nil, err
+	}
+	if r.Start != nil && r.ExcludeStart {
+		start = tuple.PrefixEnd(start)
+	}
+	if end, err = encodePrefix(def, prefix, cols, r.End); err != nil {
+		return nil, nil, err
+	}
+	if r.End == nil || r.IncludeEnd {
+		end = tuple.PrefixEnd(end)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,253 @@
+package relstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"beaver/kvstore"
+	"beaver/tuple"
+)
+
+// ColumnType is the type of the values of a column. Each maps to one tuple
+// element type, which is how the values are stored.
+type ColumnType int
+
+const (
+	TYPE_INT64 ColumnType = iota + 1
+	TYPE_UINT64
+	TYPE_FLOAT64
+	TYPE_STRING
+	TYPE_BYTES
+	TYPE_BOOL
+)
+
+var typeNames = map[ColumnType]string{
+	TYPE_INT64:   "int64",
+	TYPE_UINT64:  "uint64",
+	TYPE_FLOAT64: "float64",
+	TYPE_STRING:  "string",
+	TYPE_BYTES:   "bytes",
+	TYPE_BOOL:    "bool",
+}
+
+func (t ColumnType) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ColumnType(%d)", int(t))
+}
+
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// TableDef describes a table. The first PKeys columns form the primary key,
+// which can't be null. Prefix is assigned by CreateTable: every key of the
+// table starts with it.
+type TableDef struct {
+	Name    string
+	Columns []Column
+	PKeys   int
+	Indexes []IndexDef
+	Prefix  uint64
+}
+
+// IndexDef is a secondary index over some columns of a table, updated in the
+// same transaction as the rows. In a unique index no two rows can have the
+// same values in Columns, unless one of them is null. Like the table, each
+// index gets its own key prefix from CreateTable.
+type IndexDef struct {
+	Name    string
+	Columns []string
+	Unique  bool
+	Prefix  uint64
+}
+
+// The catalog lives in the same KV as the tables, under prefixes reserved
+// below TABLE_PREFIX_MIN:
+//
+//	(CATALOG_META, name)   -> tuple-encoded value, e.g. the next free prefix
+//	(CATALOG_TABLES, name) -> JSON-encoded TableDef
+const (
+	CATALOG_META     = 1
+	CATALOG_TABLES   = 2
+	TABLE_PREFIX_MIN = 100
+)
+
+var (
+	ErrTableExists   = errors.New("table already exists")
+	ErrTableNotFound = errors.New("table not found")
+	ErrBadSchema     = errors.New("bad table definition")
+	ErrIndexNotFound = errors.New("index not found")
+)
+
+func (def *TableDef) Column(name string) (Column, int, bool) {
+	for i, col := range def.Columns {
+		if col.Name == name {
+			return col, i, true
+		}
+	}
+	return Column{}, -1, false
+}
+
+func checkTableDef(def *TableDef) error {
+	if def.Name == "" || strings.HasPrefix(def.Name, "@") {
+		return fmt.Errorf("%w: bad table name %q", ErrBadSchema, def.Name)
+	}
+	if def.PKeys < 1 || def.PKeys > len(def.Columns) {
+		return fmt.Errorf("%w: %s: %d primary key columns out of %d",
+			ErrBadSchema, def.Name, def.PKeys, len(def.Columns))
+	}
+	seen := map[string]bool{}
+	for _, col := range def.Columns {
+		if col.Name == "" || seen[col.Name] {
+			return fmt.Errorf("%w: %s: empty or duplicate column name %q", ErrBadSchema, def.Name, col.Name)
+		}
+		if _, ok := typeNames[col.Type]; !ok {
+			return fmt.Errorf("%w: %s.%s: unknown type %v", ErrBadSchema, def.Name, col.Name, col.Type)
+		}
+		seen[col.Name] = true
+	}
+
+	names := map[string]bool{}
+	for _, index := range def.Indexes {
+		if index.Name == "" || names[index.Name] {
+			return fmt.Errorf("%w: %s: empty or duplicate index name %q", ErrBadSchema, def.Name, index.Name)
+		}
+		if len(index.Columns) == 0 {
+			return fmt.Errorf("%w: %s: index %s has no columns", ErrBadSchema, def.Name, index.Name)
+		}
+		for _, name := range index.Columns {
+			if !seen[name] {
+				return fmt.Errorf("%w: %s: index %s on unknown column %q", ErrBadSchema, def.Name, index.Name, name)
+			}
+		}
+		names[index.Name] = true
+	}
+	return nil
+}
+
+func (def *TableDef) Index(name string) (*IndexDef, error) {
+	for i := range def.Indexes {
+		if def.Indexes[i].Name == name {
+			return &def.Indexes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s.%s", ErrIndexNotFound, def.Name, name)
+}
+
+// columns returns the definitions of the named columns, which exist.
+func (def *TableDef) columns(names []string) []Column {
+	cols := make([]Column, 0, len(names))
+	for _, name := range names {
+		col, _, _ := def.Column(name)
+		cols = append(cols, col)
+	}
+	return cols
+}
+
+func catalogKey(space uint64, name string) []byte {
+	key, _ := tuple.Encode(space, name)
+	return key
+}
+
+func getTableDef(kv kvReader, name string) (*TableDef, error) {
+	data, err := kv.Get(catalogKey(CATALOG_TABLES, name))
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	} else if err != nil {
+		return nil, err
+	}
+	def := &TableDef{}
+	if err := json.Unmarshal(data, def); err != nil {
+		return nil, fmt.Errorf("table %s: bad catalog entry: %w", name, err)
+	}
+	return def, nil
+}
+
+// CreateTable records def in the catalog, giving the table and each of its
+// indexes the next free prefixes. def itself is left as is: the prefixes
+// are those of the definition returned by Table.
+func (tx *Tx) CreateTable(def *TableDef) error {
+	if err := checkTableDef(def); err != nil {
+		return err
+	}
+	// a transaction that aborts must not leave prefixes behind
+	copied := *def
+	copied.Indexes = slices.Clone(def.Indexes)
+	def = &copied
+	if _, err := tx.kv.Get(catalogKey(CATALOG_TABLES, def.Name)); err == nil {
+		return fmt.Errorf("%w: %s", ErrTableExists, def.Name)
+	} else if !errors.Is(err, kvstore.ErrNotFound) {
+		return err
+	}
+
+	prefix := uint64(TABLE_PREFIX_MIN)
+	nextKey := catalogKey(CATALOG_META, "next_prefix")
+	if data, err := tx.kv.Get(nextKey); err == nil {
+		elems, err := tuple.Decode(data)
+		if err != nil || len(elems) != 1 {
+			return fmt.Errorf("%w: bad next_prefix in catalog: %v", kvstore.ErrCorrupt, data)
+		}
+		var ok bool
+		if prefix, ok = elems[0].(uint64); !ok {
+			return fmt.Errorf("%w: bad next_prefix in catalog: %v", kvstore.ErrCorrupt, elems[0])
+		}
+	} else if !errors.Is(err, kvstore.ErrNotFound) {
+		return err
+	}
+	next, _ := tuple.Encode(prefix + 1 + uint64(len(def.Indexes)))
+	if err := tx.kv.Set(nextKey, next); err != nil {
+		return err
+	}
+
+	def.Prefix = prefix
+	for i := range def.Indexes {
+		def.Indexes[i].Prefix = prefix + 1 + uint64(i)
+	}
+	data, err := json.Marshal(def)
+	if err != nil {
+		return err
+	}
+	if err := tx.kv.Set(catalogKey(CATALOG_TABLES, def.Name), data); err != nil {
+		return err
+	}
+	tx.created[def.Name] = def
+	return nil
+}
+
+// Table returns the definition of a table, as seen by the transaction.
+func (tx *Tx) Table(name string) (*TableDef, error) {
+	return tx.table(name)
+}
+
+func (tx *Tx) table(name string) (*TableDef, error) {
+	if def, ok := tx.created[name]; ok {
+		return def, nil
+	}
+	return tx.db.table(tx.kv, name)
+}
+
+// Tables never change once created, so the committed definitions are kept
+// around instead of being decoded on every access.
+func (db *DB) table(kv kvReader, name string) (*TableDef, error) {
+	db.mu.Lock()
+	def, ok := db.tables[name]
+	db.mu.Unlock()
+	if ok {
+		return def, nil
+	}
+
+	def, err := getTableDef(kv, name)
+	if err != nil {
+		return nil, err
+	}
+	db.mu.Lock()
+	db.tables[name] = def
+	db.mu.Unlock()
+	return def, nil
+}
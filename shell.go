@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"beaver/kvstore"
+)
+
+// encoding turns keys and values into text and back.
+type encoding struct {
+	encode func([]byte) string
+	decode func(string) ([]byte, error)
+}
+
+var encodings = map[string]encoding{
+	"text": {
+		encode: func(data []byte) string { return string(data) },
+		decode: func(s string) ([]byte, error) { return []byte(s), nil },
+	},
+	"hex": {
+		encode: hex.EncodeToString,
+		decode: hex.DecodeString,
+	},
+	"base64": {
+		encode: base64.StdEncoding.EncodeToString,
+		decode: base64.StdEncoding.DecodeString,
+	},
+}
+
+// shell runs commands on an open database.
+type shell struct {
+	db     *kvstore.KV
+	out    io.Writer
+	format encoding
+	input  encoding
+}
+
+type command struct {
+	name    string
+	args    string
+	help    string
+	minArgs int
+	maxArgs int // -1 for any number
+	run     func(sh *shell, args []string) error
+}
+
+var commands []command
+
+// set in init, as help refers to commands
+func init() {
+	commands = []command{
+		{"get", "<key>", "print the value of key", 1, 1, (*shell).get},
+		{"set", "<key> <value>", "set the value of key", 2, 2, (*shell).set},
+		{"del", "<key>", "delete key", 1, 1, (*shell).del},
+		{"scan", "[-limit n] [-reverse] [-prefix p] [start [end]]", "print the pairs from start to end, end excluded", 0, -1, (*shell).scan},
+		{"stat", "", "print information about the database", 0, 0, (*shell).stat},
+		{"check", "", "verify that every page is used once and the tree is sound", 0, 0, (*shell).check},
+		{"compact", "[copy-path]", "shrink the file, or write a compacted copy to copy-path", 0, 1, (*shell).compact},
+		{"help", "", "list the commands", 0, 0, (*shell).help},
+	}
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func printCommands(w io.Writer) {
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-7s %-48s %s\n", cmd.name, cmd.args, cmd.help)
+	}
+}
+
+func (sh *shell) exec(args []string) error {
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		return fmt.Errorf("%w: unknown command %q, try help", errUsage, args[0])
+	}
+	args = args[1:]
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		return fmt.Errorf("%w: %s %s", errUsage, cmd.name, cmd.args)
+	}
+	return cmd.run(sh, args)
+}
+
+// repl runs the commands read from in, one per line, until EOF or exit.
+// Arguments holding spaces can be quoted with ' or ". A failed command is
+// reported on errOut and doesn't stop the shell.
+func (sh *shell) repl(in io.Reader, errOut io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for {
+		fmt.Fprint(sh.out, "beaver> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(sh.out)
+			return scanner.Err()
+		}
+		args, err := splitArgs(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(errOut, "error: %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" || args[0] == "quit" {
+			return nil
+		}
+		if err := sh.exec(args); err != nil {
+			fmt.Fprintf(errOut, "error: %v\n", err)
+		}
+	}
+}
+
+func splitArgs(line string) ([]string, error) {
+	args := []string{}
+	var cur strings.Builder
+	inArg := false
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			cur.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("%w: unterminated quote", errUsage)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
+
+func (sh *shell) decode(arg string) ([]byte, error) {
+	data, err := sh.input.decode(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %v", errUsage, arg, err)
+	}
+	return data, nil
+}
+
+func (sh *shell) get(args []string) error {
+	key, err := sh.decode(args[0])
+	if err != nil {
+		return err
+	}
+	val, err := sh.db.Get(key)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, args[0])
+	}
+	fmt.Fprintln(sh.out, sh.format.encode(val))
+	return nil
+}
+
+func (sh *shell) set(args []string) error {
+	key, err := sh.decode(args[0])
+	if err != nil {
+		return err
+	}
+	val, err := sh.decode(args[1])
+	if err != nil {
+		return err
+	}
+	return sh.db.Set(key, val)
+}
+
+func (sh *shell) del(args []string) error {
+	key, err := sh.decode(args[0])
+	if err != nil {
+		return err
+	}
+	if _, err := sh.db.Del(key); err != nil {
+		return fmt.Errorf("%w: %s", err, args[0])
+	}
+	return nil
+}
+
+func (sh *shell) scan(args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	limit := flags.Int("limit", 0, "")
+	reverse := flags.Bool("reverse", false, "")
+	prefix := flags.String("prefix", "", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 2 || (*prefix != "" && flags.NArg() > 0) {
+		cmd, _ := findCommand("scan")
+		return fmt.Errorf("%w: scan %s", errUsage, cmd.args)
+	}
+
+	opts := kvstore.ScanOptions{Limit: *limit, Reverse: *reverse}
+	var pairs []kvstore.KVPair
+	if *prefix != "" {
+		p, err := sh.decode(*prefix)
+		if err != nil {
+			return err
+		}
+		if pairs, err = sh.db.ScanPrefix(p, opts); err != nil {
+			return err
+		}
+	} else {
+		bounds := make([][]byte, 2)
+		for i, arg := range flags.Args() {
+			var err error
+			if bounds[i], err = sh.decode(arg); err != nil {
+				return err
+			}
+		}
+		var err error
+		if pairs, err = sh.db.Scan(bounds[0], bounds[1], opts); err != nil {
+			return err
+		}
+	}
+
+	for _, pair := range pairs {
+		fmt.Fprintf(sh.out, "%s\t%s\n", sh.format.encode(pair.Key), sh.format.encode(pair.Val))
+	}
+	return nil
+}
+
+func (sh *shell) stat(args []string) error {
+	stats := sh.db.Stat()
+	for _, line := range []struct {
+		name string
+		val  any
+	}{
+		{"path", stats.Path},
+		{"page size", stats.PageSize},
+		{"prefix compression", stats.PrefixCompression},
+		{"comparator", stats.Comparator},
+		{"txid", stats.Txid},
+		{"pages", stats.Pages},
+		{"free pages", stats.FreePages},
+		{"file size", stats.FileSize},
+		{"wal", stats.WAL},
+	} {
+		fmt.Fprintf(sh.out, "%-19s %v\n", line.name+":", line.val)
+	}
+	return nil
+}
+
+func (sh *shell) check(args []string) error {
+	return printReport(sh.out, sh.db.Verify())
+}
+
+func (sh *shell) compact(args []string) error {
+	if len(args) == 1 {
+		return sh.db.CopyTo(args[0])
+	}
+	before := sh.db.Stat()
+	if err := sh.db.Compact(); err != nil {
+		return err
+	}
+	after := sh.db.Stat()
+	fmt.Fprintf(sh.out, "pages: %d -> %d\n", before.Pages, after.Pages)
+	fmt.Fprintf(sh.out, "file size: %d -> %d\n", before.FileSize, after.FileSize)
+	return nil
+}
+
+// printReport prints what a check found, failing if it isn't OK.
+func printReport(w io.Writer, report *kvstore.CheckReport) error {
+	for _, line := range []struct {
+		name string
+		val  any
+	}{
+		{"txid", report.Txid},
+		{"pages", report.Pages},
+		{"tree pages", report.TreePages},
+		{"freelist pages", report.FreelistPages},
+		{"free pages", report.FreePages},
+		{"keys", report.Keys},
+	} {
+		fmt.Fprintf(w, "%-19s %v\n", line.name+":", line.val)
+	}
+	for _, problem := range report.Problems {
+		fmt.Fprintln(w, problem)
+	}
+	if !report.OK() {
+		return fmt.Errorf("check: %d problems found", len(report.Problems))
+	}
+	return nil
+}
+
+func (sh *shell) help(args []string) error {
+	printCommands(sh.out)
+	fmt.Fprintf(sh.out, "  %-7s %-48s %s\n", "exit", "", "leave the shell")
+	return nil
+}
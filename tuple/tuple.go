@@ -0,0 +1,212 @@
+// Package tuple encodes tuples of typed values into byte keys that sort, under
+// bytes.Compare, the way the tuples do element by element. Keys built with it
+// can be stored in a kvstore.KV with the default comparator and scanned by
+// range or by tuple prefix: the encoding of a tuple is a prefix of the
+// encoding of any longer tuple starting with the same elements.
+//
+// Supported elements are nil, bool, int64, uint64, float64, string and []byte.
+// Smaller Go integer and float types are widened on encoding; decoding always
+// gives back the types above. Elements of different types order by type:
+//
+//	nil < []byte < string < int64 < uint64 < float64 < false < true
+package tuple
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Each element starts with a tag byte giving its type. Integers and floats
+// follow in 8 big-endian bytes, transformed so they compare as unsigned
+// numbers. Bytes and strings are terminated by 0x00, a 0x00 inside them is
+// escaped as 0x00 0xff.
+const (
+	TAG_NULL   = 0x01
+	TAG_BYTES  = 0x02
+	TAG_STRING = 0x03
+	TAG_INT    = 0x04
+	TAG_UINT   = 0x05
+	TAG_FLOAT  = 0x06
+	TAG_FALSE  = 0x07
+	TAG_TRUE   = 0x08
+
+	TERMINATOR = 0x00
+	ESCAPE     = 0xff
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported tuple element type")
+	ErrMalformed       = errors.New("malformed tuple")
+)
+
+// Encode returns the key of the tuple elems.
+func Encode(elems ...any) ([]byte, error) {
+	return Append(nil, elems...)
+}
+
+// Append appends the encoding of elems to dst. Encoding a tuple piece by piece
+// gives the same key as encoding it at once.
+func Append(dst []byte, elems ...any) ([]byte, error) {
+	for i, elem := range elems {
+		var err error
+		if dst, err = appendElem(dst, elem); err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+	}
+	return dst, nil
+}
+
+// PrefixEnd returns the smallest key above the keys of every tuple starting
+// with the tuple key. Unlike a plain byte prefix end, it leaves out longer
+// strings and bytes that only share a prefix with the last element of key:
+// tags are below ESCAPE, while a longer string escapes a 0x00 with it.
+func PrefixEnd(key []byte) []byte {
+	return append(append(make([]byte, 0, len(key)+1), key...), ESCAPE)
+}
+
+func appendElem(dst []byte, elem any) ([]byte, error) {
+	switch v := elem.(type) {
+	case nil:
+		return append(dst, TAG_NULL), nil
+	case bool:
+		if v {
+			return append(dst, TAG_TRUE), nil
+		}
+		return append(dst, TAG_FALSE), nil
+	case []byte:
+		return appendEscaped(append(dst, TAG_BYTES), v), nil
+	case string:
+		return appendEscaped(append(dst, TAG_STRING), []byte(v)), nil
+	case int:
+		return appendInt(dst, int64(v)), nil
+	case int8:
+		return appendInt(dst, int64(v)), nil
+	case int16:
+		return appendInt(dst, int64(v)), nil
+	case int32:
+		return appendInt(dst, int64(v)), nil
+	case int64:
+		return appendInt(dst, v), nil
+	case uint:
+		return appendUint(dst, uint64(v)), nil
+	case uint8:
+		return appendUint(dst, uint64(v)), nil
+	case uint16:
+		return appendUint(dst, uint64(v)), nil
+	case uint32:
+		return appendUint(dst, uint64(v)), nil
+	case uint64:
+		return appendUint(dst, v), nil
+	case float32:
+		return appendFloat(dst, float64(v)), nil
+	case float64:
+		return appendFloat(dst, v), nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedType, elem)
+}
+
+func appendEscaped(dst, data []byte) []byte {
+	for _, b := range data {
+		dst = append(dst, b)
+		if b == TERMINATOR {
+			dst = append(dst, ESCAPE)
+		}
+	}
+	return append(dst, TERMINATOR)
+}
+
+// flipping the sign bit puts the negative numbers below the positive ones
+func appendInt(dst []byte, v int64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, TAG_INT), uint64(v)^(1<<63))
+}
+
+func appendUint(dst []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, TAG_UINT), v)
+}
+
+// positive floats get their sign bit set, negative ones have every bit
+// flipped so a larger magnitude sorts lower
+func appendFloat(dst []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, TAG_FLOAT), floatBits(v))
+}
+
+func floatBits(v float64) uint64 {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		return ^bits
+	}
+	return bits | 1<<63
+}
+
+func floatFromBits(bits uint64) float64 {
+	if bits&(1<<63) != 0 {
+		return math.Float64frombits(bits &^ (1 << 63))
+	}
+	return math.Float64frombits(^bits)
+}
+
+// Decode returns the elements of the tuple encoded in key.
+func Decode(key []byte) ([]any, error) {
+	elems := make([]any, 0)
+	for len(key) > 0 {
+		elem, rest, err := decodeElem(key)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", len(elems), err)
+		}
+		elems = append(elems, elem)
+		key = rest
+	}
+	return elems, nil
+}
+
+func decodeElem(key []byte) (any, []byte, error) {
+	tag, key := key[0], key[1:]
+	switch tag {
+	case TAG_NULL:
+		return nil, key, nil
+	case TAG_FALSE:
+		return false, key, nil
+	case TAG_TRUE:
+		return true, key, nil
+	case TAG_BYTES:
+		return decodeEscaped(key)
+	case TAG_STRING:
+		data, rest, err := decodeEscaped(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return string(data), rest, nil
+	case TAG_INT, TAG_UINT, TAG_FLOAT:
+		if len(key) < 8 {
+			return nil, nil, fmt.Errorf("%w: truncated number", ErrMalformed)
+		}
+		bits := binary.BigEndian.Uint64(key)
+		switch tag {
+		case TAG_INT:
+			return int64(bits ^ (1 << 63)), key[8:], nil
+		case TAG_UINT:
+			return bits, key[8:], nil
+		}
+		return floatFromBits(bits), key[8:], nil
+	}
+	return nil, nil, fmt.Errorf("%w: unknown tag 0x%02x", ErrMalformed, tag)
+}
+
+func decodeEscaped(key []byte) ([]byte, []byte, error) {
+	data := make([]byte, 0)
+	for i := 0; i < len(key); i++ {
+		if key[i] != TERMINATOR {
+			data = append(data, key[i])
+			continue
+		}
+		if i+1 < len(key) && key[i+1] == ESCAPE {
+			data = append(data, TERMINATOR)
+			i++
+			continue
+		}
+		return data, key[i+1:], nil
+	}
+	return nil, nil, fmt.Errorf("%w: unterminated bytes", ErrMalformed)
+}
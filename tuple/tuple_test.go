@@ -0,0 +1,189 @@
+package tuple
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	elems := []any{
+		nil, true, false,
+		int64(0), int64(-1), int64(math.MinInt64), int64(math.MaxInt64),
+		uint64(0), uint64(math.MaxUint64),
+		0.0, -2.5, math.Inf(1), math.Inf(-1),
+		"", "hello", "a\x00b\x00", []byte{}, []byte{0, 0xff, 0},
+	}
+	key, err := Encode(elems...)
+	assert.Nil(t, err)
+	decoded, err := Decode(key)
+	assert.Nil(t, err)
+	assert.Equal(t, elems, decoded)
+
+	// smaller types come back widened
+	key, err = Encode(int32(-7), uint8(7), float32(0.5), 3)
+	assert.Nil(t, err)
+	decoded, err = Decode(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []any{int64(-7), uint64(7), 0.5, int64(3)}, decoded)
+
+	// piece by piece is the same key
+	prefix, _ := Encode("users", int64(42))
+	whole, _ := Encode("users", int64(42), "name")
+	pieced, _ := Append(prefix, "name")
+	assert.Equal(t, whole, pieced)
+	assert.True(t, bytes.HasPrefix(whole, prefix))
+}
+
+func typeRank(v any) int {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case []byte:
+		return 1
+	case string:
+		return 2
+	case int64:
+		return 3
+	case uint64:
+		return 4
+	case float64:
+		return 5
+	case bool:
+		if v {
+			return 7
+		}
+		return 6
+	}
+	panic("unreachable")
+}
+
+func compareElem(a, b any) int {
+	if ra, rb := typeRank(a), typeRank(b); ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	case string:
+		return bytes.Compare([]byte(a), []byte(b.(string)))
+	case int64:
+		return cmp3(a < b.(int64), a > b.(int64))
+	case uint64:
+		return cmp3(a < b.(uint64), a > b.(uint64))
+	case float64:
+		return cmp3(a < b.(float64), a > b.(float64))
+	}
+	return 0
+}
+
+func cmp3(less, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
+
+func compareTuples(a, b []any) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareElem(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func randomElem(r *rand.Rand) any {
+	switch r.Intn(8) {
+	case 0:
+		return nil
+	case 1:
+		return []byte(randomString(r))
+	case 2:
+		return randomString(r)
+	case 3:
+		return r.Int63() - r.Int63()
+	case 4:
+		return r.Uint64() >> r.Intn(64)
+	case 5:
+		return r.NormFloat64() * math.Pow(10, float64(r.Intn(20)-10))
+	case 6:
+		return false
+	}
+	return true
+}
+
+// short strings over a tiny alphabet, so the escapes and shared prefixes
+// get exercised
+func randomString(r *rand.Rand) string {
+	s := make([]byte, r.Intn(4))
+	for i := range s {
+		s[i] = []byte{0, 1, 'a', 0xff}[r.Intn(4)]
+	}
+	return string(s)
+}
+
+func TestOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tuples := make([][]any, 2000)
+	for i := range tuples {
+		tuples[i] = make([]any, 1+r.Intn(3))
+		for j := range tuples[i] {
+			tuples[i][j] = randomElem(r)
+		}
+	}
+	sort.Slice(tuples, func(i, j int) bool { return compareTuples(tuples[i], tuples[j]) < 0 })
+
+	for i := 1; i < len(tuples); i++ {
+		a, err := Encode(tuples[i-1]...)
+		assert.Nil(t, err)
+		b, err := Encode(tuples[i]...)
+		assert.Nil(t, err)
+		assert.Equal(t, compareTuples(tuples[i-1], tuples[i]) < 0, bytes.Compare(a, b) < 0,
+			"%v vs %v", tuples[i-1], tuples[i])
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	key, _ := Encode("a", []byte{1})
+	end := PrefixEnd(key)
+	for _, tuple := range [][]any{
+		{"a", []byte{1}},
+		{"a", []byte{1}, nil},
+		{"a", []byte{1}, "x", true},
+	} {
+		k, _ := Encode(tuple...)
+		assert.True(t, bytes.Compare(key, k) <= 0 && bytes.Compare(k, end) < 0, "%v", tuple)
+	}
+	for _, tuple := range [][]any{
+		{"a", []byte{1, 0}},
+		{"a", []byte{1, 0, 2}},
+		{"a", []byte{2}},
+		{"a\x00"},
+	} {
+		k, _ := Encode(tuple...)
+		assert.False(t, bytes.Compare(key, k) <= 0 && bytes.Compare(k, end) < 0, "%v", tuple)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, err := Encode("ok", struct{}{})
+	assert.ErrorIs(t, err, ErrUnsupportedType)
+
+	for _, key := range [][]byte{
+		{0x42},
+		{TAG_INT, 1, 2, 3},
+		{TAG_STRING, 'a', 'b'},
+		{TAG_BYTES, 'a', TERMINATOR, ESCAPE},
+	} {
+		_, err := Decode(key)
+		assert.ErrorIs(t, err, ErrMalformed, "%v", key)
+	}
+}